@@ -1,15 +1,32 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"log"
 	"metricapp/internal/agent"
+	"metricapp/internal/config"
 	"metricapp/internal/logger"
+	"os"
 )
 
 func main() {
-	logger.InitLogger()
-	collector := agent.NewCollector()
-	flag.Parse()
+	cfg, err := config.LoadAgent(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal("failed to load config: ", err)
+	}
+
+	if err := logger.Init(cfg.Log); err != nil {
+		log.Fatal("failed to init logger: ", err)
+	}
+
+	collector := agent.NewCollector(cfg)
+	collector.SetReload(func() (*config.Agent, error) {
+		return config.LoadAgent(os.Args[1:])
+	})
 
 	logger.Info("Starting metrics collection")
 	collector.Run()
@@ -1,10 +1,27 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"log"
+	"metricapp/internal/config"
 	"metricapp/internal/server"
+	"os"
 )
 
 func main() {
-	server := server.MetricServer{}
-	server.Start()
+	cfg, err := config.LoadServer(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal("failed to load config: ", err)
+	}
+
+	server := server.MetricServer{
+		Reload: func() (*config.Server, error) {
+			return config.LoadServer(os.Args[1:])
+		},
+	}
+	server.Start(cfg)
 }
@@ -1,34 +1,37 @@
 package agent
 
 import (
-	"bytes"
-	"encoding/json"
-	"flag"
-	"fmt"
+	"context"
 	"math/rand"
+	"metricapp/internal/config"
 	"metricapp/internal/logger"
 	models "metricapp/internal/model"
 	"metricapp/internal/repository"
-	"metricapp/internal/utils"
-	"metricapp/internal/zip"
-	"net/http"
+	"metricapp/pkg/client"
 	"os"
 	"os/signal"
 	"runtime"
 	"syscall"
 	"time"
 
-	"github.com/caarlos0/env/v11"
 	"go.uber.org/zap"
 )
 
 type MetricCollector struct {
-	pollInterval   int
-	reportInterval int
+	pollInterval   time.Duration
+	reportInterval time.Duration
 	reportHost     string
 	repo           Repo[models.Metrics]
+	client         *client.Client
+	log            *zap.Logger
+	cfg            config.Agent
+	reload         func() (*config.Agent, error)
+	delivery       *deliveryStats
 }
 
+// Ключи конфигурации агента, которые применяются без перезапуска
+var liveAgentKeys = []string{"address", "poll_interval", "report_interval", "log"}
+
 type Repo[T any] interface {
 	SetField(string, T)
 	GetFields() map[string]T
@@ -38,42 +41,48 @@ type Repo[T any] interface {
 	})
 }
 
-func NewCollector() *MetricCollector {
-	newCollector := MetricCollector{
-		repo: repository.NewAgentMemoryStorage(),
-	}
-
-	var cfg struct {
-		Address        string `env:"ADDRESS"`
-		ReportInterval int    `env:"REPORT_INTERVAL"`
-		PollInterval   int    `env:"POLL_INTERVAL"`
-	}
-
-	err := env.Parse(&cfg)
-	if err == nil {
-		newCollector.reportHost = cfg.Address
-		newCollector.reportInterval = cfg.ReportInterval
-		newCollector.pollInterval = cfg.PollInterval
+func NewCollector(cfg *config.Agent) *MetricCollector {
+	return &MetricCollector{
+		repo:           repository.NewAgentMemoryStorage(),
+		reportHost:     cfg.Address,
+		reportInterval: cfg.ReportInterval.Duration,
+		pollInterval:   cfg.PollInterval.Duration,
+		cfg:            *cfg,
+		delivery:       &deliveryStats{},
 	}
+}
 
-	if newCollector.reportHost == "" {
-		flag.StringVar(&newCollector.reportHost, "a", "localhost:8080", "URL адрес сервера сбора метрик")
-	}
-	if newCollector.pollInterval == 0 {
-		flag.IntVar(&newCollector.pollInterval, "p", 2, "Промежуток времени сбора метрик")
-	}
-	if newCollector.reportInterval == 0 {
-		flag.IntVar(&newCollector.reportInterval, "r", 10, "Промежуток времени отправки данных на сервер")
-	}
+// SetReload задает функцию, которой коллектор перечитывает конфигурацию по SIGHUP.
+// Накопленные метрики при этом сохраняются.
+func (mc *MetricCollector) SetReload(fn func() (*config.Agent, error)) {
+	mc.reload = fn
+}
 
-	return &newCollector
+// SetLogger подменяет логгер коллектора, по умолчанию используется глобальный
+func (mc *MetricCollector) SetLogger(l *zap.Logger) {
+	mc.log = l
 }
 
 func (mc *MetricCollector) Run() {
-	collectTicker := time.NewTicker(time.Duration(mc.pollInterval) * time.Second)
-	sendTicker := time.NewTicker(time.Duration(mc.reportInterval) * time.Second)
+	mc.client = mc.newClient()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if mc.log != nil {
+		ctx = logger.WithLogger(ctx, mc.log)
+	}
+
+	collectTicker := time.NewTicker(mc.pollInterval)
+	sendTicker := time.NewTicker(mc.reportInterval)
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer func() {
+		collectTicker.Stop()
+		sendTicker.Stop()
+		signal.Stop(sigs)
+		signal.Stop(hup)
+	}()
 
 	// "Нинада goto. Почему не continue?"
 	//
@@ -89,13 +98,74 @@ loop:
 		case <-collectTicker.C:
 			mc.collect()
 		case <-sendTicker.C:
-			mc.sendMetricsAsBatch()
+			mc.sendMetricsAsBatch(ctx)
+		case <-hup:
+			if mc.applyReload(ctx) {
+				collectTicker.Reset(mc.pollInterval)
+				sendTicker.Reset(mc.reportInterval)
+			}
 		case <-sigs:
 			break loop
 		}
 	}
 }
 
+// newClient создает клиента к текущему адресу сервера. Агент представляется именем хоста,
+// чтобы сервер считал лимит запросов для каждого агента отдельно, а не для общего IP.
+func (mc *MetricCollector) newClient() *client.Client {
+	opts := []client.Option{client.WithRetryHook(mc.delivery.observeRetry)}
+	if host, err := os.Hostname(); err == nil {
+		opts = append(opts, client.WithAgentID(host))
+	}
+
+	return client.New(mc.reportHost, opts...)
+}
+
+// applyReload перечитывает конфигурацию и применяет изменения, возвращает true, если что-то поменялось
+func (mc *MetricCollector) applyReload(ctx context.Context) bool {
+	log := logger.Ctx(ctx)
+	if mc.reload == nil {
+		log.Warn("configuration reload is not supported")
+		return false
+	}
+
+	newCfg, err := mc.reload()
+	if err != nil {
+		log.Error("failed to reload configuration", zap.Error(err))
+		return false
+	}
+
+	apply, restart := config.SplitKeys(config.ChangedKeys(&mc.cfg, newCfg), liveAgentKeys...)
+	if len(restart) > 0 {
+		log.Warn("configuration keys require restart", zap.Strings("keys", restart))
+	}
+	if len(apply) == 0 {
+		log.Info("configuration reloaded, nothing to apply")
+		return false
+	}
+
+	if newCfg.Log != mc.cfg.Log {
+		if err := logger.Init(newCfg.Log); err != nil {
+			log.Error("failed to apply logger configuration", zap.Error(err))
+			newCfg.Log = mc.cfg.Log
+		}
+	}
+	if newCfg.Address != mc.cfg.Address {
+		mc.reportHost = newCfg.Address
+		mc.client = mc.newClient()
+	}
+	mc.pollInterval = newCfg.PollInterval.Duration
+	mc.reportInterval = newCfg.ReportInterval.Duration
+
+	mc.cfg.Address = newCfg.Address
+	mc.cfg.PollInterval = newCfg.PollInterval
+	mc.cfg.ReportInterval = newCfg.ReportInterval
+	mc.cfg.Log = newCfg.Log
+
+	logger.Ctx(ctx).Info("configuration reloaded", zap.Strings("applied", apply))
+	return true
+}
+
 func (mc *MetricCollector) collect() {
 	var mStat runtime.MemStats
 	runtime.ReadMemStats(&mStat)
@@ -132,8 +202,8 @@ func (mc *MetricCollector) collect() {
 	mc.repo.IncrementCounter()
 }
 
-func (mc *MetricCollector) sendMetrics() {
-	logger.Info("Sending data to server...")
+func (mc *MetricCollector) sendMetrics(ctx context.Context) {
+	logger.Ctx(ctx).Info("Sending data to server...")
 	metrics := mc.repo.GetFields()
 
 	// Запрашивем изменение метрик типа gauge
@@ -142,9 +212,9 @@ func (mc *MetricCollector) sendMetrics() {
 			continue
 		}
 
-		err := deliverMetric(metric, mc.reportHost)
+		err := mc.client.Update(ctx, metric)
 		if err != nil {
-			logger.Error(
+			logger.Ctx(ctx).Error(
 				"failed to send metric",
 				zap.String("ID", metric.ID),
 				zap.Error(err),
@@ -153,103 +223,58 @@ func (mc *MetricCollector) sendMetrics() {
 	}
 
 	// Отдельно отправляем счетчик
-	pCount := metrics["PollCounter"]
-	pCount.ID = "PollCount"
-	err := deliverMetric(pCount, mc.reportHost)
-	logger.Error(
-		"failed to send metric",
-		zap.String("ID", pCount.ID),
-		zap.Error(err),
-	)
-}
-
-func (mc *MetricCollector) sendMetricsAsBatch() {
-	var req []models.Metrics
-
-	metrics := mc.repo.GetFields()
-
-	for _, m := range metrics {
-		req = append(req, m)
+	pCount, ok := pollCount(metrics)
+	if !ok {
+		return
 	}
-
-	pCount := metrics["PollCounter"]
-	pCount.ID = "PollCount"
-	req = append(req, pCount)
-
-	err := deliverMetrics(req, mc.reportHost)
-
+	err := mc.client.Update(ctx, pCount)
 	if err != nil {
-		logger.Error("failed to send batch", zap.Error(err))
+		logger.Ctx(ctx).Error(
+			"failed to send metric",
+			zap.String("ID", pCount.ID),
+			zap.Error(err),
+		)
 	}
 }
 
-func deliverMetric(metric models.Metrics, reportHost string) error {
-	b, err := json.Marshal(metric)
-	if err != nil {
-		return fmt.Errorf("failed to marshal data: %w", err)
-	}
-
-	b, err = zip.GzipCompress(b)
-	if err != nil {
-		return fmt.Errorf("failed to compress data: %w", err)
+// pollCount - счетчик опросов под именем PollCount. До первого опроса его нет,
+// а пустая метрика без типа отвергла бы на сервере весь пакет.
+func pollCount(metrics map[string]models.Metrics) (models.Metrics, bool) {
+	m, ok := metrics["PollCounter"]
+	if !ok || m.MType != models.Counter {
+		return models.Metrics{}, false
 	}
+	m.ID = "PollCount"
 
-	r := bytes.NewReader(b)
+	return m, true
+}
 
-	url := fmt.Sprintf("http://%s/update/", reportHost)
-	req, err := http.NewRequest(http.MethodPost, url, r)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("Content-Encoding", "gzip")
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
-	}
-	defer func() {
-		err := resp.Body.Close()
-		if err != nil {
-			logger.Error(
-				"failed to close response body",
-				zap.Error(err),
-			)
-		}
-	}()
+func (mc *MetricCollector) sendMetricsAsBatch(ctx context.Context) {
+	var req []models.Metrics
 
-	return nil
-}
+	metrics := mc.repo.GetFields()
 
-func deliverMetrics(metrics []models.Metrics, reportHost string) error {
-	b, err := json.Marshal(metrics)
-	if err != nil {
-		return fmt.Errorf("failed to marshal data: %w", err)
+	for _, m := range metrics {
+		req = append(req, m)
 	}
 
-	b, err = zip.GzipCompress(b)
-	if err != nil {
-		return fmt.Errorf("failed to compress data: %w", err)
+	if pCount, ok := pollCount(metrics); ok {
+		req = append(req, pCount)
 	}
 
-	r := bytes.NewReader(b)
+	delivery := mc.delivery.drain()
+	req = append(req, delivery...)
 
-	url := fmt.Sprintf("http://%s/updates/", reportHost)
-	req, err := http.NewRequest(http.MethodPost, url, r)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("Content-Encoding", "gzip")
-	req.Header.Set("Content-Type", "application/json")
+	// Один идентификатор на пакет, чтобы найти его в логах сервера
+	id := logger.NewRequestID()
+	ctx = logger.WithRequestID(client.WithRequestID(ctx, id), id)
+	logger.Ctx(ctx).Info("sending batch", zap.Int("size", len(req)))
 
-	resp, err := utils.DefaultClient.Do(req)
+	start := time.Now()
+	err := mc.client.UpdateBatch(ctx, req)
+	mc.delivery.observeSend(time.Since(start), err)
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		mc.delivery.restore(delivery)
+		logger.Ctx(ctx).Error("failed to send batch", zap.Error(err))
 	}
-	defer func() {
-		if cerr := resp.Body.Close(); cerr != nil {
-			logger.Error("failed to close response body", zap.Error(cerr))
-		}
-	}()
-
-	return nil
 }
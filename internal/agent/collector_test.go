@@ -1,20 +1,26 @@
 package agent
 
 import (
-	"flag"
-	"log"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"metricapp/internal/config"
 	"metricapp/internal/logger"
+	models "metricapp/internal/model"
+	"metricapp/pkg/client"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestMetricCollector_Run(t *testing.T) {
-	collector := NewCollector()
-	flag.Parse()
 	done := make(chan bool)
 	var n atomic.Uint64
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -25,8 +31,11 @@ func TestMetricCollector_Run(t *testing.T) {
 	}))
 
 	logger.InitLogger()
-	flag.Set("a", strings.TrimPrefix(server.URL, "http://"))
-	log.Println(collector.reportHost)
+	cfg := config.DefaultAgent()
+	cfg.Address = strings.TrimPrefix(server.URL, "http://")
+	cfg.PollInterval = config.Duration{Duration: 100 * time.Millisecond}
+	cfg.ReportInterval = config.Duration{Duration: 500 * time.Millisecond}
+	collector := NewCollector(&cfg)
 	go collector.Run()
 
 	deadline := time.NewTimer(20 * time.Second)
@@ -38,3 +47,73 @@ func TestMetricCollector_Run(t *testing.T) {
 		t.Fatal("Timeout to get response")
 	}
 }
+
+func TestMetricCollector_ReportBeforePoll(t *testing.T) {
+	logger.InitLogger()
+
+	var batch []models.Metrics
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if !assert.NoError(t, err) {
+				return
+			}
+			body = zr
+		}
+		assert.NoError(t, json.NewDecoder(body).Decode(&batch))
+	}))
+	defer server.Close()
+
+	cfg := config.DefaultAgent()
+	cfg.Address = strings.TrimPrefix(server.URL, "http://")
+	collector := NewCollector(&cfg)
+	collector.client = collector.newClient()
+
+	// Отчет раньше первого опроса не должен содержать метрику без типа
+	collector.delivery.observeSend(time.Second, nil)
+	collector.sendMetricsAsBatch(context.Background())
+	assert.NotEmpty(t, batch)
+	for _, m := range batch {
+		assert.NoError(t, m.Validate(), m.ID)
+		assert.NotEqual(t, "PollCount", m.ID)
+	}
+
+	collector.collect()
+	m, ok := pollCount(collector.repo.GetFields())
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), *m.Delta)
+}
+
+func TestDeliveryStats(t *testing.T) {
+	s := &deliveryStats{}
+	s.observeRetry(client.RetryInfo{Attempt: 1, StatusCode: http.StatusTooManyRequests})
+	s.observeRetry(client.RetryInfo{Attempt: 2})
+	s.observeSend(time.Second, errors.New("server is down"))
+
+	drained := s.drain()
+	deltas := map[string]int64{}
+	for _, m := range drained {
+		if m.MType == models.Counter {
+			deltas[m.ID] = *m.Delta
+		}
+	}
+	assert.Equal(t, map[string]int64{
+		"DeliverySuccess":   0,
+		"DeliveryFailure":   1,
+		"DeliveryRetries":   2,
+		"DeliveryThrottled": 1,
+	}, deltas)
+
+	// Недоставленные приращения не теряются
+	s.restore(drained)
+	s.observeSend(time.Second, nil)
+	for _, m := range s.drain() {
+		switch m.ID {
+		case "DeliveryFailure":
+			assert.Equal(t, int64(1), *m.Delta)
+		case "DeliverySuccess":
+			assert.Equal(t, int64(1), *m.Delta)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package agent
+
+import (
+	models "metricapp/internal/model"
+	"metricapp/pkg/client"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// deliveryStats считает исходы отправки метрик на сервер.
+// Агент отправляет их вместе с остальными метриками, счетчики - приращениями с прошлой отправки.
+type deliveryStats struct {
+	mu sync.Mutex
+
+	success   int64
+	failure   int64
+	retries   int64
+	throttled int64
+	// Длительность последней отправки вместе с повторами
+	duration time.Duration
+}
+
+// observeRetry передается клиенту как WithRetryHook
+func (s *deliveryStats) observeRetry(info client.RetryInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.retries++
+	if info.StatusCode == http.StatusTooManyRequests || info.StatusCode == http.StatusServiceUnavailable {
+		s.throttled++
+	}
+}
+
+// observeSend учитывает результат отправки пакета
+func (s *deliveryStats) observeSend(d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.duration = d
+	if err != nil {
+		s.failure++
+		return
+	}
+	s.success++
+}
+
+// drain возвращает накопленные показатели и обнуляет счетчики
+func (s *deliveryStats) drain() []models.Metrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metrics := []models.Metrics{
+		counterMetric("DeliverySuccess", s.success),
+		counterMetric("DeliveryFailure", s.failure),
+		counterMetric("DeliveryRetries", s.retries),
+		counterMetric("DeliveryThrottled", s.throttled),
+		models.ComposeMetrics("DeliveryDuration", models.Gauge, s.duration.Seconds(), 0),
+	}
+	s.success, s.failure, s.retries, s.throttled = 0, 0, 0, 0
+
+	return metrics
+}
+
+// restore возвращает приращения, которые не удалось доставить, чтобы отправить их в следующий раз
+func (s *deliveryStats) restore(metrics []models.Metrics) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range metrics {
+		if m.MType != models.Counter || m.Delta == nil {
+			continue
+		}
+
+		switch m.ID {
+		case "DeliverySuccess":
+			s.success += *m.Delta
+		case "DeliveryFailure":
+			s.failure += *m.Delta
+		case "DeliveryRetries":
+			s.retries += *m.Delta
+		case "DeliveryThrottled":
+			s.throttled += *m.Delta
+		}
+	}
+}
+
+func counterMetric(id string, delta int64) models.Metrics {
+	return models.Metrics{ID: id, MType: models.Counter, Delta: &delta}
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"metricapp/internal/logger"
+)
+
+// Agent - настройки агента
+type Agent struct {
+	Address        string        `env:"ADDRESS" json:"address" yaml:"address"`
+	ReportInterval Duration      `env:"REPORT_INTERVAL" json:"report_interval" yaml:"report_interval"`
+	PollInterval   Duration      `env:"POLL_INTERVAL" json:"poll_interval" yaml:"poll_interval"`
+	Log            logger.Config `json:"log" yaml:"log"`
+}
+
+func DefaultAgent() Agent {
+	return Agent{
+		Address:        "localhost:8080",
+		ReportInterval: Seconds(10),
+		PollInterval:   Seconds(2),
+		Log:            logger.DefaultConfig(),
+	}
+}
+
+// LoadAgent собирает настройки агента из файла, окружения и флагов args
+func LoadAgent(args []string) (*Agent, error) {
+	cfg := DefaultAgent()
+	if err := load("agent", &cfg, args, bindAgent); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+func bindAgent(fs *flag.FlagSet, cfg *Agent) *string {
+	path := fs.String("c", "", "Путь к файлу конфигурации (JSON или YAML)")
+	fs.StringVar(path, "config", "", "Синоним -c")
+	fs.StringVar(&cfg.Address, "a", cfg.Address, "URL адрес сервера сбора метрик")
+	fs.Var(&cfg.PollInterval, "p", "Промежуток времени сбора метрик (секунды или 500ms, 1m)")
+	fs.Var(&cfg.ReportInterval, "r", "Промежуток времени отправки данных на сервер (секунды или 500ms, 1m)")
+	fs.StringVar(&cfg.Log.Level, "log-level", cfg.Log.Level, "Уровень логирования")
+
+	return path
+}
+
+func (cfg *Agent) Validate() error {
+	var errs []error
+
+	if err := validateAddress("address", cfg.Address); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.PollInterval.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("poll interval must be positive: %s", cfg.PollInterval))
+	}
+	if cfg.ReportInterval.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("report interval must be positive: %s", cfg.ReportInterval))
+	}
+	if err := cfg.Log.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,118 @@
+// Package config загружает настройки сервера и агента.
+//
+// Источники применяются в порядке возрастания приоритета:
+//
+//  1. значения по умолчанию;
+//  2. файл конфигурации в формате JSON или YAML (флаг -c или переменная CONFIG);
+//  3. переменные окружения;
+//  4. флаги командной строки.
+//
+// Каждый следующий источник перекрывает только те значения, которые в нем заданы явно.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/caarlos0/env/v11"
+	"gopkg.in/yaml.v3"
+)
+
+// bindFunc регистрирует флаги конфигурации и возвращает указатель на путь к файлу конфигурации
+type bindFunc[T any] func(fs *flag.FlagSet, cfg *T) *string
+
+func load[T any](name string, cfg *T, args []string, bind bindFunc[T]) error {
+	// Первый проход по флагам нужен только чтобы узнать путь к файлу конфигурации,
+	// сами значения флагов применятся последними
+	scratch := *cfg
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	path := bind(fs, &scratch)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			fs.SetOutput(os.Stderr)
+			fs.PrintDefaults()
+		}
+		return err
+	}
+
+	if *path == "" {
+		*path = os.Getenv("CONFIG")
+	}
+	if *path != "" {
+		if err := readFile(*path, cfg); err != nil {
+			return err
+		}
+	}
+
+	if err := env.Parse(cfg); err != nil {
+		return fmt.Errorf("failed to parse env: %w", err)
+	}
+
+	fs = flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	bind(fs, cfg)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	return nil
+}
+
+// readFile читает файл конфигурации, формат определяется по расширению
+func readFile(path string, cfg any) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		dec := json.NewDecoder(strings.NewReader(string(b)))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(strings.NewReader(string(b)))
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	default:
+		return fmt.Errorf("unsupported config file format: %s", path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func validateAddress(name string, addr string) error {
+	hostPort := addr
+	if strings.Contains(addr, "://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %w", name, addr, err)
+		}
+		hostPort = u.Host
+	}
+
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, addr, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadServer_Precedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	err := os.WriteFile(path, []byte(`
+address: "127.0.0.1:9000"
+store_interval: 10
+store_file: /tmp/from-file.json
+restore: true
+log:
+  level: debug
+`), 0644)
+	require.NoError(t, err)
+
+	// Файл < окружение < флаги
+	t.Setenv("CONFIG", path)
+	t.Setenv("STORE_INTERVAL", "1500ms")
+	t.Setenv("ADDRESS", "127.0.0.1:9001")
+
+	cfg, err := LoadServer([]string{"-a", "127.0.0.1:9002"})
+	require.NoError(t, err)
+
+	assert.Equal(t, "127.0.0.1:9002", cfg.Address)
+	assert.Equal(t, 1500*time.Millisecond, cfg.StoreInterval.Duration)
+	assert.Equal(t, "/tmp/from-file.json", cfg.FileStoragePath)
+	assert.True(t, cfg.Restore)
+	assert.Equal(t, "debug", cfg.Log.Level)
+	assert.Equal(t, "migrations", cfg.MigrationPath)
+}
+
+func TestLoadAgent_Validate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"poll_interval": -1}`), 0644))
+
+	_, err := LoadAgent([]string{"-c", path})
+	assert.ErrorContains(t, err, "poll interval")
+
+	_, err = LoadAgent([]string{"-a", "no-port"})
+	assert.ErrorContains(t, err, "invalid address")
+
+	t.Setenv("REPORT_INTERVAL", "abc")
+	_, err = LoadAgent(nil)
+	assert.Error(t, err)
+}
+
+func TestParseDuration(t *testing.T) {
+	cases := map[string]time.Duration{
+		"300":   300 * time.Second,
+		"0":     0,
+		"500ms": 500 * time.Millisecond,
+		"1m":    time.Minute,
+	}
+	for in, expected := range cases {
+		d, err := ParseDuration(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, expected, d.Duration, in)
+	}
+
+	_, err := ParseDuration("soon")
+	assert.Error(t, err)
+
+	var fromJSON struct {
+		A Duration `json:"a"`
+		B Duration `json:"b"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(`{"a": 2, "b": "250ms"}`), &fromJSON))
+	assert.Equal(t, 2*time.Second, fromJSON.A.Duration)
+	assert.Equal(t, 250*time.Millisecond, fromJSON.B.Duration)
+}
+
+func TestChangedKeys(t *testing.T) {
+	old := DefaultServer()
+	updated := DefaultServer()
+	updated.StoreInterval = Seconds(1)
+	updated.Address = "127.0.0.1:1"
+	updated.Log.Level = "debug"
+
+	changed := ChangedKeys(&old, &updated)
+	assert.ElementsMatch(t, []string{"address", "store_interval", "log.level"}, changed)
+
+	apply, restart := SplitKeys(changed, "store_interval", "log")
+	assert.ElementsMatch(t, []string{"store_interval", "log.level"}, apply)
+	assert.Equal(t, []string{"address"}, restart)
+}
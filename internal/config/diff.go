@@ -0,0 +1,60 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+var durationType = reflect.TypeOf(Duration{})
+
+// ChangedKeys возвращает ключи (в том виде, как они пишутся в файле конфигурации),
+// значения которых отличаются в old и new. Вложенные секции разворачиваются через точку: "log.level".
+func ChangedKeys[T any](old, new *T) []string {
+	return changedKeys("", reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem())
+}
+
+func changedKeys(prefix string, old, new reflect.Value) []string {
+	var keys []string
+
+	for i := 0; i < old.NumField(); i++ {
+		field := old.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			name = strings.ToLower(field.Name)
+		}
+		key := prefix + name
+
+		if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+			keys = append(keys, changedKeys(key+".", old.Field(i), new.Field(i))...)
+			continue
+		}
+
+		if !reflect.DeepEqual(old.Field(i).Interface(), new.Field(i).Interface()) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// SplitKeys делит измененные ключи на те, что можно применить на лету, и те, что требуют перезапуска.
+// Ключ считается применимым на лету, если он совпадает с одним из live или начинается с "<live>."
+func SplitKeys(changed []string, live ...string) (apply, restart []string) {
+	for _, key := range changed {
+		isLive := false
+		for _, l := range live {
+			if key == l || strings.HasPrefix(key, l+".") {
+				isLive = true
+				break
+			}
+		}
+
+		if isLive {
+			apply = append(apply, key)
+		} else {
+			restart = append(restart, key)
+		}
+	}
+
+	return apply, restart
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration - интервал, который задается либо строкой time.ParseDuration ("500ms", "1m"),
+// либо целым числом секунд, как раньше ("300")
+type Duration struct {
+	time.Duration
+}
+
+func Seconds(n int) Duration {
+	return Duration{time.Duration(n) * time.Second}
+}
+
+// ParseDuration разбирает интервал в любом из поддерживаемых форматов
+func ParseDuration(s string) (Duration, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return Duration{time.Duration(n) * time.Second}, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return Duration{}, fmt.Errorf("invalid duration %q: use seconds or a Go duration like 500ms", s)
+	}
+
+	return Duration{d}, nil
+}
+
+// UnmarshalText используется при разборе переменных окружения
+func (d *Duration) UnmarshalText(b []byte) error {
+	parsed, err := ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+
+	*d = parsed
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Set и String реализуют flag.Value
+func (d *Duration) Set(s string) error {
+	return d.UnmarshalText([]byte(s))
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case float64:
+		if v != float64(int64(v)) {
+			return fmt.Errorf("invalid duration %v: use whole seconds or a string like \"500ms\"", v)
+		}
+		*d = Seconds(int(v))
+		return nil
+	case string:
+		return d.UnmarshalText([]byte(v))
+	}
+
+	return fmt.Errorf("invalid duration %s", string(b))
+}
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	return d.UnmarshalText([]byte(node.Value))
+}
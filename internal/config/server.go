@@ -0,0 +1,173 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"metricapp/internal/logger"
+)
+
+// Server - настройки сервера сбора метрик
+type Server struct {
+	Address         string   `env:"ADDRESS" json:"address" yaml:"address"`
+	StoreInterval   Duration `env:"STORE_INTERVAL" json:"store_interval" yaml:"store_interval"`
+	FileStoragePath string   `env:"FILE_STORAGE_PATH" json:"store_file" yaml:"store_file"`
+	Restore         bool     `env:"RESTORE" json:"restore" yaml:"restore"`
+	DSN             string   `env:"DATABASE_DSN" json:"database_dsn" yaml:"database_dsn"`
+	MigrationPath   string   `env:"MIGRATION_PATH" json:"migration_path" yaml:"migration_path"`
+	// Токен для служебных эндпоинтов (/debug/). Пустой - служебные эндпоинты выключены.
+	AdminToken string `env:"ADMIN_TOKEN" json:"admin_token" yaml:"admin_token"`
+	// Отдельный адрес для служебных эндпоинтов. Пустой - они висят на основном адресе.
+	AdminAddress string `env:"ADMIN_ADDRESS" json:"admin_address" yaml:"admin_address"`
+	// Как часто сервер пишет собственные метрики с префиксом _server., 0 - не пишет
+	SelfMetricsInterval Duration `env:"SELF_METRICS_INTERVAL" json:"self_metrics_interval" yaml:"self_metrics_interval"`
+	// Допустимое отставание реплики Postgres, при большем /readyz отвечает 503
+	MaxReplicationLag Duration `env:"MAX_REPLICATION_LAG" json:"max_replication_lag" yaml:"max_replication_lag"`
+	// Через сколько без обновлений метрика удаляется, 0 - метрики хранятся вечно
+	MetricTTL Duration `env:"METRIC_TTL" json:"metric_ttl" yaml:"metric_ttl"`
+	// Сколько хранить историю счетчиков для rate и increase (0 - не хранить) и окно по умолчанию
+	CounterHistory Duration `env:"COUNTER_HISTORY" json:"counter_history" yaml:"counter_history"`
+	CounterWindow  Duration `env:"COUNTER_WINDOW" json:"counter_window" yaml:"counter_window"`
+	// Кэш чтения базы: сколько метрик держать (0 - выключен) и сколько живет значение (0 - пока не изменится)
+	CacheSize int      `env:"CACHE_SIZE" json:"cache_size" yaml:"cache_size"`
+	CacheTTL  Duration `env:"CACHE_TTL" json:"cache_ttl" yaml:"cache_ttl"`
+	// Отложенная запись в базу: как часто сбрасывать буфер (0 - писать сразу) и при скольких метриках
+	WriteBehindInterval Duration `env:"WRITE_BEHIND_INTERVAL" json:"write_behind_interval" yaml:"write_behind_interval"`
+	WriteBehindSize     int      `env:"WRITE_BEHIND_SIZE" json:"write_behind_size" yaml:"write_behind_size"`
+	// Ограничения на прием: размер тела запроса и его распакованного gzip-содержимого в байтах,
+	// число метрик в пакете
+	MaxBodySize         int64 `env:"MAX_BODY_SIZE" json:"max_body_size" yaml:"max_body_size"`
+	MaxDecompressedSize int64 `env:"MAX_DECOMPRESSED_SIZE" json:"max_decompressed_size" yaml:"max_decompressed_size"`
+	MaxBatchSize        int   `env:"MAX_BATCH_SIZE" json:"max_batch_size" yaml:"max_batch_size"`
+	// Лимит запросов в секунду на одного клиента (по IP) и размер всплеска, 0 - без лимита
+	RateLimit float64       `env:"RATE_LIMIT" json:"rate_limit" yaml:"rate_limit"`
+	RateBurst int           `env:"RATE_BURST" json:"rate_burst" yaml:"rate_burst"`
+	Log       logger.Config `json:"log" yaml:"log"`
+}
+
+func DefaultServer() Server {
+	return Server{
+		Address:             "0.0.0.0:8080",
+		StoreInterval:       Seconds(300),
+		FileStoragePath:     "./metrics.log",
+		MigrationPath:       "migrations",
+		SelfMetricsInterval: Seconds(10),
+		MaxReplicationLag:   Seconds(30),
+		CounterWindow:       Seconds(60),
+		CacheSize:           10000,
+		CacheTTL:            Seconds(60),
+		WriteBehindSize:     1000,
+		MaxBodySize:         1 << 20,
+		MaxDecompressedSize: 10 << 20,
+		MaxBatchSize:        10000,
+		RateBurst:           20,
+		Log:                 logger.DefaultConfig(),
+	}
+}
+
+// LoadServer собирает настройки сервера из файла, окружения и флагов args
+func LoadServer(args []string) (*Server, error) {
+	cfg := DefaultServer()
+	if err := load("server", &cfg, args, bindServer); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+func bindServer(fs *flag.FlagSet, cfg *Server) *string {
+	path := fs.String("c", "", "Путь к файлу конфигурации (JSON или YAML)")
+	fs.StringVar(path, "config", "", "Синоним -c")
+	fs.StringVar(&cfg.Address, "a", cfg.Address, "Порт на котором будет поднят сервер")
+	fs.Var(&cfg.StoreInterval, "i", "Интервал записи метрик в файл (секунды или 500ms, 1m), 0 - запись при каждом обновлении")
+	fs.StringVar(&cfg.FileStoragePath, "f", cfg.FileStoragePath, "Путь к файлу с сохраненными метрика")
+	fs.BoolVar(&cfg.Restore, "r", cfg.Restore, "Флаг для загрузки сохраненных метрик с предыдущего сеанса")
+	fs.StringVar(&cfg.DSN, "d", cfg.DSN, "Параметры подключения к базе даннных")
+	fs.StringVar(&cfg.MigrationPath, "m", cfg.MigrationPath, "Путь к фалам миграции")
+	fs.StringVar(&cfg.AdminToken, "admin-token", cfg.AdminToken, "Токен для служебных эндпоинтов")
+	fs.StringVar(&cfg.AdminAddress, "admin-address", cfg.AdminAddress, "Отдельный адрес для служебных эндпоинтов")
+	fs.Var(&cfg.SelfMetricsInterval, "self-metrics-interval", "Интервал записи собственных метрик сервера, 0 - выключено")
+	fs.Var(&cfg.MaxReplicationLag, "max-replication-lag", "Допустимое отставание реплики БД для /readyz")
+	fs.Var(&cfg.MetricTTL, "metric-ttl", "Через сколько без обновлений метрика удаляется, 0 - никогда")
+	fs.Var(&cfg.CounterHistory, "counter-history", "Сколько хранить историю счетчиков для rate и increase, 0 - не хранить")
+	fs.Var(&cfg.CounterWindow, "counter-window", "Окно rate и increase по умолчанию")
+	fs.IntVar(&cfg.CacheSize, "cache-size", cfg.CacheSize, "Сколько метрик держать в кэше чтения БД, 0 - без кэша")
+	fs.Var(&cfg.CacheTTL, "cache-ttl", "Время жизни значения в кэше чтения БД, 0 - без ограничения")
+	fs.Var(&cfg.WriteBehindInterval, "write-behind-interval", "Интервал сброса буфера отложенной записи в БД, 0 - писать сразу")
+	fs.IntVar(&cfg.WriteBehindSize, "write-behind-size", cfg.WriteBehindSize, "Сколько метрик копить в буфере отложенной записи до сброса")
+	fs.Int64Var(&cfg.MaxBodySize, "max-body-size", cfg.MaxBodySize, "Максимальный размер тела запроса в байтах")
+	fs.Int64Var(&cfg.MaxDecompressedSize, "max-decompressed-size", cfg.MaxDecompressedSize, "Максимальный размер распакованного тела запроса в байтах")
+	fs.IntVar(&cfg.MaxBatchSize, "max-batch-size", cfg.MaxBatchSize, "Максимальное число метрик в пакете")
+	fs.Float64Var(&cfg.RateLimit, "rate-limit", cfg.RateLimit, "Лимит запросов в секунду на клиента, 0 - без лимита")
+	fs.IntVar(&cfg.RateBurst, "rate-burst", cfg.RateBurst, "Допустимый всплеск запросов сверх лимита")
+	fs.StringVar(&cfg.Log.Level, "log-level", cfg.Log.Level, "Уровень логирования")
+
+	return path
+}
+
+func (cfg *Server) Validate() error {
+	var errs []error
+
+	if err := validateAddress("address", cfg.Address); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.StoreInterval.Duration < 0 {
+		errs = append(errs, fmt.Errorf("store interval must not be negative: %s", cfg.StoreInterval))
+	}
+	if cfg.DSN == "" && cfg.FileStoragePath == "" {
+		errs = append(errs, errors.New("file storage path is required without database dsn"))
+	}
+	if cfg.DSN != "" && cfg.MigrationPath == "" {
+		errs = append(errs, errors.New("migration path is required with database dsn"))
+	}
+	if cfg.AdminAddress != "" {
+		if err := validateAddress("admin address", cfg.AdminAddress); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if cfg.SelfMetricsInterval.Duration < 0 {
+		errs = append(errs, fmt.Errorf("self metrics interval must not be negative: %s", cfg.SelfMetricsInterval))
+	}
+	if cfg.MaxReplicationLag.Duration < 0 {
+		errs = append(errs, fmt.Errorf("max replication lag must not be negative: %s", cfg.MaxReplicationLag))
+	}
+	if cfg.MetricTTL.Duration < 0 {
+		errs = append(errs, fmt.Errorf("metric ttl must not be negative: %s", cfg.MetricTTL))
+	}
+	if cfg.CounterHistory.Duration < 0 {
+		errs = append(errs, fmt.Errorf("counter history must not be negative: %s", cfg.CounterHistory))
+	}
+	if cfg.CounterHistory.Duration > 0 && (cfg.CounterWindow.Duration <= 0 || cfg.CounterWindow.Duration > cfg.CounterHistory.Duration) {
+		errs = append(errs, fmt.Errorf("counter window must be positive and not longer than counter history: %s", cfg.CounterWindow))
+	}
+	if cfg.CacheSize < 0 {
+		errs = append(errs, fmt.Errorf("cache size must not be negative: %d", cfg.CacheSize))
+	}
+	if cfg.CacheTTL.Duration < 0 {
+		errs = append(errs, fmt.Errorf("cache ttl must not be negative: %s", cfg.CacheTTL))
+	}
+	if cfg.WriteBehindInterval.Duration < 0 {
+		errs = append(errs, fmt.Errorf("write behind interval must not be negative: %s", cfg.WriteBehindInterval))
+	}
+	if cfg.WriteBehindInterval.Duration > 0 && cfg.WriteBehindSize <= 0 {
+		errs = append(errs, fmt.Errorf("write behind size must be positive: %d", cfg.WriteBehindSize))
+	}
+	if cfg.MaxBodySize <= 0 || cfg.MaxDecompressedSize <= 0 || cfg.MaxBatchSize <= 0 {
+		errs = append(errs, errors.New("body, decompressed and batch size limits must be positive"))
+	}
+	if cfg.RateLimit < 0 {
+		errs = append(errs, fmt.Errorf("rate limit must not be negative: %v", cfg.RateLimit))
+	}
+	if cfg.RateLimit > 0 && cfg.RateBurst < 1 {
+		errs = append(errs, errors.New("rate burst must be at least 1 with rate limit"))
+	}
+	if err := cfg.Log.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
@@ -6,39 +6,99 @@ import (
 	"io"
 	models "metricapp/internal/model"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type FManager struct {
-	file          os.File
-	Storeinterval int
+	// Файл пишут обработчики, цикл сервера и остановка: перезапись целиком под замком
+	mu   sync.Mutex
+	file os.File
+	path string
+	// 0 - метрики пишутся в файл при каждом обновлении.
+	// Меняется на лету при перечитывании конфигурации, поэтому атомарный.
+	storeInterval atomic.Int64
+	// Время последней успешной записи в unix nano, нужно для проверки готовности
+	lastWrite atomic.Int64
 }
 
-func Open(path string, sInterval int) (*FManager, error) {
+func Open(path string, sInterval time.Duration) (*FManager, error) {
 	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file: %w", err)
 	}
 
-	return &FManager{file: *file, Storeinterval: sInterval}, nil
+	fm := &FManager{file: *file, path: path}
+	fm.SetStoreInterval(sInterval)
+	fm.lastWrite.Store(time.Now().UnixNano())
+	return fm, nil
 }
 
-func (fm *FManager) Write(metrics []models.Metrics) error {
+func (fm *FManager) StoreInterval() time.Duration {
+	return time.Duration(fm.storeInterval.Load())
+}
+
+func (fm *FManager) SetStoreInterval(d time.Duration) {
+	fm.storeInterval.Store(int64(d))
+}
+
+// Save снимает срез хранилища и пишет его под тем же замком. Поэтому последним
+// в файл попадает самый свежий срез, а не тот, что был снят раньше, но записан позже.
+func (fm *FManager) Save(snapshot func() []models.Metrics) error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	return fm.write(snapshot())
+}
+
+func (fm *FManager) write(metrics []models.Metrics) error {
 	b, err := json.Marshal(metrics)
 	if err != nil {
 		return fmt.Errorf("failed to marshal struct: %w", err)
 	}
 
-	fm.file.Truncate(0)
-	fm.file.Seek(0, 0)
+	if err := fm.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate file: %w", err)
+	}
+	if _, err := fm.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek file: %w", err)
+	}
 	_, err = fm.file.Write(b)
 	if err != nil {
 		return fmt.Errorf("failed to rewrite file: %w", err)
 	}
+	fm.lastWrite.Store(time.Now().UnixNano())
+
+	return nil
+}
+
+// LastWrite возвращает время последней успешной записи (или открытия файла)
+func (fm *FManager) LastWrite() time.Time {
+	return time.Unix(0, fm.lastWrite.Load())
+}
+
+// CheckWritable проверяет, что в каталог файла можно писать:
+// создает и сразу удаляет временный файл рядом с ним
+func (fm *FManager) CheckWritable() error {
+	tmp, err := os.CreateTemp(filepath.Dir(fm.path), ".readyz-*")
+	if err != nil {
+		return fmt.Errorf("storage directory is not writable: %w", err)
+	}
+	tmp.Close()
+
+	if err := os.Remove(tmp.Name()); err != nil {
+		return fmt.Errorf("failed to remove probe file: %w", err)
+	}
 
 	return nil
 }
 
 func (fm *FManager) Read() ([]models.Metrics, error) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
 	b, err := io.ReadAll(&fm.file)
 
 	if err != nil {
@@ -0,0 +1,70 @@
+package logger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"go.uber.org/zap"
+)
+
+type (
+	requestIDKey struct{}
+	loggerKey    struct{}
+)
+
+// WithRequestID сохраняет идентификатор запроса в контексте
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID достает идентификатор запроса из контекста
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID генерирует случайный идентификатор запроса
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// WithLogger подменяет логгер для всего, что выполняется с этим контекстом.
+// Так логгер внедряется в хэндлеры и коллектор, в том числе в тестах.
+func WithLogger(ctx context.Context, l *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// Ctx возвращает логгер из контекста (или глобальный),
+// который добавляет к каждой записи идентификатор запроса
+func Ctx(ctx context.Context) *zap.Logger {
+	l, ok := ctx.Value(loggerKey{}).(*zap.Logger)
+	if !ok {
+		l = L()
+	}
+
+	return withRequestID(ctx, l)
+}
+
+// RequestLog - логгер для журнала запросов. Глобальный логгер здесь семплируется,
+// внедренный через WithLogger используется как есть.
+func RequestLog(ctx context.Context) *zap.Logger {
+	l, ok := ctx.Value(loggerKey{}).(*zap.Logger)
+	if !ok {
+		mu.Lock()
+		l = requestLog
+		mu.Unlock()
+	}
+
+	return withRequestID(ctx, l)
+}
+
+func withRequestID(ctx context.Context, l *zap.Logger) *zap.Logger {
+	if id := RequestID(ctx); id != "" {
+		return l.With(zap.String("request_id", id))
+	}
+
+	return l
+}
@@ -1,42 +1,220 @@
 package logger
 
 import (
+	"fmt"
+	"os"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-var logger *zap.Logger
-var once sync.Once
+var (
+	// До инициализации логгер ничего не пишет, чтобы пакеты можно было использовать без InitLogger
+	logger     = zap.NewNop()
+	requestLog = zap.NewNop()
+	level      = zap.NewAtomicLevelAt(zap.InfoLevel)
+	once       sync.Once
+	mu         sync.Mutex
+	output     *rotatingWriter
+)
+
+// Config - настройки логгера
+type Config struct {
+	// debug, info, warn, error
+	Level string `env:"LOG_LEVEL" json:"level" yaml:"level"`
+	// json или console
+	Format string `env:"LOG_FORMAT" json:"format" yaml:"format"`
+	// stdout, stderr или путь к файлу
+	Output string `env:"LOG_OUTPUT" json:"output" yaml:"output"`
+	// Размер файла в мегабайтах, после которого он ротируется
+	MaxSizeMB int `env:"LOG_MAX_SIZE" json:"max_size" yaml:"max_size"`
+	// Сколько ротированных файлов хранить
+	MaxBackups int `env:"LOG_MAX_BACKUPS" json:"max_backups" yaml:"max_backups"`
+	// Семплирование лога запросов: первые SampleInitial записей в секунду пишутся все,
+	// дальше - каждая SampleThereafter. 0 отключает семплирование.
+	SampleInitial    int `env:"LOG_SAMPLE_INITIAL" json:"sample_initial" yaml:"sample_initial"`
+	SampleThereafter int `env:"LOG_SAMPLE_THEREAFTER" json:"sample_thereafter" yaml:"sample_thereafter"`
+}
+
+// DefaultConfig возвращает настройки по умолчанию: json в stdout с уровнем info
+func DefaultConfig() Config {
+	return Config{
+		Level:            "info",
+		Format:           "json",
+		Output:           "stdout",
+		MaxSizeMB:        100,
+		MaxBackups:       3,
+		SampleInitial:    100,
+		SampleThereafter: 100,
+	}
+}
+
+// Validate проверяет настройки без создания логгера
+func (cfg Config) Validate() error {
+	if _, err := parseLevel(cfg.Level); err != nil {
+		return err
+	}
 
+	switch cfg.Format {
+	case "", "json", "console":
+	default:
+		return fmt.Errorf("unknown log format: %s", cfg.Format)
+	}
+
+	if cfg.MaxSizeMB < 0 || cfg.MaxBackups < 0 || cfg.SampleInitial < 0 || cfg.SampleThereafter < 0 {
+		return fmt.Errorf("log size, backups and sampling must not be negative")
+	}
+
+	return nil
+}
+
+// InitLogger инициализирует логгер с настройками по умолчанию.
+// Повторные вызовы ничего не делают.
 func InitLogger() {
 	once.Do(func() {
-		cfg := zap.NewProductionConfig()
-		cfg.EncoderConfig.TimeKey = "time"
-		cfg.EncoderConfig.EncodeTime = zapcore.RFC3339TimeEncoder
-		cfg.OutputPaths = []string{"stdout"}
-		l, _ := cfg.Build()
-		logger = l
+		Init(DefaultConfig())
 	})
 }
 
+// Init заменяет глобальный логгер логгером с заданными настройками
+func Init(cfg Config) error {
+	lvl, err := parseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+
+	l, sampled, out, err := build(cfg, level)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	level.SetLevel(lvl)
+	logger.Sync()
+	if output != nil {
+		output.Close()
+	}
+	logger, requestLog, output = l, sampled, out
+
+	return nil
+}
+
+// New собирает логгер по настройкам, не трогая глобальный. Удобно для тестов.
+func New(cfg Config) (*zap.Logger, error) {
+	lvl, err := parseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	l, _, _, err := build(cfg, zap.NewAtomicLevelAt(lvl))
+	return l, err
+}
+
+func build(cfg Config, lvl zap.AtomicLevel) (*zap.Logger, *zap.Logger, *rotatingWriter, error) {
+	encCfg := zap.NewProductionEncoderConfig()
+	encCfg.TimeKey = "time"
+	encCfg.EncodeTime = zapcore.RFC3339TimeEncoder
+
+	var enc zapcore.Encoder
+	switch cfg.Format {
+	case "", "json":
+		enc = zapcore.NewJSONEncoder(encCfg)
+	case "console":
+		encCfg.EncodeLevel = zapcore.CapitalLevelEncoder
+		enc = zapcore.NewConsoleEncoder(encCfg)
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown log format: %s", cfg.Format)
+	}
+
+	var (
+		ws  zapcore.WriteSyncer
+		out *rotatingWriter
+	)
+	switch cfg.Output {
+	case "", "stdout":
+		ws = zapcore.Lock(os.Stdout)
+	case "stderr":
+		ws = zapcore.Lock(os.Stderr)
+	default:
+		w, err := newRotatingWriter(cfg.Output, int64(cfg.MaxSizeMB)<<20, cfg.MaxBackups)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		ws, out = w, w
+	}
+
+	core := zapcore.NewCore(enc, ws, lvl)
+	l := zap.New(core, zap.AddCaller(), zap.AddStacktrace(zap.ErrorLevel))
+
+	sampled := l
+	if cfg.SampleInitial > 0 && cfg.SampleThereafter > 0 {
+		sampled = zap.New(
+			zapcore.NewSamplerWithOptions(core, time.Second, cfg.SampleInitial, cfg.SampleThereafter),
+			zap.AddCaller(),
+		)
+	}
+
+	return l, sampled, out, nil
+}
+
+// SetLevel меняет уровень логирования на лету
+func SetLevel(lvl string) error {
+	parsed, err := parseLevel(lvl)
+	if err != nil {
+		return err
+	}
+	level.SetLevel(parsed)
+
+	return nil
+}
+
+func parseLevel(lvl string) (zapcore.Level, error) {
+	if lvl == "" {
+		return zapcore.InfoLevel, nil
+	}
+
+	parsed, err := zapcore.ParseLevel(lvl)
+	if err != nil {
+		return parsed, fmt.Errorf("unknown log level: %s", lvl)
+	}
+
+	return parsed, nil
+}
+
+// L возвращает глобальный логгер
+func L() *zap.Logger {
+	mu.Lock()
+	defer mu.Unlock()
+	return logger
+}
+
+func Debug(msg string, fields ...zapcore.Field) {
+	L().Debug(
+		msg,
+		fields...,
+	)
+}
+
 func Warn(msg string, fields ...zapcore.Field) {
-	logger.Warn(
+	L().Warn(
 		msg,
 		fields...,
 	)
 }
 
 func Info(msg string, fields ...zapcore.Field) {
-	logger.Info(
+	L().Info(
 		msg,
 		fields...,
 	)
 }
 
 func Error(msg string, fields ...zapcore.Field) {
-	logger.Error(
+	L().Error(
 		msg,
 		fields...,
 	)
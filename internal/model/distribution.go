@@ -0,0 +1,323 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+var (
+	ErrInvalidHistogram = errors.New("invalid histogram")
+	ErrBucketsMismatch  = errors.New("histogram buckets do not match stored ones")
+	ErrInvalidSummary   = errors.New("invalid summary")
+	ErrAlphaMismatch    = errors.New("summary accuracy does not match stored one")
+	ErrInvalidQuantile  = errors.New("quantile must be between 0 and 1")
+)
+
+// DefaultQuantiles - квантили, которые сервер считает для summary в ответах /value/
+var DefaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+// DefaultAlpha - относительная точность квантилей summary по умолчанию (1%)
+const DefaultAlpha = 0.01
+
+// HistogramData - гистограмма с заданными клиентом границами корзин.
+// Counts[i] - число наблюдений в (Bounds[i-1], Bounds[i]], последний элемент - корзина +Inf.
+// Клиент присылает приращения с прошлой отправки, сервер их складывает, как счетчики.
+type HistogramData struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Sum    float64   `json:"sum"`
+	Count  uint64    `json:"count"`
+}
+
+// NewHistogram создает пустую гистограмму с границами bounds
+func NewHistogram(bounds ...float64) *HistogramData {
+	return &HistogramData{
+		Bounds: slices.Clone(bounds),
+		Counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// Observe добавляет наблюдение
+func (h *HistogramData) Observe(v float64) {
+	i := sort.SearchFloat64s(h.Bounds, v)
+	h.Counts[i]++
+	h.Sum += v
+	h.Count++
+}
+
+// Validate проверяет, что границы возрастают, а количество корзин и наблюдений сходится
+func (h *HistogramData) Validate() error {
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return fmt.Errorf("%w: expected %d counts for %d bounds", ErrInvalidHistogram, len(h.Bounds)+1, len(h.Bounds))
+	}
+
+	for i, b := range h.Bounds {
+		if math.IsNaN(b) || math.IsInf(b, 0) {
+			return fmt.Errorf("%w: bounds must be finite", ErrInvalidHistogram)
+		}
+		if i > 0 && b <= h.Bounds[i-1] {
+			return fmt.Errorf("%w: bounds must be strictly increasing", ErrInvalidHistogram)
+		}
+	}
+
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total != h.Count {
+		return fmt.Errorf("%w: count %d does not match buckets total %d", ErrInvalidHistogram, h.Count, total)
+	}
+	if math.IsNaN(h.Sum) || math.IsInf(h.Sum, 0) {
+		return fmt.Errorf("%w: sum must be finite", ErrInvalidHistogram)
+	}
+
+	return nil
+}
+
+// Merge прибавляет к гистограмме приращение other с теми же границами
+func (h *HistogramData) Merge(other *HistogramData) error {
+	if !slices.Equal(h.Bounds, other.Bounds) {
+		return ErrBucketsMismatch
+	}
+
+	for i, c := range other.Counts {
+		h.Counts[i] += c
+	}
+	h.Sum += other.Sum
+	h.Count += other.Count
+
+	return nil
+}
+
+// Quantile оценивает квантиль линейной интерполяцией внутри корзины.
+// Для корзины +Inf возвращается последняя граница.
+func (h *HistogramData) Quantile(q float64) (float64, error) {
+	if q < 0 || q > 1 || math.IsNaN(q) {
+		return 0, ErrInvalidQuantile
+	}
+	if h.Count == 0 || len(h.Bounds) == 0 {
+		return math.NaN(), nil
+	}
+
+	rank := q * float64(h.Count)
+	var seen float64
+	for i, c := range h.Counts {
+		if c == 0 || seen+float64(c) < rank {
+			seen += float64(c)
+			continue
+		}
+		if i == len(h.Bounds) {
+			return h.Bounds[len(h.Bounds)-1], nil
+		}
+
+		lower := 0.0
+		if i > 0 {
+			lower = h.Bounds[i-1]
+		} else if h.Bounds[0] < 0 {
+			lower = h.Bounds[0]
+		}
+		return lower + (h.Bounds[i]-lower)*(rank-seen)/float64(c), nil
+	}
+
+	return h.Bounds[len(h.Bounds)-1], nil
+}
+
+// Clone возвращает независимую копию
+func (h *HistogramData) Clone() *HistogramData {
+	c := *h
+	c.Bounds = slices.Clone(h.Bounds)
+	c.Counts = slices.Clone(h.Counts)
+	return &c
+}
+
+// SummaryData - потоковый скетч квантилей в духе DDSketch: положительные значения
+// раскладываются по логарифмическим корзинам, так что любой квантиль оценивается
+// с относительной погрешностью не больше Alpha. Скетчи с одинаковой Alpha
+// складываются без потери точности, поэтому агенты могут присылать приращения.
+// Отрицательные значения не поддерживаются, нули и значения меньше minIndexable
+// попадают в отдельную корзину Zero.
+type SummaryData struct {
+	Alpha float64 `json:"alpha"`
+	// Номера логарифмических корзин по возрастанию и число наблюдений в каждой
+	Indexes []int32  `json:"indexes"`
+	Counts  []uint64 `json:"counts"`
+	Zero    uint64   `json:"zero"`
+	Sum     float64  `json:"sum"`
+	Count   uint64   `json:"count"`
+	Min     float64  `json:"min"`
+	Max     float64  `json:"max"`
+	// Квантили DefaultQuantiles, заполняются сервером при чтении метрики
+	Quantiles map[string]float64 `json:"quantiles,omitempty"`
+}
+
+// Значения меньше этого порога неотличимы от нуля
+const minIndexable = 1e-9
+
+// NewSummary создает пустой скетч с относительной точностью alpha
+func NewSummary(alpha float64) *SummaryData {
+	return &SummaryData{Alpha: alpha}
+}
+
+func (s *SummaryData) gamma() float64 {
+	return (1 + s.Alpha) / (1 - s.Alpha)
+}
+
+// Observe добавляет наблюдение
+func (s *SummaryData) Observe(v float64) error {
+	if v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Errorf("%w: value must be finite and not negative", ErrInvalidSummary)
+	}
+
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Count++
+	s.Sum += v
+
+	if v < minIndexable {
+		s.Zero++
+		return nil
+	}
+
+	idx := int32(math.Ceil(math.Log(v) / math.Log(s.gamma())))
+	s.add(idx, 1)
+	return nil
+}
+
+// add прибавляет n к корзине idx, сохраняя порядок Indexes
+func (s *SummaryData) add(idx int32, n uint64) {
+	i, found := slices.BinarySearch(s.Indexes, idx)
+	if found {
+		s.Counts[i] += n
+		return
+	}
+
+	s.Indexes = slices.Insert(s.Indexes, i, idx)
+	s.Counts = slices.Insert(s.Counts, i, n)
+}
+
+// Validate проверяет точность и согласованность корзин
+func (s *SummaryData) Validate() error {
+	if !(s.Alpha > 0 && s.Alpha < 1) {
+		return fmt.Errorf("%w: alpha must be between 0 and 1", ErrInvalidSummary)
+	}
+	if len(s.Indexes) != len(s.Counts) {
+		return fmt.Errorf("%w: indexes and counts must have the same length", ErrInvalidSummary)
+	}
+	for i := 1; i < len(s.Indexes); i++ {
+		if s.Indexes[i] <= s.Indexes[i-1] {
+			return fmt.Errorf("%w: indexes must be strictly increasing", ErrInvalidSummary)
+		}
+	}
+
+	total := s.Zero
+	for _, c := range s.Counts {
+		total += c
+	}
+	if total != s.Count {
+		return fmt.Errorf("%w: count %d does not match buckets total %d", ErrInvalidSummary, s.Count, total)
+	}
+
+	for _, v := range []float64{s.Sum, s.Min, s.Max} {
+		if math.IsNaN(v) || math.IsInf(v, 0) || v < 0 {
+			return fmt.Errorf("%w: sum, min and max must be finite and not negative", ErrInvalidSummary)
+		}
+	}
+
+	return nil
+}
+
+// Merge складывает скетчи с одинаковой точностью
+func (s *SummaryData) Merge(other *SummaryData) error {
+	if s.Alpha != other.Alpha {
+		return ErrAlphaMismatch
+	}
+	if other.Count == 0 {
+		return nil
+	}
+
+	if s.Count == 0 || other.Min < s.Min {
+		s.Min = other.Min
+	}
+	if s.Count == 0 || other.Max > s.Max {
+		s.Max = other.Max
+	}
+	for i, idx := range other.Indexes {
+		s.add(idx, other.Counts[i])
+	}
+	s.Zero += other.Zero
+	s.Sum += other.Sum
+	s.Count += other.Count
+
+	return nil
+}
+
+// Quantile оценивает квантиль с относительной погрешностью Alpha
+func (s *SummaryData) Quantile(q float64) (float64, error) {
+	if q < 0 || q > 1 || math.IsNaN(q) {
+		return 0, ErrInvalidQuantile
+	}
+	if s.Count == 0 {
+		return math.NaN(), nil
+	}
+
+	rank := uint64(q * float64(s.Count-1))
+	if rank < s.Zero {
+		return 0, nil
+	}
+
+	seen := s.Zero
+	g := s.gamma()
+	for i, c := range s.Counts {
+		seen += c
+		if seen > rank {
+			v := 2 * math.Pow(g, float64(s.Indexes[i])) / (g + 1)
+			// Оценка не выходит за реально наблюдавшиеся значения
+			return math.Min(math.Max(v, s.Min), s.Max), nil
+		}
+	}
+
+	return s.Max, nil
+}
+
+// FillQuantiles заполняет Quantiles для ответа клиенту
+func (s *SummaryData) FillQuantiles(qs ...float64) {
+	if s.Count == 0 {
+		return
+	}
+
+	s.Quantiles = make(map[string]float64, len(qs))
+	for _, q := range qs {
+		if v, err := s.Quantile(q); err == nil {
+			s.Quantiles[strconv.FormatFloat(q, 'f', -1, 64)] = v
+		}
+	}
+}
+
+// Clone возвращает независимую копию
+func (s *SummaryData) Clone() *SummaryData {
+	c := *s
+	c.Indexes = slices.Clone(s.Indexes)
+	c.Counts = slices.Clone(s.Counts)
+	c.Quantiles = nil
+	return &c
+}
+
+// Quantile оценивает квантиль гистограммы или summary
+func (m Metrics) Quantile(q float64) (float64, error) {
+	switch {
+	case m.MType == Histogram && m.Histogram != nil:
+		return m.Histogram.Quantile(q)
+	case m.MType == Summary && m.Summary != nil:
+		return m.Summary.Quantile(q)
+	}
+
+	return 0, fmt.Errorf("%w: quantiles are supported for histogram and summary only", ErrUnknownType)
+}
@@ -0,0 +1,204 @@
+package models
+
+import (
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogramData_Quantile(t *testing.T) {
+	tests := []struct {
+		name   string
+		bounds []float64
+		counts []uint64
+		q      float64
+		want   float64
+	}{
+		{"median inside first bucket", []float64{1, 2, 4}, []uint64{2, 2, 0, 0}, 0.5, 1},
+		{"interpolation inside bucket", []float64{1, 2, 4}, []uint64{2, 2, 0, 0}, 0.75, 1.5},
+		{"empty buckets are skipped", []float64{1, 2, 4}, []uint64{0, 0, 4, 0}, 0.5, 3},
+		{"+Inf bucket returns last bound", []float64{1, 2}, []uint64{0, 1, 3}, 0.9, 2},
+		{"zero quantile", []float64{1, 2}, []uint64{0, 2, 0}, 0, 1},
+		{"first bucket starts at negative bound", []float64{-2, 2}, []uint64{2, 0, 0}, 0.5, -2},
+		{"negative bounds", []float64{-4, 0}, []uint64{0, 2, 0}, 0.5, -2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &HistogramData{Bounds: tt.bounds, Counts: tt.counts}
+			for _, c := range tt.counts {
+				h.Count += c
+			}
+			require.NoError(t, h.Validate())
+
+			got, err := h.Quantile(tt.q)
+			require.NoError(t, err)
+			assert.InDelta(t, tt.want, got, 1e-12)
+		})
+	}
+
+	// Пустая гистограмма
+	got, err := NewHistogram(1, 2).Quantile(0.5)
+	require.NoError(t, err)
+	assert.True(t, math.IsNaN(got))
+
+	for _, q := range []float64{-0.1, 1.1, math.NaN()} {
+		_, err := NewHistogram(1).Quantile(q)
+		assert.ErrorIs(t, err, ErrInvalidQuantile, q)
+	}
+}
+
+func TestHistogramData_Validate(t *testing.T) {
+	tests := []struct {
+		name string
+		h    HistogramData
+		ok   bool
+	}{
+		{"valid", HistogramData{Bounds: []float64{1, 2}, Counts: []uint64{1, 0, 2}, Sum: 7, Count: 3}, true},
+		{"no bounds", HistogramData{Counts: []uint64{1}, Count: 1}, true},
+		{"counts length", HistogramData{Bounds: []float64{1, 2}, Counts: []uint64{1, 0}, Count: 1}, false},
+		{"NaN bound", HistogramData{Bounds: []float64{math.NaN()}, Counts: []uint64{0, 0}}, false},
+		{"infinite bound", HistogramData{Bounds: []float64{math.Inf(1)}, Counts: []uint64{0, 0}}, false},
+		{"bounds not increasing", HistogramData{Bounds: []float64{2, 2}, Counts: []uint64{0, 0, 0}}, false},
+		{"count mismatch", HistogramData{Bounds: []float64{1}, Counts: []uint64{1, 1}, Count: 3}, false},
+		{"infinite sum", HistogramData{Bounds: []float64{1}, Counts: []uint64{1, 0}, Count: 1, Sum: math.Inf(1)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.h.Validate()
+			if tt.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidHistogram)
+			}
+		})
+	}
+}
+
+func TestHistogramData_Merge(t *testing.T) {
+	h := NewHistogram(1, 2)
+	h.Observe(0.5)
+	other := NewHistogram(1, 2)
+	other.Observe(1.5)
+	other.Observe(10)
+
+	require.NoError(t, h.Merge(other))
+	assert.Equal(t, []uint64{1, 1, 1}, h.Counts)
+	assert.Equal(t, uint64(3), h.Count)
+	assert.Equal(t, 12.0, h.Sum)
+	require.NoError(t, h.Validate())
+
+	assert.ErrorIs(t, h.Merge(NewHistogram(1, 3)), ErrBucketsMismatch)
+	assert.ErrorIs(t, h.Merge(NewHistogram(1)), ErrBucketsMismatch)
+}
+
+func TestSummaryData_Quantile(t *testing.T) {
+	tests := []struct {
+		name   string
+		alpha  float64
+		values func(i int) float64
+	}{
+		{"linear", DefaultAlpha, func(i int) float64 { return float64(i + 1) }},
+		{"exponential", DefaultAlpha, func(i int) float64 { return math.Exp(float64(i%1000) / 50) }},
+		{"small values", 0.05, func(i int) float64 { return float64(i+1) / 1e6 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSummary(tt.alpha)
+			values := make([]float64, 10000)
+			for i := range values {
+				values[i] = tt.values(i)
+				require.NoError(t, s.Observe(values[i]))
+			}
+			require.NoError(t, s.Validate())
+			sort.Float64s(values)
+
+			// Оценка отличается от точного квантиля не больше чем на Alpha
+			for _, q := range []float64{0, 0.1, 0.5, 0.9, 0.99, 1} {
+				want := values[int(q*float64(len(values)-1))]
+				got, err := s.Quantile(q)
+				require.NoError(t, err)
+				assert.LessOrEqual(t, math.Abs(got-want)/want, tt.alpha+1e-9, "q=%v want %v got %v", q, want, got)
+			}
+		})
+	}
+
+	s := NewSummary(DefaultAlpha)
+	got, err := s.Quantile(0.5)
+	require.NoError(t, err)
+	assert.True(t, math.IsNaN(got))
+
+	// Нули попадают в отдельную корзину
+	require.NoError(t, s.Observe(0))
+	require.NoError(t, s.Observe(0))
+	require.NoError(t, s.Observe(5))
+	got, err = s.Quantile(0.5)
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, got)
+
+	for _, q := range []float64{-0.1, 1.1, math.NaN()} {
+		_, err := s.Quantile(q)
+		assert.ErrorIs(t, err, ErrInvalidQuantile, q)
+	}
+}
+
+func TestSummaryData_Validate(t *testing.T) {
+	tests := []struct {
+		name string
+		s    SummaryData
+		ok   bool
+	}{
+		{"valid", SummaryData{Alpha: 0.01, Indexes: []int32{1, 5}, Counts: []uint64{1, 2}, Zero: 1, Count: 4, Sum: 3, Max: 2}, true},
+		{"empty", SummaryData{Alpha: 0.01}, true},
+		{"zero alpha", SummaryData{}, false},
+		{"alpha is one", SummaryData{Alpha: 1}, false},
+		{"lengths differ", SummaryData{Alpha: 0.01, Indexes: []int32{1}, Counts: []uint64{1, 1}, Count: 2}, false},
+		{"indexes not increasing", SummaryData{Alpha: 0.01, Indexes: []int32{2, 1}, Counts: []uint64{1, 1}, Count: 2}, false},
+		{"count mismatch", SummaryData{Alpha: 0.01, Indexes: []int32{1}, Counts: []uint64{1}, Count: 2}, false},
+		{"negative min", SummaryData{Alpha: 0.01, Indexes: []int32{1}, Counts: []uint64{1}, Count: 1, Min: -1}, false},
+		{"NaN sum", SummaryData{Alpha: 0.01, Indexes: []int32{1}, Counts: []uint64{1}, Count: 1, Sum: math.NaN()}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.s.Validate()
+			if tt.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidSummary)
+			}
+		})
+	}
+
+	for _, v := range []float64{-1, math.NaN(), math.Inf(1)} {
+		assert.ErrorIs(t, NewSummary(DefaultAlpha).Observe(v), ErrInvalidSummary, v)
+	}
+}
+
+func TestSummaryData_Merge(t *testing.T) {
+	all, a, b := NewSummary(DefaultAlpha), NewSummary(DefaultAlpha), NewSummary(DefaultAlpha)
+	for i := 1; i <= 1000; i++ {
+		v := float64(i)
+		require.NoError(t, all.Observe(v))
+		if i%2 == 0 {
+			require.NoError(t, a.Observe(v))
+		} else {
+			require.NoError(t, b.Observe(v))
+		}
+	}
+
+	// Сумма скетчей равна скетчу всех наблюдений
+	require.NoError(t, a.Merge(b))
+	assert.Equal(t, all, a)
+
+	// Пустое приращение ничего не меняет
+	require.NoError(t, a.Merge(NewSummary(DefaultAlpha)))
+	assert.Equal(t, all, a)
+
+	assert.ErrorIs(t, a.Merge(NewSummary(0.02)), ErrAlphaMismatch)
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"strconv"
+	"strings"
+)
+
+// FormatValue возвращает значение метрики в текстовом виде, как его отдает GET /value/{mType}/{mName}
+func FormatValue(m Metrics) string {
+	switch {
+	case m.MType == Gauge && m.Value != nil:
+		s := strconv.FormatFloat(*m.Value, 'f', 3, 64)
+		return strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	case m.MType == Counter && m.Delta != nil:
+		return strconv.FormatInt(*m.Delta, 10)
+	// Для распределений в текстовом виде отдается число наблюдений, квантили - через ?quantile=
+	case m.MType == Histogram && m.Histogram != nil:
+		return strconv.FormatUint(m.Histogram.Count, 10)
+	case m.MType == Summary && m.Summary != nil:
+		return strconv.FormatUint(m.Summary.Count, 10)
+	case m.MType == Set && m.Set != nil:
+		return strconv.FormatUint(m.Set.Estimate(), 10)
+	}
+
+	return ""
+}
+
+// ForResponse готовит метрику для JSON-ответа /value/: для summary считает квантили,
+// для set вместо скетча отдает оценку числа элементов
+func ForResponse(m Metrics) Metrics {
+	switch {
+	case m.Summary != nil:
+		m.Summary = m.Summary.Clone()
+		m.Summary.FillQuantiles(DefaultQuantiles...)
+	case m.Set != nil:
+		m.Set = &SetData{Cardinality: m.Set.Estimate()}
+	}
+
+	return m
+}
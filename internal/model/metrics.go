@@ -1,8 +1,11 @@
 package models
 
 const (
-	Counter = "counter"
-	Gauge   = "gauge"
+	Counter   = "counter"
+	Gauge     = "gauge"
+	Histogram = "histogram"
+	Summary   = "summary"
+	Set       = "set"
 )
 
 // NOTE: Не усложняем пример, вводя иерархическую вложенность структур.
@@ -16,6 +19,19 @@ type Metrics struct {
 	Delta *int64   `json:"delta,omitempty"`
 	Value *float64 `json:"value,omitempty"`
 	Hash  string   `json:"hash,omitempty"`
+	// Заполняются только для типов histogram, summary и set
+	Histogram *HistogramData `json:"histogram,omitempty"`
+	Summary   *SummaryData   `json:"summary,omitempty"`
+	Set       *SetData       `json:"set,omitempty"`
+	// Прирост и скорость счетчика за окно, заполняются сервером в ответах /value/
+	Increase *int64   `json:"increase,omitempty"`
+	Rate     *float64 `json:"rate,omitempty"`
+}
+
+// MetricRef - ссылка на метрику в запросах чтения
+type MetricRef struct {
+	ID    string `json:"id"`
+	MType string `json:"type"`
 }
 
 func ComposeMetrics(id string, mType string, v float64, d int64) Metrics {
@@ -62,6 +62,56 @@ func easyjson2220f231DecodeMetricappInternalModel(in *jlexer.Lexer, out *Metrics
 			}
 		case "hash":
 			out.Hash = string(in.String())
+		case "histogram":
+			if in.IsNull() {
+				in.Skip()
+				out.Histogram = nil
+			} else {
+				if out.Histogram == nil {
+					out.Histogram = new(HistogramData)
+				}
+				(*out.Histogram).UnmarshalEasyJSON(in)
+			}
+		case "summary":
+			if in.IsNull() {
+				in.Skip()
+				out.Summary = nil
+			} else {
+				if out.Summary == nil {
+					out.Summary = new(SummaryData)
+				}
+				(*out.Summary).UnmarshalEasyJSON(in)
+			}
+		case "set":
+			if in.IsNull() {
+				in.Skip()
+				out.Set = nil
+			} else {
+				if out.Set == nil {
+					out.Set = new(SetData)
+				}
+				(*out.Set).UnmarshalEasyJSON(in)
+			}
+		case "increase":
+			if in.IsNull() {
+				in.Skip()
+				out.Increase = nil
+			} else {
+				if out.Increase == nil {
+					out.Increase = new(int64)
+				}
+				*out.Increase = int64(in.Int64())
+			}
+		case "rate":
+			if in.IsNull() {
+				in.Skip()
+				out.Rate = nil
+			} else {
+				if out.Rate == nil {
+					out.Rate = new(float64)
+				}
+				*out.Rate = float64(in.Float64())
+			}
 		default:
 			in.SkipRecursive()
 		}
@@ -101,6 +151,31 @@ func easyjson2220f231EncodeMetricappInternalModel(out *jwriter.Writer, in Metric
 		out.RawString(prefix)
 		out.String(string(in.Hash))
 	}
+	if in.Histogram != nil {
+		const prefix string = ",\"histogram\":"
+		out.RawString(prefix)
+		(*in.Histogram).MarshalEasyJSON(out)
+	}
+	if in.Summary != nil {
+		const prefix string = ",\"summary\":"
+		out.RawString(prefix)
+		(*in.Summary).MarshalEasyJSON(out)
+	}
+	if in.Set != nil {
+		const prefix string = ",\"set\":"
+		out.RawString(prefix)
+		(*in.Set).MarshalEasyJSON(out)
+	}
+	if in.Increase != nil {
+		const prefix string = ",\"increase\":"
+		out.RawString(prefix)
+		out.Int64(int64(*in.Increase))
+	}
+	if in.Rate != nil {
+		const prefix string = ",\"rate\":"
+		out.RawString(prefix)
+		out.Float64(float64(*in.Rate))
+	}
 	out.RawByte('}')
 }
 
@@ -127,3 +202,76 @@ func (v *Metrics) UnmarshalJSON(data []byte) error {
 func (v *Metrics) UnmarshalEasyJSON(l *jlexer.Lexer) {
 	easyjson2220f231DecodeMetricappInternalModel(l, v)
 }
+func easyjson2220f231DecodeMetricappInternalModel1(in *jlexer.Lexer, out *MetricRef) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeFieldName(false)
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "id":
+			out.ID = string(in.String())
+		case "type":
+			out.MType = string(in.String())
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjson2220f231EncodeMetricappInternalModel1(out *jwriter.Writer, in MetricRef) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	{
+		const prefix string = ",\"id\":"
+		out.RawString(prefix[1:])
+		out.String(string(in.ID))
+	}
+	{
+		const prefix string = ",\"type\":"
+		out.RawString(prefix)
+		out.String(string(in.MType))
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v MetricRef) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjson2220f231EncodeMetricappInternalModel1(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v MetricRef) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjson2220f231EncodeMetricappInternalModel1(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *MetricRef) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjson2220f231DecodeMetricappInternalModel1(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *MetricRef) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjson2220f231DecodeMetricappInternalModel1(l, v)
+}
@@ -0,0 +1,205 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+var (
+	ErrInvalidSet        = errors.New("invalid set")
+	ErrPrecisionMismatch = errors.New("set sketch precision does not match stored one")
+)
+
+const (
+	// DefaultPrecision - точность HyperLogLog: 2^14 регистров, 16 КБ на метрику,
+	// стандартная погрешность оценки около 0.8%
+	DefaultPrecision = 14
+	minPrecision     = 4
+	maxPrecision     = 18
+)
+
+// SetData - элементы множества или готовый скетч HyperLogLog.
+// Агент может прислать сырые элементы или скетч, собранный на своей стороне,
+// чтобы не передавать идентификаторы на сервер. Сервер хранит только скетч.
+type SetData struct {
+	Elements []string `json:"elements,omitempty"`
+	// Скетч в формате HLL.MarshalBinary, в JSON - base64
+	Sketch []byte `json:"sketch,omitempty"`
+	// Оценка числа уникальных элементов, заполняется сервером в ответах /value/
+	Cardinality uint64 `json:"cardinality,omitempty"`
+}
+
+// Validate проверяет, что есть что добавлять и скетч разбирается
+func (s *SetData) Validate() error {
+	if len(s.Elements) == 0 && len(s.Sketch) == 0 {
+		return fmt.Errorf("%w: elements or sketch are required", ErrInvalidSet)
+	}
+
+	if len(s.Sketch) > 0 {
+		var h HLL
+		return h.UnmarshalBinary(s.Sketch)
+	}
+
+	return nil
+}
+
+// HLL собирает скетч из элементов и присланного скетча.
+// Без скетча используется точность по умолчанию.
+func (s *SetData) HLL() (*HLL, error) {
+	h := NewHLL(DefaultPrecision)
+	if len(s.Sketch) > 0 {
+		if err := h.UnmarshalBinary(s.Sketch); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, e := range s.Elements {
+		h.Add(e)
+	}
+
+	return h, nil
+}
+
+// Estimate возвращает оценку числа уникальных элементов
+func (s *SetData) Estimate() uint64 {
+	if len(s.Elements) == 0 && len(s.Sketch) == 0 {
+		return s.Cardinality
+	}
+
+	h, err := s.HLL()
+	if err != nil {
+		return 0
+	}
+
+	return h.Estimate()
+}
+
+// HLL - скетч HyperLogLog для оценки числа уникальных элементов.
+// Скетчи с одинаковой точностью объединяются взятием максимума по регистрам,
+// поэтому повторная отправка тех же элементов не меняет оценку.
+type HLL struct {
+	p         uint8
+	registers []uint8
+}
+
+// NewHLL создает пустой скетч с 2^p регистрами
+func NewHLL(p uint8) *HLL {
+	return &HLL{p: p, registers: make([]uint8, 1<<p)}
+}
+
+// Precision возвращает точность скетча
+func (h *HLL) Precision() uint8 {
+	return h.p
+}
+
+// Add добавляет элемент
+func (h *HLL) Add(element string) {
+	x := hashElement(element)
+	idx := x >> (64 - h.p)
+	// Ранг - позиция первой единицы в оставшихся битах; сдвинутый в хвост маркер
+	// ограничивает его значением 64-p+1
+	w := x<<h.p | 1<<(h.p-1)
+	rank := uint8(bits.LeadingZeros64(w)) + 1
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+// Merge объединяет скетч с other той же точности
+func (h *HLL) Merge(other *HLL) error {
+	if h.p != other.p {
+		return ErrPrecisionMismatch
+	}
+
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+
+	return nil
+}
+
+// Estimate оценивает число уникальных элементов.
+// Для маленьких множеств используется линейный подсчет по пустым регистрам.
+func (h *HLL) Estimate() uint64 {
+	m := float64(len(h.registers))
+
+	var (
+		sum   float64
+		zeros int
+	)
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	e := alpha * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(math.Round(e))
+}
+
+// Clone возвращает независимую копию
+func (h *HLL) Clone() *HLL {
+	c := &HLL{p: h.p, registers: make([]uint8, len(h.registers))}
+	copy(c.registers, h.registers)
+	return c
+}
+
+// MarshalBinary кодирует скетч: байт точности и значения регистров
+func (h *HLL) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, 1+len(h.registers))
+	b = append(b, h.p)
+	return append(b, h.registers...), nil
+}
+
+// UnmarshalBinary разбирает скетч, закодированный MarshalBinary
+func (h *HLL) UnmarshalBinary(b []byte) error {
+	if len(b) == 0 {
+		return fmt.Errorf("%w: empty sketch", ErrInvalidSet)
+	}
+
+	p := b[0]
+	if p < minPrecision || p > maxPrecision {
+		return fmt.Errorf("%w: precision must be between %d and %d", ErrInvalidSet, minPrecision, maxPrecision)
+	}
+	if len(b)-1 != 1<<p {
+		return fmt.Errorf("%w: expected %d registers", ErrInvalidSet, 1<<p)
+	}
+
+	maxRank := 64 - p + 1
+	for _, r := range b[1:] {
+		if r > maxRank {
+			return fmt.Errorf("%w: register value out of range", ErrInvalidSet)
+		}
+	}
+
+	h.p = p
+	h.registers = append(h.registers[:0], b[1:]...)
+	return nil
+}
+
+// hashElement - детерминированный 64-битный хеш: агенты и сервер должны получать
+// одинаковые регистры для одного элемента. FNV-1a плохо перемешивает старшие биты
+// у коротких строк, поэтому результат проходит через финализатор splitmix64.
+func hashElement(s string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(s))
+
+	x := f.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
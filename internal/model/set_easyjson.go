@@ -0,0 +1,204 @@
+// Code generated by easyjson for marshaling/unmarshaling. DO NOT EDIT.
+
+package models
+
+import (
+	json "encoding/json"
+	easyjson "github.com/mailru/easyjson"
+	jlexer "github.com/mailru/easyjson/jlexer"
+	jwriter "github.com/mailru/easyjson/jwriter"
+)
+
+// suppress unused package warning
+var (
+	_ *json.RawMessage
+	_ *jlexer.Lexer
+	_ *jwriter.Writer
+	_ easyjson.Marshaler
+)
+
+func easyjsonAb31f886DecodeMetricappInternalModel(in *jlexer.Lexer, out *SetData) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeFieldName(false)
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "elements":
+			if in.IsNull() {
+				in.Skip()
+				out.Elements = nil
+			} else {
+				in.Delim('[')
+				if out.Elements == nil {
+					if !in.IsDelim(']') {
+						out.Elements = make([]string, 0, 4)
+					} else {
+						out.Elements = []string{}
+					}
+				} else {
+					out.Elements = (out.Elements)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v1 string
+					v1 = string(in.String())
+					out.Elements = append(out.Elements, v1)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "sketch":
+			if in.IsNull() {
+				in.Skip()
+				out.Sketch = nil
+			} else {
+				out.Sketch = in.Bytes()
+			}
+		case "cardinality":
+			out.Cardinality = uint64(in.Uint64())
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonAb31f886EncodeMetricappInternalModel(out *jwriter.Writer, in SetData) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if len(in.Elements) != 0 {
+		const prefix string = ",\"elements\":"
+		first = false
+		out.RawString(prefix[1:])
+		{
+			out.RawByte('[')
+			for v3, v4 := range in.Elements {
+				if v3 > 0 {
+					out.RawByte(',')
+				}
+				out.String(string(v4))
+			}
+			out.RawByte(']')
+		}
+	}
+	if len(in.Sketch) != 0 {
+		const prefix string = ",\"sketch\":"
+		if first {
+			first = false
+			out.RawString(prefix[1:])
+		} else {
+			out.RawString(prefix)
+		}
+		out.Base64Bytes(in.Sketch)
+	}
+	if in.Cardinality != 0 {
+		const prefix string = ",\"cardinality\":"
+		if first {
+			first = false
+			out.RawString(prefix[1:])
+		} else {
+			out.RawString(prefix)
+		}
+		out.Uint64(uint64(in.Cardinality))
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v SetData) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonAb31f886EncodeMetricappInternalModel(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v SetData) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonAb31f886EncodeMetricappInternalModel(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *SetData) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonAb31f886DecodeMetricappInternalModel(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *SetData) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonAb31f886DecodeMetricappInternalModel(l, v)
+}
+func easyjsonAb31f886DecodeMetricappInternalModel1(in *jlexer.Lexer, out *HLL) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeFieldName(false)
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonAb31f886EncodeMetricappInternalModel1(out *jwriter.Writer, in HLL) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v HLL) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonAb31f886EncodeMetricappInternalModel1(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v HLL) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonAb31f886EncodeMetricappInternalModel1(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *HLL) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonAb31f886DecodeMetricappInternalModel1(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *HLL) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonAb31f886DecodeMetricappInternalModel1(l, v)
+}
@@ -0,0 +1,126 @@
+package models
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHLL_Estimate(t *testing.T) {
+	// Стандартная погрешность HyperLogLog - 1.04/sqrt(m)
+	sigma := 1.04 / math.Sqrt(float64(uint64(1)<<DefaultPrecision))
+
+	// 1000 и 30000 считаются линейным подсчетом, 60000 и 100000 - оценкой HyperLogLog
+	for _, n := range []int{1000, 30000, 60000, 100000} {
+		t.Run(strconv.Itoa(n), func(t *testing.T) {
+			h := NewHLL(DefaultPrecision)
+			for i := range n {
+				h.Add("element-" + strconv.Itoa(i))
+			}
+
+			got := float64(h.Estimate())
+			assert.InEpsilon(t, float64(n), got, 3*sigma, "estimate %v", got)
+
+			// Повторные элементы оценку не меняют
+			before := h.Estimate()
+			for i := range n / 10 {
+				h.Add("element-" + strconv.Itoa(i))
+			}
+			assert.Equal(t, before, h.Estimate())
+		})
+	}
+
+	assert.Equal(t, uint64(0), NewHLL(DefaultPrecision).Estimate())
+}
+
+func TestHLL_MarshalBinary(t *testing.T) {
+	h := NewHLL(DefaultPrecision)
+	for i := range 5000 {
+		h.Add(strconv.Itoa(i))
+	}
+
+	b, err := h.MarshalBinary()
+	require.NoError(t, err)
+	assert.Len(t, b, 1+1<<DefaultPrecision)
+
+	var got HLL
+	require.NoError(t, got.UnmarshalBinary(b))
+	assert.Equal(t, h, &got)
+	assert.Equal(t, h.Estimate(), got.Estimate())
+
+	// Скетч, присланный клиентом, дает ту же оценку, что и элементы
+	s := &SetData{Sketch: b}
+	require.NoError(t, s.Validate())
+	assert.Equal(t, h.Estimate(), s.Estimate())
+}
+
+func TestHLL_UnmarshalBinary(t *testing.T) {
+	valid := func(p uint8) []byte {
+		b, _ := NewHLL(p).MarshalBinary()
+		return b
+	}
+	outOfRange := valid(minPrecision)
+	outOfRange[1] = 64 - minPrecision + 2
+	maxRank := valid(minPrecision)
+	maxRank[1] = 64 - minPrecision + 1
+
+	tests := []struct {
+		name string
+		b    []byte
+		ok   bool
+	}{
+		{"min precision", valid(minPrecision), true},
+		{"max precision", valid(maxPrecision), true},
+		{"max register value", maxRank, true},
+		{"empty", nil, false},
+		{"precision too low", append([]byte{minPrecision - 1}, make([]byte, 1<<(minPrecision-1))...), false},
+		{"precision too high", []byte{maxPrecision + 1}, false},
+		{"too few registers", valid(minPrecision)[:1<<minPrecision], false},
+		{"too many registers", append(valid(minPrecision), 0), false},
+		{"register out of range", outOfRange, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h HLL
+			err := h.UnmarshalBinary(tt.b)
+			if tt.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidSet)
+			}
+		})
+	}
+}
+
+func TestHLL_Merge(t *testing.T) {
+	all, a, b := NewHLL(DefaultPrecision), NewHLL(DefaultPrecision), NewHLL(DefaultPrecision)
+	for i := range 20000 {
+		e := strconv.Itoa(i)
+		all.Add(e)
+		if i%2 == 0 {
+			a.Add(e)
+		} else {
+			b.Add(e)
+		}
+	}
+
+	// Объединение скетчей совпадает со скетчем всех элементов
+	require.NoError(t, a.Merge(b))
+	assert.Equal(t, all, a)
+
+	// Повторное объединение ничего не меняет
+	require.NoError(t, a.Merge(b))
+	assert.Equal(t, all, a)
+
+	assert.ErrorIs(t, a.Merge(NewHLL(DefaultPrecision-1)), ErrPrecisionMismatch)
+
+	// Скетч агента с другой точностью не объединяется с сохраненным
+	other, _ := NewHLL(10).MarshalBinary()
+	set, err := (&SetData{Sketch: other}).HLL()
+	require.NoError(t, err)
+	assert.ErrorIs(t, all.Merge(set), ErrPrecisionMismatch)
+}
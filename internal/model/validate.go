@@ -0,0 +1,188 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	// MaxIDLength - максимальная длина имени метрики
+	MaxIDLength = 255
+	// ReservedPrefix - префикс собственных метрик сервера, клиентам писать в них нельзя
+	ReservedPrefix = "_server."
+)
+
+var (
+	ErrEmptyID         = errors.New("metric name is required")
+	ErrIDTooLong       = fmt.Errorf("metric name is longer than %d characters", MaxIDLength)
+	ErrUnknownType     = errors.New("unknown metric type")
+	ErrMissingValue    = errors.New("gauge value is required")
+	ErrMissingDelta    = errors.New("counter delta is required")
+	ErrInvalidGauge    = errors.New("gauge value must be a finite number")
+	ErrCounterOverflow = errors.New("counter overflow")
+	ErrReservedID      = fmt.Errorf("metric names starting with %q are reserved", ReservedPrefix)
+)
+
+// Validate проверяет метрику перед записью в хранилище.
+// Переполнение счетчика здесь не проверяется, так как для этого нужно текущее значение,
+// см. AddDelta.
+func (m Metrics) Validate() error {
+	if m.ID == "" {
+		return ErrEmptyID
+	}
+	if len(m.ID) > MaxIDLength {
+		return ErrIDTooLong
+	}
+
+	switch m.MType {
+	case Gauge:
+		if m.Value == nil {
+			return ErrMissingValue
+		}
+		return ValidateGauge(*m.Value)
+	case Counter:
+		if m.Delta == nil {
+			return ErrMissingDelta
+		}
+	case Histogram:
+		if m.Histogram == nil {
+			return fmt.Errorf("%w: histogram data is required", ErrInvalidHistogram)
+		}
+		return m.Histogram.Validate()
+	case Summary:
+		if m.Summary == nil {
+			return fmt.Errorf("%w: summary data is required", ErrInvalidSummary)
+		}
+		return m.Summary.Validate()
+	case Set:
+		if m.Set == nil {
+			return fmt.Errorf("%w: set data is required", ErrInvalidSet)
+		}
+		return m.Set.Validate()
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownType, m.MType)
+	}
+
+	return nil
+}
+
+// ValidateType проверяет, что тип метрики известен
+func ValidateType(t string) error {
+	switch t {
+	case Gauge, Counter, Histogram, Summary, Set:
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrUnknownType, t)
+}
+
+// ValidateGauge отбрасывает NaN и бесконечности
+func ValidateGauge(v float64) error {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return ErrInvalidGauge
+	}
+
+	return nil
+}
+
+// AddDelta складывает значение счетчика с приращением, не допуская переполнения int64
+func AddDelta(cur, delta int64) (int64, error) {
+	if (delta > 0 && cur > math.MaxInt64-delta) || (delta < 0 && cur < math.MinInt64-delta) {
+		return cur, ErrCounterOverflow
+	}
+
+	return cur + delta, nil
+}
+
+// ItemError - ошибка одной метрики из пакета /updates/
+type ItemError struct {
+	Index int
+	ID    string
+	Err   error
+}
+
+func (e ItemError) Error() string {
+	return fmt.Sprintf("metric #%d (%s): %v", e.Index, e.ID, e.Err)
+}
+
+func (e ItemError) Unwrap() error {
+	return e.Err
+}
+
+func (e ItemError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Index int    `json:"index"`
+		ID    string `json:"id"`
+		Error string `json:"error"`
+	}{
+		Index: e.Index,
+		ID:    e.ID,
+		Error: e.Err.Error(),
+	})
+}
+
+// BatchError собирает ошибки всех невалидных метрик пакета
+type BatchError []ItemError
+
+func (e BatchError) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, item := range e {
+		msgs = append(msgs, item.Error())
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+func (e BatchError) Unwrap() []error {
+	errs := make([]error, 0, len(e))
+	for _, item := range e {
+		errs = append(errs, item)
+	}
+
+	return errs
+}
+
+// CheckReserved не дает клиентам писать в метрики с зарезервированным префиксом
+func CheckReserved(id string) error {
+	if strings.HasPrefix(id, ReservedPrefix) {
+		return ErrReservedID
+	}
+
+	return nil
+}
+
+// CheckReservedBatch - то же для пакета, возвращает BatchError
+func CheckReservedBatch(metrics []Metrics) error {
+	var errs BatchError
+	for i, m := range metrics {
+		if err := CheckReserved(m.ID); err != nil {
+			errs = append(errs, ItemError{Index: i, ID: m.ID, Err: err})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// ValidateBatch проверяет каждую метрику пакета и возвращает BatchError,
+// если хотя бы одна из них невалидна
+func ValidateBatch(metrics []Metrics) error {
+	var errs BatchError
+	for i, m := range metrics {
+		if err := m.Validate(); err != nil {
+			errs = append(errs, ItemError{Index: i, ID: m.ID, Err: err})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
@@ -0,0 +1,285 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"math"
+	models "metricapp/internal/model"
+	"sort"
+)
+
+// Source возвращает метрики, имена которых начинаются с prefix.
+// Пустой префикс означает все метрики. Лишние метрики допустимы - их отсеет Eval.
+type Source func(ctx context.Context, prefix string) ([]models.Metrics, error)
+
+// Sample - значение одной метрики в результате
+type Sample struct {
+	ID    string  `json:"id"`
+	Type  string  `json:"type"`
+	Value float64 `json:"value"`
+}
+
+// Result - результат запроса: число (type=scalar) или набор метрик (type=vector)
+type Result struct {
+	Type   string   `json:"type"`
+	Value  *float64 `json:"value,omitempty"`
+	Series []Sample `json:"series,omitempty"`
+}
+
+const (
+	ResultScalar = "scalar"
+	ResultVector = "vector"
+)
+
+// value - промежуточное значение: число или набор метрик
+type value struct {
+	scalar bool
+	v      float64
+	series []Sample
+}
+
+type evaluator struct {
+	ctx context.Context
+	src Source
+	// Одна и та же выборка в запросе читается из хранилища один раз
+	cache map[string][]models.Metrics
+}
+
+// Eval вычисляет запрос по текущему состоянию хранилища
+func (q *Query) Eval(ctx context.Context, src Source) (Result, error) {
+	e := &evaluator{ctx: ctx, src: src, cache: make(map[string][]models.Metrics)}
+
+	v, err := e.eval(q.root)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if v.scalar {
+		if math.IsNaN(v.v) || math.IsInf(v.v, 0) {
+			return Result{}, fmt.Errorf("%w: result is not a finite number", ErrEval)
+		}
+		return Result{Type: ResultScalar, Value: &v.v}, nil
+	}
+
+	for _, s := range v.series {
+		if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			return Result{}, fmt.Errorf("%w: %s is not a finite number", ErrEval, s.ID)
+		}
+	}
+	return Result{Type: ResultVector, Series: v.series}, nil
+}
+
+func (e *evaluator) eval(n node) (value, error) {
+	switch n := n.(type) {
+	case numberNode:
+		return value{scalar: true, v: n.v}, nil
+	case selectorNode:
+		return e.selector(n)
+	case negNode:
+		x, err := e.eval(n.x)
+		if err != nil {
+			return value{}, err
+		}
+		return apply(x, func(v float64) float64 { return -v }), nil
+	case callNode:
+		return e.call(n)
+	case binaryNode:
+		return e.binary(n)
+	}
+
+	return value{}, fmt.Errorf("%w: unknown expression", ErrEval)
+}
+
+func (e *evaluator) selector(n selectorNode) (value, error) {
+	metrics, ok := e.cache[n.prefix]
+	if !ok {
+		var err error
+		metrics, err = e.src(e.ctx, n.prefix)
+		if err != nil {
+			return value{}, err
+		}
+		e.cache[n.prefix] = metrics
+	}
+
+	series := make([]Sample, 0)
+	for _, m := range metrics {
+		if !n.re.MatchString(m.ID) {
+			continue
+		}
+		if v, ok := numeric(m); ok {
+			series = append(series, Sample{ID: m.ID, Type: m.MType, Value: v})
+		}
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].ID != series[j].ID {
+			return series[i].ID < series[j].ID
+		}
+		return series[i].Type < series[j].Type
+	})
+
+	return value{series: series}, nil
+}
+
+// numeric - числовое значение метрики: для распределений - число наблюдений,
+// для множеств - оценка числа элементов
+func numeric(m models.Metrics) (float64, bool) {
+	switch {
+	case m.MType == models.Gauge && m.Value != nil:
+		return *m.Value, true
+	case m.MType == models.Counter && m.Delta != nil:
+		return float64(*m.Delta), true
+	case m.MType == models.Histogram && m.Histogram != nil:
+		return float64(m.Histogram.Count), true
+	case m.MType == models.Summary && m.Summary != nil:
+		return float64(m.Summary.Count), true
+	case m.MType == models.Set && m.Set != nil:
+		return float64(m.Set.Estimate()), true
+	}
+
+	return 0, false
+}
+
+func (e *evaluator) call(n callNode) (value, error) {
+	x, err := e.eval(n.arg)
+	if err != nil {
+		return value{}, err
+	}
+
+	// Агрегат от числа - само число
+	if x.scalar {
+		if n.fn == "count" {
+			return value{scalar: true, v: 1}, nil
+		}
+		return x, nil
+	}
+
+	switch n.fn {
+	case "count":
+		return value{scalar: true, v: float64(len(x.series))}, nil
+	case "sum":
+		var sum float64
+		for _, s := range x.series {
+			sum += s.Value
+		}
+		return value{scalar: true, v: sum}, nil
+	}
+
+	if len(x.series) == 0 {
+		return value{}, fmt.Errorf("%w: %s() of empty selection", ErrNoMatch, n.fn)
+	}
+
+	res := x.series[0].Value
+	for _, s := range x.series[1:] {
+		switch n.fn {
+		case "avg":
+			res += s.Value
+		case "min":
+			res = math.Min(res, s.Value)
+		case "max":
+			res = math.Max(res, s.Value)
+		}
+	}
+	if n.fn == "avg" {
+		res /= float64(len(x.series))
+	}
+
+	return value{scalar: true, v: res}, nil
+}
+
+// binary выполняет арифметику. Выборка из одной метрики ведет себя как число,
+// выборка из нескольких - поэлементно с числом. Две выборки из нескольких
+// метрик сначала нужно агрегировать.
+func (e *evaluator) binary(n binaryNode) (value, error) {
+	l, err := e.operand(n.l)
+	if err != nil {
+		return value{}, err
+	}
+	r, err := e.operand(n.r)
+	if err != nil {
+		return value{}, err
+	}
+
+	op := func(a, b float64) (float64, error) {
+		switch n.op {
+		case '+':
+			return a + b, nil
+		case '-':
+			return a - b, nil
+		case '*':
+			return a * b, nil
+		}
+
+		if b == 0 {
+			return 0, fmt.Errorf("%w: division by zero", ErrEval)
+		}
+		return a / b, nil
+	}
+
+	switch {
+	case l.scalar && r.scalar:
+		v, err := op(l.v, r.v)
+		return value{scalar: true, v: v}, err
+	case !l.scalar && !r.scalar:
+		return value{}, fmt.Errorf("%w: both operands select several metrics, aggregate one of them", ErrEval)
+	}
+
+	vec, scalar := l, r
+	if l.scalar {
+		vec, scalar = r, l
+	}
+
+	series := make([]Sample, 0, len(vec.series))
+	for _, s := range vec.series {
+		a, b := s.Value, scalar.v
+		if l.scalar {
+			a, b = b, a
+		}
+
+		v, err := op(a, b)
+		if err != nil {
+			return value{}, err
+		}
+		s.Value = v
+		series = append(series, s)
+	}
+
+	return value{series: series}, nil
+}
+
+// operand вычисляет операнд арифметики: выборка из одной метрики становится числом,
+// пустая выборка - ошибкой
+func (e *evaluator) operand(n node) (value, error) {
+	v, err := e.eval(n)
+	if err != nil {
+		return value{}, err
+	}
+	if v.scalar {
+		return v, nil
+	}
+
+	switch len(v.series) {
+	case 0:
+		if sel, ok := n.(selectorNode); ok {
+			return value{}, fmt.Errorf("%w: %s", ErrNoMatch, sel.text)
+		}
+		return value{}, ErrNoMatch
+	case 1:
+		return value{scalar: true, v: v.series[0].Value}, nil
+	}
+
+	return v, nil
+}
+
+func apply(v value, fn func(float64) float64) value {
+	if v.scalar {
+		return value{scalar: true, v: fn(v.v)}
+	}
+
+	series := make([]Sample, 0, len(v.series))
+	for _, s := range v.series {
+		s.Value = fn(s.Value)
+		series = append(series, s)
+	}
+
+	return value{series: series}
+}
@@ -0,0 +1,405 @@
+// Package query - язык запросов POST /query: выборка метрик по имени, агрегаты и арифметика.
+//
+//	HeapInuse                 метрика по точному имени
+//	Heap*                     glob: * - любая строка, ? - любой символ
+//	"my-metric"               точное имя в кавычках, если в нем есть спецсимволы
+//	/^Heap(Inuse|Sys)$/       регулярное выражение (синтаксис Go)
+//	sum(Heap*)                агрегаты: sum, avg, min, max, count
+//	HeapInuse / HeapSys * 100 арифметика: + - * / и скобки
+//
+// Знак * сразу после имени считается частью glob, поэтому умножение
+// отделяется пробелами: "Alloc * 2", а не "Alloc*2".
+package query
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrSyntax - запрос не удалось разобрать
+	ErrSyntax = errors.New("query syntax error")
+	// ErrNoMatch - под выборку не попала ни одна метрика, а для вычисления она нужна
+	ErrNoMatch = errors.New("no metrics match selector")
+	// ErrEval - запрос разобран, но не вычисляется: деление на ноль, арифметика над несколькими выборками
+	ErrEval = errors.New("query evaluation error")
+)
+
+// Ограничения на сложность запроса
+const (
+	maxQueryLength = 4096
+	maxDepth       = 32
+)
+
+var functions = map[string]bool{
+	"sum":   true,
+	"avg":   true,
+	"min":   true,
+	"max":   true,
+	"count": true,
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokIdent
+	tokString
+	tokRegex
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// lex разбивает запрос на токены. * и / трактуются как операторы только после операнда,
+// иначе * начинает glob, а / - регулярное выражение.
+func lex(s string) ([]token, error) {
+	var (
+		tokens  []token
+		operand bool
+	)
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+
+		case c == '(':
+			tokens = append(tokens, token{kind: tokLParen, text: "(", pos: i})
+			i++
+			operand = false
+			continue
+
+		case c == ')':
+			tokens = append(tokens, token{kind: tokRParen, text: ")", pos: i})
+			i++
+			operand = true
+			continue
+
+		case c == '+' || c == '-' || (operand && (c == '*' || c == '/')):
+			tokens = append(tokens, token{kind: tokOp, text: string(c), pos: i})
+			i++
+			operand = false
+			continue
+
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(s) && (isDigit(s[j]) || s[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: s[i:j], pos: i})
+			i = j
+
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				j++
+			}
+			if j == len(s) {
+				return nil, fmt.Errorf("%w: unterminated string at %d", ErrSyntax, i)
+			}
+			tokens = append(tokens, token{kind: tokString, text: s[i+1 : j], pos: i})
+			i = j + 1
+
+		case c == '/':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != '/'; j++ {
+				if s[j] == '\\' && j+1 < len(s) && s[j+1] == '/' {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			if j == len(s) {
+				return nil, fmt.Errorf("%w: unterminated regex at %d", ErrSyntax, i)
+			}
+			tokens = append(tokens, token{kind: tokRegex, text: b.String(), pos: i})
+			i = j + 1
+
+		case isIdentStart(c):
+			j := i
+			for j < len(s) && (isIdentStart(s[j]) || isDigit(s[j])) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: s[i:j], pos: i})
+			i = j
+
+		default:
+			return nil, fmt.Errorf("%w: unexpected %q at %d", ErrSyntax, c, i)
+		}
+
+		operand = true
+	}
+
+	return append(tokens, token{kind: tokEOF, pos: len(s)}), nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '.' || c == ':' || c == '*' || c == '?'
+}
+
+type node interface{}
+
+type numberNode struct {
+	v float64
+}
+
+// selectorNode выбирает метрики по имени. prefix - постоянное начало имени,
+// по нему хранилище отбирает кандидатов до проверки регулярным выражением.
+type selectorNode struct {
+	text   string
+	prefix string
+	re     *regexp.Regexp
+}
+
+type callNode struct {
+	fn  string
+	arg node
+}
+
+type binaryNode struct {
+	op   byte
+	l, r node
+}
+
+type negNode struct {
+	x node
+}
+
+// Query - разобранный запрос
+type Query struct {
+	text string
+	root node
+}
+
+// Parse разбирает запрос
+func Parse(s string) (*Query, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, fmt.Errorf("%w: empty query", ErrSyntax)
+	}
+	if len(s) > maxQueryLength {
+		return nil, fmt.Errorf("%w: query is longer than %d characters", ErrSyntax, maxQueryLength)
+	}
+
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.expr(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("%w: unexpected %q at %d", ErrSyntax, t.text, t.pos)
+	}
+
+	return &Query{text: s, root: root}, nil
+}
+
+func (q *Query) String() string {
+	return q.text
+}
+
+// parser - рекурсивный спуск:
+//
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/") unary }
+//	unary   = "-" unary | primary
+//	primary = number | selector | func "(" expr ")" | "(" expr ")"
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expr(depth int) (node, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("%w: query is nested too deep", ErrSyntax)
+	}
+
+	l, err := p.term(depth)
+	if err != nil {
+		return nil, err
+	}
+
+	for t := p.peek(); t.kind == tokOp && (t.text == "+" || t.text == "-"); t = p.peek() {
+		p.next()
+		r, err := p.term(depth)
+		if err != nil {
+			return nil, err
+		}
+		l = binaryNode{op: t.text[0], l: l, r: r}
+	}
+
+	return l, nil
+}
+
+func (p *parser) term(depth int) (node, error) {
+	l, err := p.unary(depth)
+	if err != nil {
+		return nil, err
+	}
+
+	for t := p.peek(); t.kind == tokOp && (t.text == "*" || t.text == "/"); t = p.peek() {
+		p.next()
+		r, err := p.unary(depth)
+		if err != nil {
+			return nil, err
+		}
+		l = binaryNode{op: t.text[0], l: l, r: r}
+	}
+
+	return l, nil
+}
+
+func (p *parser) unary(depth int) (node, error) {
+	if t := p.peek(); t.kind == tokOp && t.text == "-" {
+		p.next()
+		if depth > maxDepth {
+			return nil, fmt.Errorf("%w: query is nested too deep", ErrSyntax)
+		}
+		x, err := p.unary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return negNode{x: x}, nil
+	}
+
+	return p.primary(depth)
+}
+
+func (p *parser) primary(depth int) (node, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokNumber:
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid number %q at %d", ErrSyntax, t.text, t.pos)
+		}
+		return numberNode{v: v}, nil
+
+	case tokIdent:
+		if p.peek().kind == tokLParen {
+			if !functions[t.text] {
+				return nil, fmt.Errorf("%w: unknown function %q at %d", ErrSyntax, t.text, t.pos)
+			}
+			p.next()
+
+			arg, err := p.expr(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(tokRParen); err != nil {
+				return nil, err
+			}
+			return callNode{fn: t.text, arg: arg}, nil
+		}
+		return globSelector(t.text), nil
+
+	case tokString:
+		if t.text == "" {
+			return nil, fmt.Errorf("%w: empty metric name at %d", ErrSyntax, t.pos)
+		}
+		return selectorNode{
+			text:   t.text,
+			prefix: t.text,
+			re:     regexp.MustCompile("^" + regexp.QuoteMeta(t.text) + "$"),
+		}, nil
+
+	case tokRegex:
+		re, err := regexp.Compile(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid regex at %d: %v", ErrSyntax, t.pos, err)
+		}
+		// Префикс известен, только если выражение привязано к началу имени
+		var prefix string
+		if strings.HasPrefix(t.text, "^") {
+			if rest, err := regexp.Compile(strings.TrimPrefix(t.text, "^")); err == nil {
+				prefix, _ = rest.LiteralPrefix()
+			}
+		}
+		return selectorNode{text: "/" + t.text + "/", prefix: prefix, re: re}, nil
+
+	case tokLParen:
+		x, err := p.expr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokRParen); err != nil {
+			return nil, err
+		}
+		return x, nil
+
+	case tokEOF:
+		return nil, fmt.Errorf("%w: unexpected end of query", ErrSyntax)
+	}
+
+	return nil, fmt.Errorf("%w: unexpected %q at %d", ErrSyntax, t.text, t.pos)
+}
+
+func (p *parser) expect(kind tokenKind) error {
+	if t := p.next(); t.kind != kind {
+		if t.kind == tokEOF {
+			return fmt.Errorf("%w: unexpected end of query", ErrSyntax)
+		}
+		return fmt.Errorf("%w: unexpected %q at %d", ErrSyntax, t.text, t.pos)
+	}
+
+	return nil
+}
+
+// globSelector переводит glob в регулярное выражение на все имя
+func globSelector(glob string) selectorNode {
+	var (
+		b      strings.Builder
+		prefix = glob
+	)
+	if i := strings.IndexAny(glob, "*?"); i >= 0 {
+		prefix = glob[:i]
+	}
+
+	b.WriteByte('^')
+	for _, c := range glob {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteByte('.')
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteByte('$')
+
+	return selectorNode{text: glob, prefix: prefix, re: regexp.MustCompile(b.String())}
+}
@@ -0,0 +1,111 @@
+package query
+
+import (
+	"context"
+	models "metricapp/internal/model"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gauge(id string, v float64) models.Metrics {
+	return models.Metrics{ID: id, MType: models.Gauge, Value: &v}
+}
+
+func counter(id string, d int64) models.Metrics {
+	return models.Metrics{ID: id, MType: models.Counter, Delta: &d}
+}
+
+var testMetrics = []models.Metrics{
+	gauge("HeapInuse", 30),
+	gauge("HeapSys", 120),
+	gauge("HeapIdle", 90),
+	gauge("Alloc", 10),
+	gauge("my-metric", 7),
+	counter("PollCount", 5),
+}
+
+// testSource отдает кандидатов по префиксу, как хранилища
+func testSource(_ context.Context, prefix string) ([]models.Metrics, error) {
+	var res []models.Metrics
+	for _, m := range testMetrics {
+		if strings.HasPrefix(m.ID, prefix) {
+			res = append(res, m)
+		}
+	}
+	return res, nil
+}
+
+func eval(t *testing.T, q string) (Result, error) {
+	t.Helper()
+
+	parsed, err := Parse(q)
+	if err != nil {
+		return Result{}, err
+	}
+	return parsed.Eval(context.Background(), testSource)
+}
+
+func TestQuery_Scalar(t *testing.T) {
+	cases := []struct {
+		query    string
+		expected float64
+	}{
+		{query: "sum(Heap*)", expected: 240},
+		{query: "avg(Heap*)", expected: 80},
+		{query: "min(Heap*)", expected: 30},
+		{query: "max(/^Heap(Inuse|Sys)$/)", expected: 120},
+		{query: "count(*)", expected: 6},
+		{query: "count(Heap?nuse)", expected: 1},
+		{query: "HeapInuse / HeapSys * 100", expected: 25},
+		{query: "-(Alloc + 2) * 3", expected: -36},
+		{query: `"my-metric" - PollCount`, expected: 2},
+		{query: "sum(Heap* * 2) / count(Heap*)", expected: 160},
+		{query: "count(Missing*)", expected: 0},
+		{query: "1.5 + 2", expected: 3.5},
+	}
+
+	for _, c := range cases {
+		res, err := eval(t, c.query)
+		require.NoError(t, err, c.query)
+		require.Equal(t, ResultScalar, res.Type, c.query)
+		assert.InDelta(t, c.expected, *res.Value, 1e-9, c.query)
+	}
+}
+
+func TestQuery_Vector(t *testing.T) {
+	res, err := eval(t, "Heap* / 10")
+	require.NoError(t, err)
+	require.Equal(t, ResultVector, res.Type)
+	assert.Equal(t, []Sample{
+		{ID: "HeapIdle", Type: models.Gauge, Value: 9},
+		{ID: "HeapInuse", Type: models.Gauge, Value: 3},
+		{ID: "HeapSys", Type: models.Gauge, Value: 12},
+	}, res.Series)
+}
+
+func TestQuery_Errors(t *testing.T) {
+	cases := []struct {
+		query    string
+		expected error
+	}{
+		{query: "", expected: ErrSyntax},
+		{query: "sum(Heap*", expected: ErrSyntax},
+		{query: "median(Heap*)", expected: ErrSyntax},
+		{query: "Alloc +", expected: ErrSyntax},
+		{query: "/[/", expected: ErrSyntax},
+		{query: `"unterminated`, expected: ErrSyntax},
+		{query: strings.Repeat("(", 100) + "1" + strings.Repeat(")", 100), expected: ErrSyntax},
+		{query: "Missing + 1", expected: ErrNoMatch},
+		{query: "avg(Missing*)", expected: ErrNoMatch},
+		{query: "Alloc / 0", expected: ErrEval},
+		{query: "Heap* / Heap*", expected: ErrEval},
+	}
+
+	for _, c := range cases {
+		_, err := eval(t, c.query)
+		assert.ErrorIs(t, err, c.expected, c.query)
+	}
+}
@@ -0,0 +1,192 @@
+package repository
+
+import (
+	"container/list"
+	models "metricapp/internal/model"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// readCache - LRU-кэш метрик базы по типу и имени. Заполняется при чтении через QueryRow
+// и при записи, сбрасывается удалениями и уведомлениями metrics_changed от других реплик.
+// Включен, только пока уведомления слушаются: без них не узнать о чужих записях.
+// TTL ограничивает, как долго может жить значение, если уведомление все же потерялось.
+// Значения в кэше не изменяются, их можно отдавать без копирования.
+type readCache struct {
+	mu      sync.Mutex
+	enabled bool
+	size    int
+	ttl     time.Duration
+	// Спереди - недавно использованные
+	lru   *list.List
+	items map[models.MetricRef]*list.Element
+	// Растет при каждой записи и инвалидации. Прочитанное из базы кладется в кэш, только если
+	// за время чтения поколение не сменилось, иначе в кэш может попасть старое значение.
+	gen uint64
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type cacheEntry struct {
+	ref     models.MetricRef
+	m       models.Metrics
+	expires time.Time
+}
+
+// Типы метрик, по которым ищется имя из уведомления: в базе имя уникально, тип в нем не передается
+var metricTypes = []string{models.Gauge, models.Counter, models.Histogram, models.Summary, models.Set}
+
+// cache - кэш чтения базы, общий для процесса. Размер и TTL задает SetCache.
+var cache = newReadCache(0, 0)
+
+func newReadCache(size int, ttl time.Duration) *readCache {
+	return &readCache{
+		size:  size,
+		ttl:   ttl,
+		lru:   list.New(),
+		items: make(map[models.MetricRef]*list.Element),
+	}
+}
+
+// SetCache задает размер кэша чтения базы (0 - выключен) и время жизни значений (0 - без ограничения)
+func SetCache(size int, ttl time.Duration) {
+	cache.resize(size, ttl)
+}
+
+// CacheStats возвращает попадания и промахи кэша с прошлого вызова
+func CacheStats() (hits int64, misses int64) {
+	return cache.hits.Swap(0), cache.misses.Swap(0)
+}
+
+func (c *readCache) resize(size int, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size, c.ttl = size, ttl
+	for c.lru.Len() > max(size, 0) {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *readCache) get(ref models.MetricRef, now time.Time) (models.Metrics, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.enabled || c.size <= 0 {
+		return models.Metrics{}, false
+	}
+
+	el, ok := c.items[ref]
+	if ok && c.ttl > 0 && now.After(el.Value.(*cacheEntry).expires) {
+		c.remove(el)
+		ok = false
+	}
+	if !ok {
+		c.misses.Add(1)
+		return models.Metrics{}, false
+	}
+
+	c.hits.Add(1)
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry).m, true
+}
+
+// generation запоминается перед чтением или записью в базу и передается в put или update
+func (c *readCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.gen
+}
+
+// put кладет прочитанную из базы метрику, если с начала чтения ее никто не менял
+func (c *readCache) put(gen uint64, m models.Metrics, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen == c.gen {
+		c.store(m, now)
+	}
+}
+
+// update обновляет кэш значениями, записанными в базу. Если во время записи поколение сменилось,
+// порядок записей неизвестен, и метрики просто сбрасываются.
+func (c *readCache) update(gen uint64, metrics []models.Metrics, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stale := gen != c.gen
+	c.gen++
+	for _, m := range metrics {
+		if stale {
+			c.drop(m.ID)
+			continue
+		}
+		c.store(m, now)
+	}
+}
+
+// invalidate сбрасывает метрики с именами ids любого типа
+func (c *readCache) invalidate(ids ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for _, id := range ids {
+		c.drop(id)
+	}
+}
+
+func (c *readCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.lru.Init()
+	clear(c.items)
+}
+
+// setEnabled включает кэш с чистого листа или выключает и очищает его
+func (c *readCache) setEnabled(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.enabled = enabled
+	c.gen++
+	c.lru.Init()
+	clear(c.items)
+}
+
+func (c *readCache) store(m models.Metrics, now time.Time) {
+	if !c.enabled || c.size <= 0 {
+		return
+	}
+
+	ref := models.MetricRef{ID: m.ID, MType: m.MType}
+	entry := &cacheEntry{ref: ref, m: m, expires: now.Add(c.ttl)}
+	if el, ok := c.items[ref]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.items[ref] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *readCache) drop(id string) {
+	for _, t := range metricTypes {
+		if el, ok := c.items[models.MetricRef{ID: id, MType: t}]; ok {
+			c.remove(el)
+		}
+	}
+}
+
+func (c *readCache) remove(el *list.Element) {
+	delete(c.items, el.Value.(*cacheEntry).ref)
+	c.lru.Remove(el)
+}
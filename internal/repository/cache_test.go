@@ -0,0 +1,72 @@
+package repository
+
+import (
+	models "metricapp/internal/model"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadCache(t *testing.T) {
+	c := newReadCache(2, time.Minute)
+	now := time.Now()
+	v := 1.0
+	m := models.Metrics{ID: "a", MType: models.Gauge, Value: &v}
+	ref := models.MetricRef{ID: "a", MType: models.Gauge}
+
+	// Пока нет LISTEN, кэш ничего не хранит
+	c.put(c.generation(), m, now)
+	_, ok := c.get(ref, now)
+	assert.False(t, ok)
+
+	c.setEnabled(true)
+	c.put(c.generation(), m, now)
+	got, ok := c.get(ref, now)
+	assert.True(t, ok)
+	assert.Equal(t, m, got)
+	_, ok = c.get(models.MetricRef{ID: "a", MType: models.Counter}, now)
+	assert.False(t, ok)
+
+	// Устаревшее по TTL не отдается
+	_, ok = c.get(ref, now.Add(2*time.Minute))
+	assert.False(t, ok)
+
+	// Значение, прочитанное до записи, в кэш не попадает, записанное - попадает
+	gen := c.generation()
+	w := 2.0
+	c.update(c.generation(), []models.Metrics{{ID: "a", MType: models.Gauge, Value: &w}}, now)
+	c.put(gen, m, now)
+	got, ok = c.get(ref, now)
+	assert.True(t, ok)
+	assert.Equal(t, 2.0, *got.Value)
+
+	// Запись, во время которой кэш менялся, сбрасывает метрику
+	c.update(gen, []models.Metrics{m}, now)
+	_, ok = c.get(ref, now)
+	assert.False(t, ok)
+
+	// Вытесняется давно не использованная
+	for _, id := range []string{"a", "b"} {
+		c.put(c.generation(), models.Metrics{ID: id, MType: models.Gauge, Value: &v}, now)
+	}
+	c.get(ref, now)
+	c.put(c.generation(), models.Metrics{ID: "c", MType: models.Gauge, Value: &v}, now)
+	_, ok = c.get(models.MetricRef{ID: "b", MType: models.Gauge}, now)
+	assert.False(t, ok)
+	_, ok = c.get(ref, now)
+	assert.True(t, ok)
+
+	c.invalidate("a")
+	_, ok = c.get(ref, now)
+	assert.False(t, ok)
+
+	hits, misses := c.hits.Load(), c.misses.Load()
+	assert.Equal(t, int64(4), hits)
+	assert.Equal(t, int64(5), misses)
+
+	c.put(c.generation(), m, now)
+	c.setEnabled(false)
+	_, ok = c.get(ref, now)
+	assert.False(t, ok)
+}
@@ -0,0 +1,23 @@
+package repository
+
+import (
+	"cmp"
+	models "metricapp/internal/model"
+)
+
+// ListOptions - фильтр и страница для листинга метрик.
+// Метрики упорядочены по имени, а при совпадении имен - по типу.
+type ListOptions struct {
+	// Тип метрики, "" - любой
+	Type   string
+	Prefix string
+	// Курсор: отдаются метрики строго после After, пустой - с начала
+	After models.MetricRef
+	// Размер страницы, 0 - без ограничения
+	Limit int
+}
+
+// compareRefs задает порядок листинга
+func compareRefs(a, b models.MetricRef) int {
+	return cmp.Or(cmp.Compare(a.ID, b.ID), cmp.Compare(a.MType, b.MType))
+}
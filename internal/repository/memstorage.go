@@ -3,30 +3,52 @@ package repository
 import (
 	"errors"
 	"fmt"
+	"iter"
+	"maps"
+	"math"
 	models "metricapp/internal/model"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type MemStorage struct {
-	storage  map[string]float64
-	counters map[string]int64
-	counter  atomic.Int64
-	mu       sync.RWMutex
+	storage    map[string]float64
+	counters   map[string]int64
+	histograms map[string]*models.HistogramData
+	summaries  map[string]*models.SummaryData
+	sets       map[string]*models.HLL
+	// История значений счетчиков для rate и increase
+	samples map[string][]sample
+	// Время последнего обновления метрики, ключ - updatedKey(mType, id)
+	updated map[string]time.Time
+	counter atomic.Int64
+	mu      sync.RWMutex
 }
 
 func NewMemStorage() MemStorage {
 	return MemStorage{
-		storage:  make(map[string]float64),
-		counters: make(map[string]int64),
+		storage:    make(map[string]float64),
+		counters:   make(map[string]int64),
+		histograms: make(map[string]*models.HistogramData),
+		summaries:  make(map[string]*models.SummaryData),
+		sets:       make(map[string]*models.HLL),
+		samples:    make(map[string][]sample),
+		updated:    make(map[string]time.Time),
 	}
 }
 
+// Имена метрик разных типов не пересекаются, поэтому в ключе есть тип
+func updatedKey(mType string, id string) string {
+	return mType + "/" + id
+}
+
 var (
-	ErrMetricIsRequired    = errors.New("metric name is required")
-	ErrUnknownMetricType   = errors.New("unknown metric type")
+	ErrMetricIsRequired    = models.ErrEmptyID
+	ErrUnknownMetricType   = models.ErrUnknownType
 	ErrInvalidGaugeValue   = errors.New("failed to parse gauge value")
 	ErrInvalidCounterValue = errors.New("failed to parse counter value")
 
@@ -42,6 +64,9 @@ func (ms *MemStorage) ProcessMetric(metric struct {
 	if metric.ID == "" {
 		return ErrMetricIsRequired
 	}
+	if len(metric.ID) > models.MaxIDLength {
+		return models.ErrIDTooLong
+	}
 
 	switch metric.Type {
 	case models.Gauge:
@@ -58,6 +83,12 @@ func (ms *MemStorage) ProcessMetric(metric struct {
 		case float64:
 			value := metric.Value.(float64)
 			v = value
+		default:
+			return models.ErrMissingValue
+		}
+
+		if err := models.ValidateGauge(v); err != nil {
+			return err
 		}
 
 		ms.SetField(metric.ID, v)
@@ -69,15 +100,20 @@ func (ms *MemStorage) ProcessMetric(metric struct {
 			value := metric.Value.(string)
 			parsedValue, err := strconv.ParseInt(value, 10, 64)
 			if err != nil {
-				return ErrInvalidGaugeValue
+				return ErrInvalidCounterValue
 			}
 			v = parsedValue
 		case float64:
 			value := metric.Value.(float64)
+			if value != math.Trunc(value) || value >= math.MaxInt64 || value < math.MinInt64 {
+				return ErrInvalidCounterValue
+			}
 			v = int64(value)
+		default:
+			return models.ErrMissingDelta
 		}
 
-		ms.IncrementCounter(struct {
+		return ms.IncrementCounter(struct {
 			Name  string
 			Delta int64
 		}{
@@ -85,31 +121,191 @@ func (ms *MemStorage) ProcessMetric(metric struct {
 			Delta: v,
 		})
 
+	case models.Histogram, models.Summary:
+		var v float64
+
+		switch value := metric.Value.(type) {
+		case string:
+			parsedValue, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return ErrInvalidGaugeValue
+			}
+			v = parsedValue
+		case float64:
+			v = value
+		default:
+			return models.ErrMissingValue
+		}
+
+		return ms.Observe(metric.Type, metric.ID, v)
+
+	case models.Set:
+		// Одиночное обновление добавляет в множество один элемент
+		element, ok := metric.Value.(string)
+		if !ok || element == "" {
+			return fmt.Errorf("%w: element is required", models.ErrInvalidSet)
+		}
+
+		return ms.ProcessMultyMetrics([]models.Metrics{{
+			ID:    metric.ID,
+			MType: models.Set,
+			Set:   &models.SetData{Elements: []string{element}},
+		}})
+
 	default:
-		return fmt.Errorf("unknown metric type: %s", metric.Type)
+		return fmt.Errorf("%w: %s", ErrUnknownMetricType, metric.Type)
 	}
 
 	return nil
 }
 
-func (ms *MemStorage) ProcessMultyMetrics(metrics []models.Metrics) {
+// Observe добавляет одно наблюдение в гистограмму или summary.
+// Гистограмма должна уже существовать: границы корзин задает клиент при первой отправке.
+// Summary создается с точностью models.DefaultAlpha.
+func (ms *MemStorage) Observe(mType string, name string, v float64) error {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 
+	switch mType {
+	case models.Histogram:
+		h, ok := ms.histograms[name]
+		if !ok {
+			return fmt.Errorf("%w: buckets must be sent before single observations", models.ErrInvalidHistogram)
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("%w: value must be finite", models.ErrInvalidHistogram)
+		}
+		h.Observe(v)
+	case models.Summary:
+		sum, ok := ms.summaries[name]
+		if !ok {
+			sum = models.NewSummary(models.DefaultAlpha)
+		}
+		if err := sum.Observe(v); err != nil {
+			return err
+		}
+		ms.summaries[name] = sum
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownMetricType, mType)
+	}
+	ms.updated[updatedKey(mType, name)] = time.Now()
+
+	return nil
+}
+
+// ProcessMultyMetrics применяет пакет метрик атомарно: если хотя бы одна метрика
+// невалидна или переполняет счетчик, хранилище не изменяется и возвращается models.BatchError
+func (ms *MemStorage) ProcessMultyMetrics(metrics []models.Metrics) error {
+	if err := models.ValidateBatch(metrics); err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// Считаем итоговые значения счетчиков и распределений заранее, чтобы не применять пакет частично
+	var (
+		pending    = make(map[string]int64)
+		histograms = make(map[string]*models.HistogramData)
+		summaries  = make(map[string]*models.SummaryData)
+		sets       = make(map[string]*models.HLL)
+		errs       models.BatchError
+	)
+	for i, m := range metrics {
+		var err error
+
+		switch m.MType {
+		case models.Counter:
+			cur, ok := pending[m.ID]
+			if !ok {
+				cur = ms.counters[m.ID]
+			}
+
+			var next int64
+			next, err = models.AddDelta(cur, *m.Delta)
+			if err == nil {
+				pending[m.ID] = next
+			}
+		case models.Histogram:
+			h, ok := histograms[m.ID]
+			if !ok {
+				h = ms.histograms[m.ID]
+			}
+			if h == nil {
+				histograms[m.ID] = m.Histogram.Clone()
+				break
+			}
+			h = h.Clone()
+			if err = h.Merge(m.Histogram); err == nil {
+				histograms[m.ID] = h
+			}
+		case models.Summary:
+			sum, ok := summaries[m.ID]
+			if !ok {
+				sum = ms.summaries[m.ID]
+			}
+			if sum == nil {
+				summaries[m.ID] = m.Summary.Clone()
+				break
+			}
+			sum = sum.Clone()
+			if err = sum.Merge(m.Summary); err == nil {
+				summaries[m.ID] = sum
+			}
+		case models.Set:
+			var delta *models.HLL
+			if delta, err = m.Set.HLL(); err != nil {
+				break
+			}
+
+			set, ok := sets[m.ID]
+			if !ok {
+				set = ms.sets[m.ID]
+			}
+			if set == nil {
+				sets[m.ID] = delta
+				break
+			}
+			set = set.Clone()
+			if err = set.Merge(delta); err == nil {
+				sets[m.ID] = set
+			}
+		}
+
+		if err != nil {
+			errs = append(errs, models.ItemError{Index: i, ID: m.ID, Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	now := time.Now()
 	for _, m := range metrics {
 		switch m.MType {
 		case models.Gauge:
 			ms.storage[m.ID] = *m.Value
 		case models.Counter:
-			ms.counters[m.ID] += *m.Delta
+			ms.counters[m.ID] = pending[m.ID]
+			ms.samples[m.ID] = record(ms.samples[m.ID], now, pending[m.ID])
+		case models.Histogram:
+			ms.histograms[m.ID] = histograms[m.ID]
+		case models.Summary:
+			ms.summaries[m.ID] = summaries[m.ID]
+		case models.Set:
+			ms.sets[m.ID] = sets[m.ID]
 		}
+		ms.updated[updatedKey(m.MType, m.ID)] = now
 	}
+
+	return nil
 }
 
 func (ms *MemStorage) SetField(key string, value float64) {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 	ms.storage[key] = value
+	ms.updated[updatedKey(models.Gauge, key)] = time.Now()
 }
 
 func (ms *MemStorage) GetFields() map[string]float64 {
@@ -124,23 +320,210 @@ func (ms *MemStorage) GetFields() map[string]float64 {
 	return newMap
 }
 
+// GetAllMetrics возвращает все метрики, кроме устаревших по TTL
 func (ms *MemStorage) GetAllMetrics() []models.Metrics {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 
 	metrics := make([]models.Metrics, 0)
+	now := time.Now()
 
 	for id, g := range ms.storage {
+		if expired(ms.updated[updatedKey(models.Gauge, id)], now) {
+			continue
+		}
 		metrics = append(metrics, models.ComposeMetrics(id, models.Gauge, g, 0))
 	}
 
 	for id, c := range ms.counters {
+		if expired(ms.updated[updatedKey(models.Counter, id)], now) {
+			continue
+		}
 		metrics = append(metrics, models.ComposeMetrics(id, models.Counter, 0, c))
 	}
 
+	for id, h := range ms.histograms {
+		if expired(ms.updated[updatedKey(models.Histogram, id)], now) {
+			continue
+		}
+		metrics = append(metrics, models.Metrics{ID: id, MType: models.Histogram, Histogram: h.Clone()})
+	}
+
+	for id, sum := range ms.summaries {
+		if expired(ms.updated[updatedKey(models.Summary, id)], now) {
+			continue
+		}
+		metrics = append(metrics, models.Metrics{ID: id, MType: models.Summary, Summary: sum.Clone()})
+	}
+
+	for id, set := range ms.sets {
+		if expired(ms.updated[updatedKey(models.Set, id)], now) {
+			continue
+		}
+		metrics = append(metrics, setMetric(id, set))
+	}
+
+	return metrics
+}
+
+// SelectPrefix возвращает неустаревшие метрики, имена которых начинаются с prefix
+func (ms *MemStorage) SelectPrefix(prefix string) []models.Metrics {
+	all := ms.GetAllMetrics()
+
+	metrics := all[:0]
+	for _, m := range all {
+		if strings.HasPrefix(m.ID, prefix) {
+			metrics = append(metrics, m)
+		}
+	}
+
+	return metrics
+}
+
+// Get возвращает метрику любого типа. Распределения отдаются копией.
+func (ms *MemStorage) Get(mType string, name string) (models.Metrics, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	return ms.get(mType, name)
+}
+
+// GetMany возвращает метрики из refs за один проход под блокировкой на чтение.
+// Отсутствующие и устаревшие метрики пропускаются. При window > 0 для счетчиков
+// заполняются increase и rate.
+func (ms *MemStorage) GetMany(refs []models.MetricRef, window time.Duration, now time.Time) []models.Metrics {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	metrics := make([]models.Metrics, 0, len(refs))
+	for _, ref := range refs {
+		if expired(ms.updated[updatedKey(ref.MType, ref.ID)], now) {
+			continue
+		}
+
+		m, err := ms.get(ref.MType, ref.ID)
+		if err != nil {
+			continue
+		}
+		metrics = append(metrics, ms.withRate(m, window, now))
+	}
+
+	return metrics
+}
+
+// Select возвращает метрики типа mType ("" - любого), имена которых начинаются с prefix,
+// по возрастанию имени. Устаревшие метрики пропускаются, rate - как в GetMany.
+func (ms *MemStorage) Select(mType string, prefix string, window time.Duration, now time.Time) []models.Metrics {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	return ms.list(ListOptions{Type: mType, Prefix: prefix}, window, now)
+}
+
+// List возвращает страницу метрик по возрастанию имени и типа
+func (ms *MemStorage) List(opts ListOptions, now time.Time) []models.Metrics {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	return ms.list(opts, 0, now)
+}
+
+// list - List без блокировки
+func (ms *MemStorage) list(opts ListOptions, window time.Duration, now time.Time) []models.Metrics {
+	var refs []models.MetricRef
+	collect := func(t string, ids iter.Seq[string]) {
+		if opts.Type != "" && opts.Type != t {
+			return
+		}
+		for id := range ids {
+			ref := models.MetricRef{ID: id, MType: t}
+			if strings.HasPrefix(id, opts.Prefix) && compareRefs(ref, opts.After) > 0 &&
+				!expired(ms.updated[updatedKey(t, id)], now) {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	collect(models.Gauge, maps.Keys(ms.storage))
+	collect(models.Counter, maps.Keys(ms.counters))
+	collect(models.Histogram, maps.Keys(ms.histograms))
+	collect(models.Summary, maps.Keys(ms.summaries))
+	collect(models.Set, maps.Keys(ms.sets))
+
+	slices.SortFunc(refs, compareRefs)
+	if opts.Limit > 0 && len(refs) > opts.Limit {
+		refs = refs[:opts.Limit]
+	}
+
+	metrics := make([]models.Metrics, 0, len(refs))
+	for _, ref := range refs {
+		m, _ := ms.get(ref.MType, ref.ID)
+		metrics = append(metrics, ms.withRate(m, window, now))
+	}
+
 	return metrics
 }
 
+// withRate дописывает к счетчику increase и rate, вызывается под блокировкой
+func (ms *MemStorage) withRate(m models.Metrics, window time.Duration, now time.Time) models.Metrics {
+	if m.MType != models.Counter || window <= 0 {
+		return m
+	}
+
+	if r, ok := rateOver(ms.samples[m.ID], *m.Delta, now, window); ok {
+		m.Increase = &r.Increase
+		m.Rate = &r.PerSec
+	}
+
+	return m
+}
+
+// get - Get без блокировки
+func (ms *MemStorage) get(mType string, name string) (models.Metrics, error) {
+	m := models.Metrics{ID: name, MType: mType}
+	switch mType {
+	case models.Gauge:
+		v, ok := ms.storage[name]
+		if !ok {
+			return m, ErrUnknownMetric
+		}
+		m.Value = &v
+	case models.Counter:
+		d, ok := ms.counters[name]
+		if !ok {
+			return m, ErrUnknownCounter
+		}
+		m.Delta = &d
+	case models.Histogram:
+		h, ok := ms.histograms[name]
+		if !ok {
+			return m, ErrUnknownMetric
+		}
+		m.Histogram = h.Clone()
+	case models.Summary:
+		sum, ok := ms.summaries[name]
+		if !ok {
+			return m, ErrUnknownMetric
+		}
+		m.Summary = sum.Clone()
+	case models.Set:
+		set, ok := ms.sets[name]
+		if !ok {
+			return m, ErrUnknownMetric
+		}
+		m = setMetric(name, set)
+	default:
+		return m, ErrUnknownMetric
+	}
+
+	return m, nil
+}
+
+// setMetric упаковывает скетч множества в метрику, как она хранится в файле и отдается клиенту
+func setMetric(id string, set *models.HLL) models.Metrics {
+	sketch, _ := set.MarshalBinary()
+	return models.Metrics{ID: id, MType: models.Set, Set: &models.SetData{Sketch: sketch}}
+}
+
 func (ms *MemStorage) ProcessGetField(mName string, mType string) ([]byte, any, error) {
 	switch mType {
 	case models.Gauge:
@@ -149,8 +532,7 @@ func (ms *MemStorage) ProcessGetField(mName string, mType string) ([]byte, any,
 			return nil, nil, ErrUnknownMetric
 		}
 
-		s := strconv.FormatFloat(v, 'f', 3, 64)
-		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+		s := models.FormatValue(models.Metrics{MType: mType, Value: &v})
 		return []byte(s), v, nil
 	case models.Counter:
 		counter, ok := ms.GetCounter(mName)
@@ -158,11 +540,19 @@ func (ms *MemStorage) ProcessGetField(mName string, mType string) ([]byte, any,
 			return nil, nil, ErrUnknownCounter
 		}
 
-		s := strconv.Itoa(int(counter))
+		s := models.FormatValue(models.Metrics{MType: mType, Delta: &counter})
 		return []byte(s), counter, nil
+	case models.Histogram, models.Summary, models.Set:
+		m, err := ms.Get(mType, mName)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return []byte(models.FormatValue(m)), m, nil
 	}
 
-	return nil, nil, fmt.Errorf("unknown error")
+	// Метрики неизвестного типа в хранилище нет
+	return nil, nil, ErrUnknownMetric
 }
 
 func (ms *MemStorage) GetField(name string) (float64, bool) {
@@ -176,16 +566,26 @@ func (ms *MemStorage) GetField(name string) (float64, bool) {
 func (ms *MemStorage) IncrementCounter(n ...struct {
 	Name  string
 	Delta int64
-}) {
+}) error {
 	if len(n) == 0 {
-		return
+		return nil
 	}
 
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 	key := n[0].Name
 	delta := n[0].Delta
-	ms.counters[n[0].Name] = ms.counters[key] + delta
+
+	next, err := models.AddDelta(ms.counters[key], delta)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	ms.counters[key] = next
+	ms.updated[updatedKey(models.Counter, key)] = now
+	ms.samples[key] = record(ms.samples[key], now, next)
+
+	return nil
 }
 
 func (ms *MemStorage) GetCounter(name string) (counter int64, ok bool) {
@@ -195,3 +595,174 @@ func (ms *MemStorage) GetCounter(name string) (counter int64, ok bool) {
 	counter, ok = ms.counters[name]
 	return
 }
+
+// CounterRate возвращает прирост и скорость счетчика за окно window.
+// ok=false, если истории для счетчика нет.
+func (ms *MemStorage) CounterRate(name string, window time.Duration, now time.Time) (Rate, bool) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	cur, ok := ms.counters[name]
+	if !ok {
+		return Rate{}, false
+	}
+
+	return rateOver(ms.samples[name], cur, now, window)
+}
+
+// Delete удаляет метрику заданного типа
+func (ms *MemStorage) Delete(mType string, name string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	switch mType {
+	case models.Gauge:
+		if _, ok := ms.storage[name]; !ok {
+			return ErrUnknownMetric
+		}
+		delete(ms.storage, name)
+		delete(ms.updated, updatedKey(mType, name))
+	case models.Counter:
+		if _, ok := ms.counters[name]; !ok {
+			return ErrUnknownCounter
+		}
+		delete(ms.counters, name)
+		delete(ms.samples, name)
+		delete(ms.updated, updatedKey(mType, name))
+	case models.Histogram:
+		if _, ok := ms.histograms[name]; !ok {
+			return ErrUnknownMetric
+		}
+		delete(ms.histograms, name)
+		delete(ms.updated, updatedKey(mType, name))
+	case models.Summary:
+		if _, ok := ms.summaries[name]; !ok {
+			return ErrUnknownMetric
+		}
+		delete(ms.summaries, name)
+		delete(ms.updated, updatedKey(mType, name))
+	case models.Set:
+		if _, ok := ms.sets[name]; !ok {
+			return ErrUnknownMetric
+		}
+		delete(ms.sets, name)
+		delete(ms.updated, updatedKey(mType, name))
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownMetricType, mType)
+	}
+
+	return nil
+}
+
+// ResetCounter обнуляет существующий счетчик
+func (ms *MemStorage) ResetCounter(name string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.counters[name]; !ok {
+		return ErrUnknownCounter
+	}
+	// История до сброса не годится для rate, начинаем ее заново
+	now := time.Now()
+	ms.counters[name] = 0
+	ms.updated[updatedKey(models.Counter, name)] = now
+	ms.samples[name] = record(nil, now, 0)
+
+	return nil
+}
+
+// DeletePrefix удаляет все метрики, имена которых начинаются с prefix, и возвращает их количество
+func (ms *MemStorage) DeletePrefix(prefix string) int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var n int
+	for id := range ms.storage {
+		if strings.HasPrefix(id, prefix) {
+			delete(ms.storage, id)
+			delete(ms.updated, updatedKey(models.Gauge, id))
+			n++
+		}
+	}
+	for id := range ms.counters {
+		if strings.HasPrefix(id, prefix) {
+			delete(ms.counters, id)
+			delete(ms.samples, id)
+			delete(ms.updated, updatedKey(models.Counter, id))
+			n++
+		}
+	}
+	for id := range ms.histograms {
+		if strings.HasPrefix(id, prefix) {
+			delete(ms.histograms, id)
+			delete(ms.updated, updatedKey(models.Histogram, id))
+			n++
+		}
+	}
+	for id := range ms.summaries {
+		if strings.HasPrefix(id, prefix) {
+			delete(ms.summaries, id)
+			delete(ms.updated, updatedKey(models.Summary, id))
+			n++
+		}
+	}
+	for id := range ms.sets {
+		if strings.HasPrefix(id, prefix) {
+			delete(ms.sets, id)
+			delete(ms.updated, updatedKey(models.Set, id))
+			n++
+		}
+	}
+
+	return n
+}
+
+// Expire удаляет метрики, которые не обновлялись дольше TTL, и возвращает их количество
+func (ms *MemStorage) Expire(now time.Time) int {
+	if TTL() <= 0 {
+		return 0
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var n int
+	for id := range ms.storage {
+		if expired(ms.updated[updatedKey(models.Gauge, id)], now) {
+			delete(ms.storage, id)
+			delete(ms.updated, updatedKey(models.Gauge, id))
+			n++
+		}
+	}
+	for id := range ms.counters {
+		if expired(ms.updated[updatedKey(models.Counter, id)], now) {
+			delete(ms.counters, id)
+			delete(ms.samples, id)
+			delete(ms.updated, updatedKey(models.Counter, id))
+			n++
+		}
+	}
+	for id := range ms.histograms {
+		if expired(ms.updated[updatedKey(models.Histogram, id)], now) {
+			delete(ms.histograms, id)
+			delete(ms.updated, updatedKey(models.Histogram, id))
+			n++
+		}
+	}
+	for id := range ms.summaries {
+		if expired(ms.updated[updatedKey(models.Summary, id)], now) {
+			delete(ms.summaries, id)
+			delete(ms.updated, updatedKey(models.Summary, id))
+			n++
+		}
+	}
+	for id := range ms.sets {
+		if expired(ms.updated[updatedKey(models.Set, id)], now) {
+			delete(ms.sets, id)
+			delete(ms.updated, updatedKey(models.Set, id))
+			n++
+		}
+	}
+
+	return n
+}
@@ -1,8 +1,13 @@
 package repository
 
 import (
+	"fmt"
+	"math"
 	"metricapp/internal/logger"
+	models "metricapp/internal/model"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -34,3 +39,270 @@ func TestMemStorage_IncrementCounter(t *testing.T) {
 
 	assert.Equal(t, inc, counter)
 }
+
+func TestMemStorage_ProcessMultyMetrics(t *testing.T) {
+	logger.InitLogger()
+	storage := NewMemStorage()
+
+	var (
+		delta int64 = math.MaxInt64
+		one   int64 = 1
+		value       = 1.5
+	)
+	require.NoError(t, storage.ProcessMultyMetrics([]models.Metrics{
+		{ID: "Big", MType: models.Counter, Delta: &delta},
+	}))
+
+	err := storage.ProcessMultyMetrics([]models.Metrics{
+		{ID: "Gauge", MType: models.Gauge, Value: &value},
+		{ID: "NoValue", MType: models.Gauge},
+		{ID: "", MType: models.Counter, Delta: &one},
+	})
+	var batchErr models.BatchError
+	require.ErrorAs(t, err, &batchErr)
+	require.Len(t, batchErr, 2)
+	assert.Equal(t, 1, batchErr[0].Index)
+	assert.ErrorIs(t, batchErr[0], models.ErrMissingValue)
+	assert.ErrorIs(t, batchErr[1], models.ErrEmptyID)
+
+	err = storage.ProcessMultyMetrics([]models.Metrics{
+		{ID: "Gauge", MType: models.Gauge, Value: &value},
+		{ID: "Big", MType: models.Counter, Delta: &one},
+	})
+	assert.ErrorIs(t, err, models.ErrCounterOverflow)
+
+	// Пакет с ошибкой не должен применяться частично
+	_, ok := storage.GetField("Gauge")
+	assert.False(t, ok)
+	counter, _ := storage.GetCounter("Big")
+	assert.Equal(t, delta, counter)
+}
+
+func TestMemStorage_Delete(t *testing.T) {
+	storage := NewMemStorage()
+	storage.SetField("app.alloc", 1)
+	storage.SetField("other", 1)
+	require.NoError(t, storage.IncrementCounter(struct {
+		Name  string
+		Delta int64
+	}{Name: "app.polls", Delta: 5}))
+
+	assert.ErrorIs(t, storage.Delete(models.Gauge, "missing"), ErrUnknownMetric)
+	assert.ErrorIs(t, storage.ResetCounter("missing"), ErrUnknownCounter)
+
+	require.NoError(t, storage.ResetCounter("app.polls"))
+	counter, ok := storage.GetCounter("app.polls")
+	assert.True(t, ok)
+	assert.Zero(t, counter)
+
+	assert.Equal(t, 2, storage.DeletePrefix("app."))
+	assert.Len(t, storage.GetAllMetrics(), 1)
+
+	require.NoError(t, storage.Delete(models.Gauge, "other"))
+	assert.Empty(t, storage.GetAllMetrics())
+}
+
+func TestMemStorage_GetMany(t *testing.T) {
+	storage := NewMemStorage()
+	storage.SetField("app.heap", 2)
+	storage.SetField("app.alloc", 1)
+	storage.SetField("other", 3)
+	require.NoError(t, storage.IncrementCounter(struct {
+		Name  string
+		Delta int64
+	}{Name: "app.polls", Delta: 5}))
+
+	metrics := storage.GetMany([]models.MetricRef{
+		{ID: "app.polls", MType: models.Counter},
+		{ID: "missing", MType: models.Gauge},
+		{ID: "other", MType: models.Counter},
+		{ID: "other", MType: models.Gauge},
+	}, 0, time.Now())
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "app.polls", metrics[0].ID)
+	assert.Equal(t, int64(5), *metrics[0].Delta)
+	assert.Equal(t, 3.0, *metrics[1].Value)
+
+	var ids []string
+	for _, m := range storage.Select("", "app.", 0, time.Now()) {
+		ids = append(ids, m.ID)
+	}
+	assert.Equal(t, []string{"app.alloc", "app.heap", "app.polls"}, ids)
+	assert.Len(t, storage.Select(models.Counter, "", 0, time.Now()), 1)
+}
+
+func TestMemStorage_Expire(t *testing.T) {
+	SetTTL(time.Minute)
+	defer SetTTL(0)
+
+	storage := NewMemStorage()
+	storage.SetField("stale", 1)
+	require.NoError(t, storage.IncrementCounter(struct {
+		Name  string
+		Delta int64
+	}{Name: "stale", Delta: 1}))
+
+	// Пока TTL не истек, метрики на месте
+	assert.Zero(t, storage.Expire(time.Now()))
+	assert.Len(t, storage.GetAllMetrics(), 2)
+
+	assert.Equal(t, 2, storage.Expire(time.Now().Add(2*time.Minute)))
+	assert.Empty(t, storage.GetAllMetrics())
+	_, ok := storage.GetField("stale")
+	assert.False(t, ok)
+}
+
+func TestMemStorage_Distributions(t *testing.T) {
+	storage := NewMemStorage()
+
+	// Одиночное наблюдение в гистограмму без границ корзин не принимается
+	assert.ErrorIs(t, storage.Observe(models.Histogram, "latency", 1), models.ErrInvalidHistogram)
+
+	h := models.NewHistogram(1, 2, 4)
+	h.Observe(0.5)
+	h.Observe(3)
+	require.NoError(t, storage.ProcessMultyMetrics([]models.Metrics{
+		{ID: "latency", MType: models.Histogram, Histogram: h},
+	}))
+	require.NoError(t, storage.Observe(models.Histogram, "latency", 10))
+
+	// Приращения складываются, как у счетчика
+	require.NoError(t, storage.ProcessMultyMetrics([]models.Metrics{
+		{ID: "latency", MType: models.Histogram, Histogram: h},
+	}))
+	m, err := storage.Get(models.Histogram, "latency")
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{2, 0, 2, 1}, m.Histogram.Counts)
+	assert.Equal(t, uint64(5), m.Histogram.Count)
+
+	// Пакет с другими границами отклоняется целиком
+	err = storage.ProcessMultyMetrics([]models.Metrics{
+		{ID: "latency", MType: models.Histogram, Histogram: models.NewHistogram(1, 2)},
+	})
+	assert.ErrorIs(t, err, models.ErrBucketsMismatch)
+
+	sum := models.NewSummary(models.DefaultAlpha)
+	for i := 1; i <= 50; i++ {
+		require.NoError(t, sum.Observe(float64(i)))
+	}
+	require.NoError(t, storage.ProcessMultyMetrics([]models.Metrics{
+		{ID: "size", MType: models.Summary, Summary: sum},
+	}))
+	for i := 51; i <= 100; i++ {
+		require.NoError(t, storage.Observe(models.Summary, "size", float64(i)))
+	}
+
+	m, err = storage.Get(models.Summary, "size")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(100), m.Summary.Count)
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		v, err := m.Quantile(q)
+		require.NoError(t, err)
+		exact := math.Floor(q*99) + 1
+		assert.InEpsilon(t, exact, v, models.DefaultAlpha*1.01, "q=%v", q)
+	}
+
+	assert.ErrorIs(t, storage.ProcessMultyMetrics([]models.Metrics{
+		{ID: "size", MType: models.Summary, Summary: models.NewSummary(0.05)},
+	}), models.ErrAlphaMismatch)
+
+	assert.Len(t, storage.GetAllMetrics(), 2)
+	assert.Equal(t, 2, storage.DeletePrefix(""))
+}
+
+func TestMemStorage_Set(t *testing.T) {
+	storage := NewMemStorage()
+
+	// Один агент присылает элементы, другой - готовый скетч с частично теми же элементами
+	elements := make([]string, 0, 1000)
+	for i := range 1000 {
+		elements = append(elements, fmt.Sprintf("user-%d", i))
+	}
+	require.NoError(t, storage.ProcessMultyMetrics([]models.Metrics{
+		{ID: "users", MType: models.Set, Set: &models.SetData{Elements: elements}},
+	}))
+
+	h := models.NewHLL(models.DefaultPrecision)
+	for i := 500; i < 2000; i++ {
+		h.Add(fmt.Sprintf("user-%d", i))
+	}
+	sketch, _ := h.MarshalBinary()
+	require.NoError(t, storage.ProcessMultyMetrics([]models.Metrics{
+		{ID: "users", MType: models.Set, Set: &models.SetData{Sketch: sketch}},
+	}))
+
+	// Повторное добавление элемента оценку не меняет
+	require.NoError(t, storage.ProcessMetric(struct {
+		ID    string `json:"id"`
+		Type  string `json:"type"`
+		Value any    `json:"value"`
+	}{ID: "users", Type: models.Set, Value: "user-1"}))
+
+	m, err := storage.Get(models.Set, "users")
+	require.NoError(t, err)
+	assert.InEpsilon(t, 2000, m.Set.Estimate(), 0.03)
+	assert.Equal(t, models.FormatValue(m), strconv.FormatUint(m.Set.Estimate(), 10))
+
+	assert.ErrorIs(t, storage.ProcessMultyMetrics([]models.Metrics{
+		{ID: "users", MType: models.Set, Set: &models.SetData{Sketch: []byte{14, 1}}},
+	}), models.ErrInvalidSet)
+
+	other, _ := models.NewHLL(10).MarshalBinary()
+	assert.ErrorIs(t, storage.ProcessMultyMetrics([]models.Metrics{
+		{ID: "users", MType: models.Set, Set: &models.SetData{Sketch: other}},
+	}), models.ErrPrecisionMismatch)
+}
+
+func TestCounterRate(t *testing.T) {
+	SetCounterHistory(10*time.Minute, time.Minute)
+	defer SetCounterHistory(0, 0)
+
+	// Точки раз в 5 секунд, счетчик растет на 10 за точку
+	start := time.Now()
+	var samples []sample
+	for i := range 200 {
+		samples = record(samples, start.Add(time.Duration(i)*5*time.Second), int64(i*10))
+	}
+	now := start.Add(199 * 5 * time.Second)
+
+	// История обрезана, но начало окна во всю историю сохранено
+	assert.LessOrEqual(t, len(samples), maxSamples+1)
+	assert.False(t, samples[0].at.After(now.Add(-10*time.Minute)))
+
+	r, ok := rateOver(samples, 1990, now, time.Minute)
+	require.True(t, ok)
+	assert.Equal(t, int64(120), r.Increase)
+	assert.InDelta(t, 2, r.PerSec, 1e-9)
+
+	// Счетчик моложе окна - прирост с первой точки
+	r, ok = rateOver(samples[len(samples)-2:], 1990, now, 10*time.Minute)
+	require.True(t, ok)
+	assert.Equal(t, int64(10), r.Increase)
+
+	_, err := CounterWindow(time.Hour)
+	assert.ErrorIs(t, err, ErrWindowTooLong)
+
+	storage := NewMemStorage()
+	require.NoError(t, storage.IncrementCounter(struct {
+		Name  string
+		Delta int64
+	}{Name: "PollCount", Delta: 5}))
+	require.NoError(t, storage.IncrementCounter(struct {
+		Name  string
+		Delta int64
+	}{Name: "PollCount", Delta: 7}))
+
+	r, ok = storage.CounterRate("PollCount", time.Minute, time.Now().Add(time.Second))
+	require.True(t, ok)
+	assert.Equal(t, int64(7), r.Increase)
+	assert.Greater(t, r.PerSec, 0.0)
+
+	// После сброса история начинается заново
+	require.NoError(t, storage.ResetCounter("PollCount"))
+	r, ok = storage.CounterRate("PollCount", time.Minute, time.Now().Add(time.Second))
+	require.True(t, ok)
+	assert.Zero(t, r.Increase)
+
+	_, ok = storage.CounterRate("missing", time.Minute, time.Now())
+	assert.False(t, ok)
+}
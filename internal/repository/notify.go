@@ -0,0 +1,151 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"metricapp/internal/logger"
+	models "metricapp/internal/model"
+	"metricapp/internal/utils"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+// Канал, в который триггер на metrics отправляет id измененных метрик (миграции 6 и 7).
+// Payload - JSON-массив id, пустой payload - изменилась вся таблица.
+const changesChannel = "metrics_changed"
+
+// Настройка транзакции, при которой построчный триггер молчит: InsertBatch уведомляет сам
+const batchSetting = "metricapp.batch"
+
+// Postgres ограничивает payload 8000 байтами, оставляем запас
+const maxNotifyPayload = 7900
+
+// PID серверных процессов Postgres, обслуживающих соединения нашего пула.
+// Свои записи уже отражены в кэше, уведомления о них пропускаются.
+var ownBackends sync.Map
+
+// trackBackends запоминает PID соединений пула
+func trackBackends(cfg *pgxpool.Config) {
+	cfg.AfterConnect = func(_ context.Context, conn *pgx.Conn) error {
+		ownBackends.Store(conn.PgConn().PID(), struct{}{})
+		return nil
+	}
+	cfg.BeforeClose = func(conn *pgx.Conn) {
+		ownBackends.Delete(conn.PgConn().PID())
+	}
+}
+
+// notifyBatch отправляет id метрик пакета внутри его транзакции: слушатели получат
+// уведомление при коммите, одно на пакет, а не по одному на строку.
+// Длинный пакет делится на несколько уведомлений по ограничению на размер payload.
+func notifyBatch(ctx context.Context, tx pgx.Tx, metrics []models.Metrics) error {
+	ids := make([]string, 0, len(metrics))
+	seen := make(map[string]struct{}, len(metrics))
+	for _, m := range metrics {
+		if _, ok := seen[m.ID]; !ok {
+			seen[m.ID] = struct{}{}
+			ids = append(ids, m.ID)
+		}
+	}
+
+	for _, payload := range notifyPayloads(ids) {
+		if _, err := tx.Exec(ctx, "SELECT pg_notify($1, $2)", changesChannel, payload); err != nil {
+			return fmt.Errorf("failed to notify changes: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// notifyPayloads делит id на JSON-массивы не длиннее maxNotifyPayload.
+// Один id всегда помещается: имя не длиннее models.MaxIDLength.
+func notifyPayloads(ids []string) []string {
+	var payloads []string
+	for len(ids) > 0 {
+		n := len(ids)
+		b, _ := json.Marshal(ids[:n])
+		for len(b) > maxNotifyPayload && n > 1 {
+			n /= 2
+			b, _ = json.Marshal(ids[:n])
+		}
+		payloads = append(payloads, string(b))
+		ids = ids[n:]
+	}
+
+	return payloads
+}
+
+// Паузы между попытками переподключить слушателя
+var listenPolicy = utils.Policy{Initial: time.Second, Max: 30 * time.Second}
+
+// listen слушает metrics_changed на отдельном соединении и сбрасывает из кэша
+// метрики, измененные любой репликой. Пока соединения нет, кэш выключен.
+func (h *PsqlHandler) listen(ctx context.Context) {
+	for attempt := 0; ctx.Err() == nil; attempt++ {
+		listening, err := h.listenOnce(ctx)
+		cache.setEnabled(false)
+		if ctx.Err() != nil {
+			return
+		}
+		if listening {
+			attempt = 0
+		}
+
+		wait := listenPolicy.Delay(attempt)
+		logger.Warn("metrics_changed listener stopped, read cache disabled",
+			zap.Duration("retry_in", wait),
+			zap.Error(err),
+		)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// listenOnce слушает канал, пока соединение живо. listening - LISTEN успел выполниться.
+func (h *PsqlHandler) listenOnce(ctx context.Context) (listening bool, err error) {
+	pooled, err := h.pool.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	// Соединение с LISTEN не должно вернуться в пул
+	conn := pooled.Hijack()
+	defer func() {
+		ownBackends.Delete(conn.PgConn().PID())
+		conn.Close(context.Background())
+	}()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+changesChannel); err != nil {
+		return false, err
+	}
+	// Все, что закэшировано до LISTEN, могло устареть незаметно для нас
+	cache.setEnabled(true)
+	logger.Info("listening for metric changes, read cache enabled")
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return true, err
+		}
+
+		if _, own := ownBackends.Load(n.PID); own {
+			continue
+		}
+		var ids []string
+		if n.Payload == "" || json.Unmarshal([]byte(n.Payload), &ids) != nil {
+			cache.clear()
+			continue
+		}
+		cache.invalidate(ids...)
+	}
+}
@@ -0,0 +1,33 @@
+package repository
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifyPayloads(t *testing.T) {
+	assert.Empty(t, notifyPayloads(nil))
+	assert.Equal(t, []string{`["a","b,c"]`}, notifyPayloads([]string{"a", "b,c"}))
+
+	// Большой пакет делится на несколько уведомлений, ни один id не теряется
+	var ids []string
+	for i := range 1000 {
+		ids = append(ids, strings.Repeat("x", 50)+strconv.Itoa(i))
+	}
+	payloads := notifyPayloads(ids)
+	require.Greater(t, len(payloads), 1)
+
+	var got []string
+	for _, p := range payloads {
+		assert.LessOrEqual(t, len(p), maxNotifyPayload)
+		var part []string
+		require.NoError(t, json.Unmarshal([]byte(p), &part))
+		got = append(got, part...)
+	}
+	assert.Equal(t, ids, got)
+}
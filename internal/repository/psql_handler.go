@@ -3,9 +3,10 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"math"
 	"metricapp/internal/logger"
 	models "metricapp/internal/model"
 	"metricapp/internal/utils"
@@ -28,15 +29,28 @@ var (
 
 var (
 	ErrNoConnection = errors.New("there is no connection to db")
+	// ErrTypeConflict - имя занято метрикой другого типа. В базе имя уникально для всех типов,
+	// поэтому каждый upsert обновляет строку, только если тип совпадает.
+	ErrTypeConflict = errors.New("metric name is taken by another type")
 )
 
+// Код ошибки Postgres numeric_value_out_of_range, возникает при переполнении BIGINT
+const pgNumericOutOfRange = "22003"
+
 type PsqlHandler struct {
 	pool *pgxpool.Pool
 }
 
 func NewPsqlHandler(dsn string, mPath string) {
 	once.Do(func() {
-		pool, err := pgxpool.New(context.Background(), dsn)
+		poolCfg, err := pgxpool.ParseConfig(dsn)
+		if err != nil {
+			logger.Error("failed to connect to db", zap.Error(err))
+			return
+		}
+		trackBackends(poolCfg)
+
+		pool, err := pgxpool.NewWithConfig(context.Background(), poolCfg)
 		if err != nil {
 			logger.Error("failed to connect to db", zap.Error(err))
 			return
@@ -56,6 +70,8 @@ func NewPsqlHandler(dsn string, mPath string) {
 			logger.Error("failed to make migration", zap.Error(err))
 			return
 		}
+
+		go psqlHandler.listen(context.Background())
 	})
 }
 
@@ -80,20 +96,30 @@ func migration(dsn string, mPath string) error {
 	return nil
 }
 
-func Ping() error {
+func Ping(ctx context.Context) error {
 	if psqlHandler == nil {
 		return ErrNoConnection
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	return psqlHandler.pool.Ping(ctx)
 }
 
-func UpdateGauge(key string, value float64, opt ...transactionInfo) error {
+func UpdateGauge(ctx context.Context, key string, value float64, opt ...transactionInfo) error {
+	_, err := updateGauge(ctx, key, value, opt...)
+	return err
+}
+
+// updateGauge записывает gauge и возвращает строку в том виде, в каком она теперь лежит в базе
+func updateGauge(ctx context.Context, key string, value float64, opt ...transactionInfo) (*models.Metrics, error) {
 	if psqlHandler == nil {
-		return ErrNoConnection
+		return nil, ErrNoConnection
+	}
+
+	if err := models.ValidateGauge(value); err != nil {
+		return nil, err
 	}
 
 	query := `INSERT INTO
@@ -103,79 +129,472 @@ func UpdateGauge(key string, value float64, opt ...transactionInfo) error {
 			ON CONFLICT (id) DO
 			UPDATE
 			SET
-			value = EXCLUDED.value;`
+			value = EXCLUDED.value,
+			updated_at = now()
+			WHERE metrics.mtype = EXCLUDED.mtype
+			RETURNING ` + metricColumns
+
+	gen := cache.generation()
 
 	var (
-		rows pgconn.CommandTag
-		err  error
+		m   *models.Metrics
+		err error
 	)
 
 	if len(opt) > 0 {
 		tInfo := opt[0]
-		rows, err = tInfo.tx.Exec(
+		m, err = scanMetric(tInfo.tx.QueryRow(
 			tInfo.ctx,
 			query,
 			key, models.Gauge, value,
-		)
+		))
 	} else {
-		rows, err = psqlHandler.Exec(context.Background(),
+		m, err = psqlHandler.QueryRow(ctx,
 			query,
 			key, models.Gauge, value,
 		)
 	}
 
+	if errors.Is(err, pgx.ErrNoRows) || errors.Is(err, ErrUnknownMetric) {
+		return nil, fmt.Errorf("%w: gauge %s", ErrTypeConflict, key)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to make query: %w", err)
+		return nil, fmt.Errorf("failed to update gauge: %w", err)
 	}
+	cacheWrite(opt, gen, m)
 
-	if rows.RowsAffected() == 0 {
-		return fmt.Errorf("rows is not affected")
-	}
+	return m, nil
+}
 
-	return nil
+func IncrementCounter(ctx context.Context, key string, delta int64, opt ...transactionInfo) error {
+	_, err := incrementCounter(ctx, key, delta, opt...)
+	return err
 }
 
-func IncrementCounter(key string, delta int64, opt ...transactionInfo) error {
+// incrementCounter прибавляет delta к счетчику и возвращает строку с новым значением
+func incrementCounter(ctx context.Context, key string, delta int64, opt ...transactionInfo) (*models.Metrics, error) {
 	if psqlHandler == nil {
-		return ErrNoConnection
+		return nil, ErrNoConnection
+	}
+
+	// Приращение и точка истории пишутся одной транзакцией. Иначе при ошибке записи точки
+	// приращение уже закоммичено, клиент получает 500, повторяет запрос и счетчик растет дважды.
+	if len(opt) == 0 && CounterHistory() > 0 {
+		gen := cache.generation()
+		tx, err := psqlHandler.pool.Begin(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start transaction: %w", err)
+		}
+		defer tx.Rollback(ctx)
+
+		m, err := incrementCounter(ctx, key, delta, transactionInfo{tx: tx, ctx: ctx})
+		if err != nil {
+			return nil, err
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			return nil, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		cache.update(gen, []models.Metrics{*m}, time.Now())
+		return m, nil
 	}
 
 	const query = `INSERT INTO metrics (id, mtype, delta)
 		VALUES ($1, $2, $3)
 		ON CONFLICT (id) DO UPDATE
-		SET delta = metrics.delta + EXCLUDED.delta;`
+		SET delta = metrics.delta + EXCLUDED.delta, updated_at = now()
+		WHERE metrics.mtype = EXCLUDED.mtype
+		RETURNING ` + metricColumns
+
+	gen := cache.generation()
 
 	var (
-		rows pgconn.CommandTag
-		err  error
+		m   *models.Metrics
+		err error
 	)
 
 	if len(opt) > 0 {
 		tInfo := opt[0]
-		rows, err = tInfo.tx.Exec(tInfo.ctx, query, key, models.Counter, delta)
+		m, err = scanMetric(tInfo.tx.QueryRow(tInfo.ctx, query, key, models.Counter, delta))
 	} else {
-		rows, err = psqlHandler.Exec(context.Background(), query, key, models.Counter, delta)
+		m, err = psqlHandler.QueryRow(ctx, query, key, models.Counter, delta)
 	}
 
+	if errors.Is(err, pgx.ErrNoRows) || errors.Is(err, ErrUnknownMetric) {
+		return nil, fmt.Errorf("%w: counter %s", ErrTypeConflict, key)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to update counter: %w", err)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgNumericOutOfRange {
+			return nil, models.ErrCounterOverflow
+		}
+		return nil, fmt.Errorf("failed to update counter: %w", err)
 	}
-	if rows.RowsAffected() == 0 {
-		return fmt.Errorf("rows is not affected")
+	cacheWrite(opt, gen, m)
+
+	return m, recordSample(ctx, key, opt...)
+}
+
+// recordSample добавляет текущее значение счетчика в историю для rate и increase,
+// если с прошлой точки прошло не меньше sampleSpacing, и отбрасывает точки старше истории
+func recordSample(ctx context.Context, key string, opt ...transactionInfo) error {
+	if CounterHistory() == 0 {
+		return nil
+	}
+
+	const insert = `INSERT INTO counter_samples (id, ts, value)
+		SELECT id, now(), delta FROM metrics
+		WHERE id = $1 AND mtype = 'counter' AND NOT EXISTS (
+			SELECT 1 FROM counter_samples WHERE id = $1 AND ts > now() - make_interval(secs => $2::float8)
+		);`
+	// Самая свежая из старых точек остается началом окна во всю историю
+	const prune = `DELETE FROM counter_samples
+		WHERE id = $1 AND ts < (
+			SELECT max(ts) FROM counter_samples WHERE id = $1 AND ts <= now() - make_interval(secs => $2::float8)
+		);`
+
+	exec := psqlHandler.Exec
+	if len(opt) > 0 {
+		exec = opt[0].tx.Exec
+		ctx = opt[0].ctx
+	}
+
+	tag, err := exec(ctx, insert, key, sampleSpacing().Seconds())
+	if err != nil {
+		return fmt.Errorf("failed to record counter sample: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil
+	}
+
+	if _, err := exec(ctx, prune, key, CounterHistory().Seconds()); err != nil {
+		return fmt.Errorf("failed to prune counter samples: %w", err)
 	}
+
 	return nil
 }
 
+// CounterRate возвращает прирост и скорость счетчика за окно window.
+// ok=false, если истории для счетчика нет.
+func CounterRate(ctx context.Context, name string, window time.Duration) (Rate, bool, error) {
+	rates, err := CounterRates(ctx, []string{name}, window)
+	if err != nil {
+		return Rate{}, false, err
+	}
+
+	r, ok := rates[name]
+	return r, ok, nil
+}
+
+// CounterRates - CounterRate для нескольких счетчиков одним запросом.
+// Счетчиков без истории в результате нет.
+func CounterRates(ctx context.Context, names []string, window time.Duration) (map[string]Rate, error) {
+	if psqlHandler == nil {
+		return nil, ErrNoConnection
+	}
+
+	// Начало окна - последняя точка не позже now-window, а если счетчик моложе окна - самая ранняя
+	const query = `SELECT m.id, m.delta, s.value, EXTRACT(EPOCH FROM now() - s.ts)
+		FROM metrics m
+		JOIN LATERAL (
+			(SELECT ts, value FROM counter_samples
+				WHERE id = m.id AND ts <= now() - make_interval(secs => $2::float8)
+				ORDER BY ts DESC LIMIT 1)
+			UNION ALL
+			(SELECT ts, value FROM counter_samples WHERE id = m.id ORDER BY ts LIMIT 1)
+			LIMIT 1
+		) s ON true
+		WHERE m.mtype = 'counter' AND m.id = ANY($1)`
+
+	rows, err := psqlHandler.Query(ctx, query, names, window.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get counter rates: %w", err)
+	}
+	defer rows.Close()
+
+	rates := make(map[string]Rate, len(names))
+	for rows.Next() {
+		var (
+			id        string
+			cur, base int64
+			elapsed   float64
+		)
+		if err := rows.Scan(&id, &cur, &base, &elapsed); err != nil {
+			return nil, fmt.Errorf("failed to scan counter rate: %w", err)
+		}
+
+		r := Rate{Increase: cur - base}
+		if elapsed > 0 {
+			r.PerSec = float64(r.Increase) / elapsed
+		}
+		rates[id] = r
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read counter rates: %w", err)
+	}
+
+	return rates, nil
+}
+
+// MergeDistribution прибавляет к сохраненной гистограмме или summary приращение из metric
+func MergeDistribution(ctx context.Context, metric models.Metrics, opt ...transactionInfo) error {
+	return updateDistribution(ctx, metric.MType, metric.ID, func(stored *models.Metrics) (models.Metrics, error) {
+		if stored == nil {
+			return metric, nil
+		}
+
+		return *stored, mergeInto(*stored, metric)
+	}, opt...)
+}
+
+// ObserveDistribution добавляет одно наблюдение, как MemStorage.Observe
+func ObserveDistribution(ctx context.Context, mType string, name string, v float64) error {
+	return updateDistribution(ctx, mType, name, func(stored *models.Metrics) (models.Metrics, error) {
+		m := models.Metrics{ID: name, MType: mType}
+		if stored != nil {
+			m = *stored
+		}
+
+		switch mType {
+		case models.Histogram:
+			if m.Histogram == nil {
+				return m, fmt.Errorf("%w: buckets must be sent before single observations", models.ErrInvalidHistogram)
+			}
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return m, fmt.Errorf("%w: value must be finite", models.ErrInvalidHistogram)
+			}
+			m.Histogram.Observe(v)
+			return m, nil
+		case models.Summary:
+			if m.Summary == nil {
+				m.Summary = models.NewSummary(models.DefaultAlpha)
+			}
+			return m, m.Summary.Observe(v)
+		}
+
+		return m, fmt.Errorf("%w: %s", models.ErrUnknownType, mType)
+	})
+}
+
+// updateDistribution читает распределение под блокировкой строки, изменяет его в Go
+// и записывает обратно. stored равен nil, если метрики еще нет.
+func updateDistribution(ctx context.Context, mType string, name string, apply func(stored *models.Metrics) (models.Metrics, error), opt ...transactionInfo) error {
+	if psqlHandler == nil {
+		return ErrNoConnection
+	}
+
+	if len(opt) == 0 {
+		tx, err := psqlHandler.pool.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to start transaction: %w", err)
+		}
+		defer tx.Rollback(ctx)
+
+		if err := updateDistribution(ctx, mType, name, apply, transactionInfo{tx: tx, ctx: ctx}); err != nil {
+			return err
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		cache.invalidate(name)
+		return nil
+	}
+	tInfo := opt[0]
+
+	var data []byte
+	err := tInfo.tx.QueryRow(tInfo.ctx,
+		"SELECT data FROM metrics WHERE mtype = $1 AND id = $2 FOR UPDATE",
+		mType, name,
+	).Scan(&data)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("failed to read %s: %w", mType, err)
+	}
+
+	var stored *models.Metrics
+	if data != nil {
+		m, err := decodeDistribution(name, mType, data)
+		if err != nil {
+			return err
+		}
+		stored = &m
+	}
+
+	updated, err := apply(stored)
+	if err != nil {
+		return err
+	}
+
+	data, err = encodeDistribution(updated)
+	if err != nil {
+		return err
+	}
+
+	// Строку другого типа с тем же именем не трогаем: иначе в gauge или счетчик попадет JSON
+	// распределения, и метрика перестанет читаться
+	const query = `INSERT INTO metrics (id, mtype, data)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE
+		SET data = EXCLUDED.data, updated_at = now()
+		WHERE metrics.mtype = EXCLUDED.mtype;`
+
+	tag, err := tInfo.tx.Exec(tInfo.ctx, query, name, mType, data)
+	if err != nil {
+		return fmt.Errorf("failed to update %s: %w", mType, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %s %s", ErrTypeConflict, mType, name)
+	}
+
+	return nil
+}
+
+// MergeSet объединяет сохраненный скетч множества с элементами и скетчем из metric
+func MergeSet(ctx context.Context, metric models.Metrics, opt ...transactionInfo) error {
+	if psqlHandler == nil {
+		return ErrNoConnection
+	}
+
+	if len(opt) == 0 {
+		tx, err := psqlHandler.pool.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to start transaction: %w", err)
+		}
+		defer tx.Rollback(ctx)
+
+		if err := MergeSet(ctx, metric, transactionInfo{tx: tx, ctx: ctx}); err != nil {
+			return err
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		cache.invalidate(metric.ID)
+		return nil
+	}
+	tInfo := opt[0]
+
+	set, err := metric.Set.HLL()
+	if err != nil {
+		return err
+	}
+
+	var stored []byte
+	err = tInfo.tx.QueryRow(tInfo.ctx,
+		"SELECT sketch FROM metrics WHERE mtype = $1 AND id = $2 FOR UPDATE",
+		models.Set, metric.ID,
+	).Scan(&stored)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("failed to read set: %w", err)
+	}
+
+	if stored != nil {
+		var cur models.HLL
+		if err := cur.UnmarshalBinary(stored); err != nil {
+			return fmt.Errorf("failed to decode set: %w", err)
+		}
+		if err := cur.Merge(set); err != nil {
+			return err
+		}
+		set = &cur
+	}
+
+	sketch, _ := set.MarshalBinary()
+
+	// Как и для распределений: скетч в строке gauge или счетчика спрятал бы их значение
+	const query = `INSERT INTO metrics (id, mtype, sketch)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE
+		SET sketch = EXCLUDED.sketch, updated_at = now()
+		WHERE metrics.mtype = EXCLUDED.mtype;`
+
+	tag, err := tInfo.tx.Exec(tInfo.ctx, query, metric.ID, models.Set, sketch)
+	if err != nil {
+		return fmt.Errorf("failed to update set: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: set %s", ErrTypeConflict, metric.ID)
+	}
+
+	return nil
+}
+
+func mergeInto(dst models.Metrics, delta models.Metrics) error {
+	switch dst.MType {
+	case models.Histogram:
+		return dst.Histogram.Merge(delta.Histogram)
+	case models.Summary:
+		return dst.Summary.Merge(delta.Summary)
+	}
+
+	return fmt.Errorf("%w: %s", models.ErrUnknownType, dst.MType)
+}
+
+func encodeDistribution(m models.Metrics) ([]byte, error) {
+	var (
+		data []byte
+		err  error
+	)
+
+	switch m.MType {
+	case models.Histogram:
+		data, err = json.Marshal(m.Histogram)
+	case models.Summary:
+		data, err = json.Marshal(m.Summary.Clone())
+	default:
+		return nil, fmt.Errorf("%w: %s", models.ErrUnknownType, m.MType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %w", m.MType, err)
+	}
+
+	return data, nil
+}
+
+func decodeDistribution(id string, mType string, data []byte) (models.Metrics, error) {
+	m := models.Metrics{ID: id, MType: mType}
+
+	var err error
+	switch mType {
+	case models.Histogram:
+		m.Histogram = &models.HistogramData{}
+		err = json.Unmarshal(data, m.Histogram)
+	case models.Summary:
+		m.Summary = &models.SummaryData{}
+		err = json.Unmarshal(data, m.Summary)
+	default:
+		return m, fmt.Errorf("%w: %s", models.ErrUnknownType, mType)
+	}
+	if err != nil {
+		return m, fmt.Errorf("failed to decode %s: %w", mType, err)
+	}
+
+	return m, nil
+}
+
 type transactionInfo struct {
 	tx  pgx.Tx
 	ctx context.Context
 }
 
+// cacheWrite обновляет кэш строкой, записанной вне транзакции.
+// Внутри транзакции кэш обновляет ее владелец после коммита.
+func cacheWrite(opt []transactionInfo, gen uint64, m *models.Metrics) {
+	if len(opt) == 0 {
+		cache.update(gen, []models.Metrics{*m}, time.Now())
+	}
+}
+
 func InsertBatch(ctx context.Context, metrics []models.Metrics) error {
 	if psqlHandler == nil {
 		return ErrNoConnection
 	}
 
+	if err := models.ValidateBatch(metrics); err != nil {
+		return err
+	}
+
+	gen := cache.generation()
 	tx, err := psqlHandler.pool.Begin(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to start transaction: %w", err)
@@ -185,100 +604,465 @@ func InsertBatch(ctx context.Context, metrics []models.Metrics) error {
 		tx:  tx,
 		ctx: ctx,
 	}
+	// Построчные уведомления выключаются, пакет сообщит о себе сам перед коммитом
+	if _, err := tx.Exec(ctx, "SELECT set_config('"+batchSetting+"', 'on', true)"); err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
 
-	for _, m := range metrics {
-		var err error
+	// После коммита gauge и счетчики попадут в кэш, распределения и множества из него сбросятся
+	var (
+		written []models.Metrics
+		touched []string
+	)
+
+	for i, m := range metrics {
+		var (
+			row *models.Metrics
+			err error
+		)
 
 		switch m.MType {
 		case models.Gauge:
-			err = UpdateGauge(m.ID, *m.Value, tInfo)
+			row, err = updateGauge(ctx, m.ID, *m.Value, tInfo)
 		case models.Counter:
-			err = IncrementCounter(m.ID, *m.Delta, tInfo)
+			row, err = incrementCounter(ctx, m.ID, *m.Delta, tInfo)
+		case models.Histogram, models.Summary:
+			err = MergeDistribution(ctx, m, tInfo)
+		case models.Set:
+			err = MergeSet(ctx, m, tInfo)
+		}
+		if row != nil {
+			written = append(written, *row)
+		} else {
+			touched = append(touched, m.ID)
 		}
 
+		if errors.Is(err, models.ErrCounterOverflow) || errors.Is(err, ErrTypeConflict) || errors.Is(err, models.ErrBucketsMismatch) ||
+			errors.Is(err, models.ErrAlphaMismatch) || errors.Is(err, models.ErrPrecisionMismatch) {
+			return models.BatchError{{Index: i, ID: m.ID, Err: err}}
+		}
 		if err != nil {
+			logger.Ctx(ctx).Error("batch transaction aborted", zap.String("ID", m.ID), zap.Error(err))
 			return fmt.Errorf("transaction aborted: %w", err)
 		}
 	}
 
+	if err := notifyBatch(ctx, tx, metrics); err != nil {
+		return err
+	}
 	if err := tx.Commit(ctx); err != nil {
 		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
+	cache.update(gen, written, time.Now())
+	if len(touched) > 0 {
+		cache.invalidate(touched...)
+	}
+
 	return nil
 }
 
+// dbRetryPolicy повторяет только ошибки соединения и временные отказы Postgres,
+// отмена контекста запроса прерывает повторы сразу
+func dbRetryPolicy(ctx context.Context) utils.Policy {
+	p := utils.DefaultPolicy
+	p.Retryable = utils.PgRetryable
+	p.OnRetry = func(attempt int, err error, wait time.Duration) {
+		logger.Ctx(ctx).Warn("query failed, retrying",
+			zap.Int("attempt", attempt),
+			zap.Duration("wait", wait),
+			zap.Error(err),
+		)
+	}
+
+	return p
+}
+
 func (h *PsqlHandler) Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error) {
-	for i := 0; i <= len(utils.Delays); i++ {
-		resp, err := h.pool.Exec(ctx, sql, arguments...)
-		if err == nil {
-			return resp, nil
-		}
+	tag, err := utils.Retry(ctx, dbRetryPolicy(ctx), func(ctx context.Context) (pgconn.CommandTag, error) {
+		return h.pool.Exec(ctx, sql, arguments...)
+	})
+	if err != nil {
+		return pgconn.CommandTag{}, fmt.Errorf("failed to make query: %w", err)
+	}
+
+	return tag, nil
+}
+
+func (h *PsqlHandler) Query(ctx context.Context, sql string, arguments ...any) (pgx.Rows, error) {
+	rows, err := utils.Retry(ctx, dbRetryPolicy(ctx), func(ctx context.Context) (pgx.Rows, error) {
+		return h.pool.Query(ctx, sql, arguments...)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to make query: %w", err)
+	}
+
+	return rows, nil
+}
+
+func (h *PsqlHandler) QueryRow(ctx context.Context, sql string, arguments ...any) (*models.Metrics, error) {
+	metric, err := utils.Retry(ctx, dbRetryPolicy(ctx), func(ctx context.Context) (*models.Metrics, error) {
+		return scanMetric(h.pool.QueryRow(ctx, sql, arguments...))
+	})
+
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return &models.Metrics{}, ErrUnknownMetric
+	case err != nil:
+		logger.Ctx(ctx).Error("failed to scan", zap.Error(err))
+		return &models.Metrics{}, fmt.Errorf("failed to make query: %w", err)
+	}
+
+	return metric, nil
+}
+
+// metricColumns - столбцы, которые разбирает scanMetric
+const metricColumns = "id, mtype, delta, value, hash, data, sketch"
+
+// scanMetric разбирает строку metrics с полями metricColumns
+func scanMetric(row pgx.Row) (*models.Metrics, error) {
+	var (
+		id     string
+		t      string
+		value  *float64
+		delta  *int64
+		hash   *string
+		data   []byte
+		sketch []byte
+	)
+
+	if err := row.Scan(&id, &t, &delta, &value, &hash, &data, &sketch); err != nil {
+		return nil, err
+	}
+
+	if sketch != nil {
+		return &models.Metrics{ID: id, MType: t, Set: &models.SetData{Sketch: sketch}}, nil
+	}
+
+	if data != nil {
+		m, err := decodeDistribution(id, t, data)
+		return &m, err
+	}
+
+	return &models.Metrics{
+		ID:    id,
+		MType: t,
+		Delta: delta,
+		Value: value,
+	}, nil
+}
+
+// QueryRow читает метрику через кэш
+func QueryRow(ctx context.Context, mtype string, mName string) (*models.Metrics, error) {
+	if psqlHandler == nil {
+		return nil, ErrNoConnection
+	}
+
+	if m, ok := cache.get(models.MetricRef{ID: mName, MType: mtype}, time.Now()); ok {
+		return &m, nil
+	}
+
+	gen := cache.generation()
+	m, err := psqlHandler.QueryRow(ctx, "SELECT "+metricColumns+" FROM metrics WHERE mtype = $1 AND id = $2", mtype, mName)
+	if err != nil {
+		return m, err
+	}
+	cache.put(gen, *m, time.Now())
+
+	return m, nil
+}
+
+// SelectPrefix возвращает неустаревшие метрики, имена которых начинаются с prefix
+func SelectPrefix(ctx context.Context, prefix string) ([]models.Metrics, error) {
+	return Select(ctx, "", prefix, 0)
+}
+
+// Select возвращает неустаревшие метрики типа mType ("" - любого), имена которых
+// начинаются с prefix, по возрастанию имени. При window > 0 для счетчиков
+// заполняются increase и rate.
+func Select(ctx context.Context, mType string, prefix string, window time.Duration) ([]models.Metrics, error) {
+	if psqlHandler == nil {
+		return nil, ErrNoConnection
+	}
+
+	metrics, err := List(ctx, ListOptions{Type: mType, Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+
+	return withRates(ctx, metrics, window)
+}
+
+// List возвращает страницу неустаревших метрик по возрастанию имени и типа
+func List(ctx context.Context, opts ListOptions) ([]models.Metrics, error) {
+	if psqlHandler == nil {
+		return nil, ErrNoConnection
+	}
+
+	// LIMIT NULL - без ограничения
+	var limit any
+	if opts.Limit > 0 {
+		limit = opts.Limit
+	}
+
+	return queryMetrics(ctx,
+		"SELECT "+metricColumns+" FROM metrics WHERE "+notExpired+
+			" AND left(id, length($2)) = $2 AND ($3 = '' OR mtype = $3) AND (id, mtype) > ($4, $5)"+
+			" ORDER BY id, mtype LIMIT $6",
+		ttlSeconds(), opts.Prefix, opts.Type, opts.After.ID, opts.After.MType, limit,
+	)
+}
+
+// GetMany возвращает метрики из refs одним запросом.
+// Отсутствующие и устаревшие метрики пропускаются, rate - как в Select.
+func GetMany(ctx context.Context, refs []models.MetricRef, window time.Duration) ([]models.Metrics, error) {
+	if psqlHandler == nil {
+		return nil, ErrNoConnection
+	}
+
+	ids := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		ids = append(ids, ref.ID)
+	}
+
+	found, err := queryMetrics(ctx,
+		"SELECT "+metricColumns+" FROM metrics WHERE "+notExpired+" AND id = ANY($2)",
+		ttlSeconds(), ids,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// id - первичный ключ, тип метрики сверяем уже в Go и сохраняем порядок запроса
+	byID := make(map[string]models.Metrics, len(found))
+	for _, m := range found {
+		byID[m.ID] = m
+	}
 
-		if i == len(utils.Delays) {
-			break
+	metrics := make([]models.Metrics, 0, len(refs))
+	for _, ref := range refs {
+		if m, ok := byID[ref.ID]; ok && m.MType == ref.MType {
+			metrics = append(metrics, m)
 		}
+	}
+
+	return withRates(ctx, metrics, window)
+}
 
-		time.Sleep(time.Duration(utils.Delays[i]) * time.Second)
+func queryMetrics(ctx context.Context, sql string, arguments ...any) ([]models.Metrics, error) {
+	rows, err := psqlHandler.Query(ctx, sql, arguments...)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return pgconn.CommandTag{}, fmt.Errorf("failed to make query after %d attempts", len(utils.Delays))
+	metrics := make([]models.Metrics, 0)
+	for rows.Next() {
+		m, err := scanMetric(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan metric: %w", err)
+		}
+		metrics = append(metrics, *m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read metrics: %w", err)
+	}
+
+	return metrics, nil
 }
 
-func (h *PsqlHandler) Query(ctx context.Context, sql string, arguments ...any) (pgx.Rows, error) {
-	for i := 0; i <= len(utils.Delays); i++ {
-		rows, err := h.pool.Query(ctx, sql, arguments...)
-		if err == nil {
-			return rows, nil
+// withRates дописывает increase и rate к счетчикам из metrics
+func withRates(ctx context.Context, metrics []models.Metrics, window time.Duration) ([]models.Metrics, error) {
+	if window <= 0 {
+		return metrics, nil
+	}
+
+	var names []string
+	for _, m := range metrics {
+		if m.MType == models.Counter {
+			names = append(names, m.ID)
 		}
+	}
+	if len(names) == 0 {
+		return metrics, nil
+	}
+
+	rates, err := CounterRates(ctx, names, window)
+	if err != nil {
+		return nil, err
+	}
 
-		if i == len(utils.Delays) {
-			break
+	for i, m := range metrics {
+		if r, ok := rates[m.ID]; ok && m.MType == models.Counter {
+			metrics[i].Increase = &r.Increase
+			metrics[i].Rate = &r.PerSec
 		}
+	}
+
+	return metrics, nil
+}
 
-		time.Sleep(time.Duration(utils.Delays[i]) * time.Second)
+// Count возвращает количество метрик в базе
+func Count(ctx context.Context) (int, error) {
+	if psqlHandler == nil {
+		return 0, ErrNoConnection
 	}
 
-	return nil, fmt.Errorf("failed to make query after %d attempts", len(utils.Delays))
+	var n int
+	if err := psqlHandler.pool.QueryRow(ctx, "SELECT count(*) FROM metrics WHERE "+notExpired, ttlSeconds()).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count metrics: %w", err)
+	}
+
+	return n, nil
 }
 
-func (h *PsqlHandler) QueryRow(ctx context.Context, sql string, arguments ...any) (*models.Metrics, error) {
-	var row pgx.Row
-	var err error
+// MigrationVersion возвращает версию схемы, до которой goose применил миграции
+func MigrationVersion(ctx context.Context) (int64, error) {
+	if psqlHandler == nil {
+		return 0, ErrNoConnection
+	}
 
-	for i := 0; i <= len(utils.Delays); i++ {
-		log.Println(i)
-		row = h.pool.QueryRow(ctx, sql, arguments...)
+	var v int64
+	err := psqlHandler.pool.QueryRow(ctx,
+		"SELECT COALESCE(max(version_id), 0) FROM goose_db_version WHERE is_applied",
+	).Scan(&v)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get migration version: %w", err)
+	}
 
-		var (
-			id    string
-			t     string
-			value *float64
-			delta *int64
-			hash  *string
-		)
+	return v, nil
+}
 
-		if err = row.Scan(&id, &t, &delta, &value, &hash); err == nil {
-			return &models.Metrics{
-				ID:    id,
-				MType: t,
-				Delta: delta,
-				Value: value,
-			}, nil
-		} else {
-			logger.Error("failed to scan", zap.Error(err))
-		}
+// LatestMigration возвращает версию последней миграции в каталоге
+func LatestMigration(mPath string) (int64, error) {
+	migrations, err := goose.CollectMigrations(mPath, 0, goose.MaxVersion)
+	if err != nil {
+		return 0, fmt.Errorf("failed to collect migrations: %w", err)
+	}
 
-		if i == len(utils.Delays) {
-			break
-		}
+	last, err := migrations.Last()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get last migration: %w", err)
+	}
 
-		time.Sleep(time.Duration(utils.Delays[i]) * time.Second)
+	return last.Version, nil
+}
+
+// ReplicationLag возвращает отставание реплики от мастера по времени последней
+// примененной транзакции из WAL. На мастере отставание нулевое.
+func ReplicationLag(ctx context.Context) (time.Duration, error) {
+	if psqlHandler == nil {
+		return 0, ErrNoConnection
+	}
+
+	var lag float64
+	err := psqlHandler.pool.QueryRow(ctx, `SELECT CASE WHEN pg_is_in_recovery()
+		THEN COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+		ELSE 0 END`,
+	).Scan(&lag)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get replication lag: %w", err)
 	}
 
-	return &models.Metrics{}, fmt.Errorf("failed to make query: %w", err)
+	return time.Duration(lag * float64(time.Second)), nil
 }
 
-func QueryRow(ctx context.Context, mtype string, mName string) (*models.Metrics, error) {
-	return psqlHandler.QueryRow(ctx, "SELECT * FROM metrics WHERE mtype = $1 AND id = $2", mtype, mName)
+// DeleteMetric удаляет метрику заданного типа
+func DeleteMetric(ctx context.Context, mType string, name string) error {
+	if psqlHandler == nil {
+		return ErrNoConnection
+	}
+
+	tag, err := psqlHandler.Exec(ctx, "DELETE FROM metrics WHERE mtype = $1 AND id = $2", mType, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete metric: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUnknownMetric
+	}
+	cache.invalidate(name)
+
+	return nil
+}
+
+// ResetCounter обнуляет существующий счетчик
+func ResetCounter(ctx context.Context, name string) error {
+	if psqlHandler == nil {
+		return ErrNoConnection
+	}
+
+	tx, err := psqlHandler.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, "UPDATE metrics SET delta = 0, updated_at = now() WHERE mtype = $1 AND id = $2", models.Counter, name)
+	if err != nil {
+		return fmt.Errorf("failed to reset counter: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUnknownCounter
+	}
+
+	// История до сброса не годится для rate, начинаем ее заново
+	if _, err := tx.Exec(ctx, "DELETE FROM counter_samples WHERE id = $1", name); err != nil {
+		return fmt.Errorf("failed to reset counter samples: %w", err)
+	}
+	if err := recordSample(ctx, name, transactionInfo{tx: tx, ctx: ctx}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	cache.invalidate(name)
+
+	return nil
+}
+
+// DeletePrefix удаляет все метрики, имена которых начинаются с prefix, и возвращает их количество
+func DeletePrefix(ctx context.Context, prefix string) (int64, error) {
+	if psqlHandler == nil {
+		return 0, ErrNoConnection
+	}
+
+	// left() вместо LIKE, чтобы не экранировать % и _ в префиксе
+	tag, err := psqlHandler.Exec(ctx, "DELETE FROM metrics WHERE left(id, length($1)) = $1", prefix)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete metrics: %w", err)
+	}
+	if tag.RowsAffected() > 0 {
+		cache.clear()
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// Expire удаляет метрики, которые не обновлялись дольше TTL, и возвращает их количество
+func Expire(ctx context.Context) (int64, error) {
+	if psqlHandler == nil {
+		return 0, ErrNoConnection
+	}
+	if TTL() <= 0 {
+		return 0, nil
+	}
+
+	tag, err := psqlHandler.Exec(ctx, "DELETE FROM metrics WHERE NOT "+notExpired, ttlSeconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire metrics: %w", err)
+	}
+	if tag.RowsAffected() > 0 {
+		cache.clear()
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// notExpired - условие для выборок: метрика обновлялась не раньше TTL назад.
+// $1 - TTL в секундах, 0 - метрики не устаревают.
+const notExpired = "($1::float8 = 0 OR updated_at >= now() - make_interval(secs => $1::float8))"
+
+func ttlSeconds() float64 {
+	return TTL().Seconds()
 }
@@ -0,0 +1,157 @@
+package repository
+
+import (
+	"context"
+	"math"
+	"metricapp/internal/logger"
+	models "metricapp/internal/model"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDB подключается к базе из TEST_DATABASE_DSN и удаляет метрики с префиксом prefix после теста.
+// Без переменной тест пропускается.
+func testDB(t *testing.T, prefix string) context.Context {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	logger.InitLogger()
+	NewPsqlHandler(dsn, "../../migrations")
+	require.NotNil(t, psqlHandler, "failed to connect to %s", dsn)
+
+	ctx := context.Background()
+	_, err := DeletePrefix(ctx, prefix)
+	require.NoError(t, err)
+	t.Cleanup(func() { DeletePrefix(ctx, prefix) })
+
+	return ctx
+}
+
+func TestPsql_DistributionTypeConflict(t *testing.T) {
+	ctx := testDB(t, "test_conflict_")
+
+	require.NoError(t, UpdateGauge(ctx, "test_conflict_g", 1.5))
+
+	h := models.NewHistogram(1, 2)
+	h.Observe(1)
+	hist := models.Metrics{ID: "test_conflict_g", MType: models.Histogram, Histogram: h}
+	assert.ErrorIs(t, MergeDistribution(ctx, hist), ErrTypeConflict)
+	assert.ErrorIs(t, ObserveDistribution(ctx, models.Summary, "test_conflict_g", 1), ErrTypeConflict)
+
+	// В пакете конфликт - ошибка метрики, а не всей транзакции
+	err := InsertBatch(ctx, []models.Metrics{models.ComposeMetrics("test_conflict_c", models.Counter, 0, 1), hist})
+	var batchErr models.BatchError
+	require.ErrorAs(t, err, &batchErr)
+	assert.Equal(t, 1, batchErr[0].Index)
+	assert.ErrorIs(t, batchErr[0].Err, ErrTypeConflict)
+
+	// Gauge не испорчен
+	m, err := QueryRow(ctx, models.Gauge, "test_conflict_g")
+	require.NoError(t, err)
+	require.NotNil(t, m.Value)
+	assert.Equal(t, 1.5, *m.Value)
+	_, err = QueryRow(ctx, models.Histogram, "test_conflict_g")
+	assert.ErrorIs(t, err, ErrUnknownMetric)
+
+	// И наоборот: gauge и счетчик не пишутся поверх гистограммы
+	require.NoError(t, MergeDistribution(ctx, models.Metrics{ID: "test_conflict_h", MType: models.Histogram, Histogram: h}))
+	assert.ErrorIs(t, UpdateGauge(ctx, "test_conflict_h", 1), ErrTypeConflict)
+	assert.ErrorIs(t, IncrementCounter(ctx, "test_conflict_h", 1), ErrTypeConflict)
+}
+
+func TestPsql_SetTypeConflict(t *testing.T) {
+	ctx := testDB(t, "test_set_conflict_")
+
+	require.NoError(t, IncrementCounter(ctx, "test_set_conflict_c", 7))
+
+	set := models.Metrics{ID: "test_set_conflict_c", MType: models.Set, Set: &models.SetData{Elements: []string{"a"}}}
+	assert.ErrorIs(t, MergeSet(ctx, set), ErrTypeConflict)
+
+	m, err := QueryRow(ctx, models.Counter, "test_set_conflict_c")
+	require.NoError(t, err)
+	require.NotNil(t, m.Delta)
+	assert.Equal(t, int64(7), *m.Delta)
+	assert.Nil(t, m.Set)
+
+	// Счетчик не пишется поверх множества
+	set.ID = "test_set_conflict_s"
+	require.NoError(t, MergeSet(ctx, set))
+	assert.ErrorIs(t, IncrementCounter(ctx, "test_set_conflict_s", 1), ErrTypeConflict)
+}
+
+func TestPsql_IncrementCounterWithHistory(t *testing.T) {
+	ctx := testDB(t, "test_history_")
+	SetCounterHistory(time.Minute, time.Minute)
+	t.Cleanup(func() { SetCounterHistory(0, 0) })
+
+	// Приращение и точка истории пишутся вместе
+	require.NoError(t, IncrementCounter(ctx, "test_history_c", 5))
+	require.NoError(t, IncrementCounter(ctx, "test_history_c", 2))
+
+	m, err := QueryRow(ctx, models.Counter, "test_history_c")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), *m.Delta)
+
+	rate, ok, err := CounterRate(ctx, "test_history_c", time.Minute)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, int64(2), rate.Increase)
+}
+
+func TestPsql_WriteBehindFlush(t *testing.T) {
+	ctx := testDB(t, "test_wb_")
+
+	require.NoError(t, IncrementCounter(ctx, "test_wb_c", math.MaxInt64-1))
+
+	// Переполнение вместе с сохраненным значением буфер не видит, его отвергает база при сбросе
+	wb := NewWriteBehind(100)
+	require.NoError(t, wb.Add(models.ComposeMetrics("test_wb_c", models.Counter, 0, 5)))
+	require.NoError(t, wb.Add(models.ComposeMetrics("test_wb_g", models.Gauge, 2.5, 0)))
+
+	refs, err := wb.Flush(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []models.MetricRef{{ID: "test_wb_g", MType: models.Gauge}}, refs)
+	assert.Equal(t, 0, wb.Len())
+
+	m, err := QueryRow(ctx, models.Gauge, "test_wb_g")
+	require.NoError(t, err)
+	assert.Equal(t, 2.5, *m.Value)
+
+	// Отвергнутое при сбросе приращение не пропадает молча
+	assert.ErrorIs(t, wb.Add(models.ComposeMetrics("test_wb_c", models.Counter, 0, 1)), models.ErrCounterOverflow)
+}
+
+func TestPsql_NotifyBatch(t *testing.T) {
+	ctx := testDB(t, "test_notify_")
+
+	pooled, err := psqlHandler.pool.Acquire(ctx)
+	require.NoError(t, err)
+	conn := pooled.Hijack()
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, "LISTEN "+changesChannel)
+	require.NoError(t, err)
+
+	// Пакет из трех метрик - одно уведомление со всеми id
+	require.NoError(t, InsertBatch(ctx, []models.Metrics{
+		models.ComposeMetrics("test_notify_a", models.Gauge, 1, 0),
+		models.ComposeMetrics("test_notify_b", models.Counter, 0, 1),
+		models.ComposeMetrics("test_notify_a", models.Gauge, 2, 0),
+	}))
+	n, err := conn.WaitForNotification(ctx)
+	require.NoError(t, err)
+	assert.JSONEq(t, `["test_notify_a","test_notify_b"]`, n.Payload)
+
+	// Запись вне пакета по-прежнему уведомляет построчно
+	require.NoError(t, UpdateGauge(ctx, "test_notify_c", 1))
+	n, err = conn.WaitForNotification(ctx)
+	require.NoError(t, err)
+	assert.JSONEq(t, `["test_notify_c"]`, n.Payload)
+}
@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var ErrWindowTooLong = errors.New("rate window is longer than counter history")
+
+// Сколько хранить историю значений счетчиков для rate и increase (0 - не хранить)
+// и окно по умолчанию. Общие для обоих хранилищ и меняются на лету.
+var (
+	counterHistory atomic.Int64
+	counterWindow  atomic.Int64
+)
+
+// История прореживается так, чтобы на счетчик приходилось не больше maxSamples точек
+const maxSamples = 120
+
+func SetCounterHistory(history time.Duration, window time.Duration) {
+	counterHistory.Store(int64(history))
+	counterWindow.Store(int64(window))
+}
+
+func CounterHistory() time.Duration {
+	return time.Duration(counterHistory.Load())
+}
+
+// CounterWindow проверяет окно для rate и increase, 0 - окно по умолчанию.
+// Возвращает 0, если история не хранится и окно не запрошено явно.
+func CounterWindow(window time.Duration) (time.Duration, error) {
+	history := CounterHistory()
+	if window <= 0 {
+		if history == 0 {
+			return 0, nil
+		}
+		window = time.Duration(counterWindow.Load())
+	}
+	if window > history {
+		return 0, fmt.Errorf("%w: %s > %s", ErrWindowTooLong, window, history)
+	}
+
+	return window, nil
+}
+
+// sampleSpacing - минимальный промежуток между точками истории
+func sampleSpacing() time.Duration {
+	return max(CounterHistory()/maxSamples, time.Second)
+}
+
+// sample - значение счетчика в момент at
+type sample struct {
+	at    time.Time
+	value int64
+}
+
+// record добавляет точку, если с прошлой прошло не меньше sampleSpacing,
+// и отбрасывает точки старше истории. Самая свежая из старых точек остается:
+// она нужна как начало окна длиной во всю историю.
+func record(samples []sample, now time.Time, value int64) []sample {
+	if CounterHistory() == 0 {
+		return nil
+	}
+	if n := len(samples); n > 0 && now.Sub(samples[n-1].at) < sampleSpacing() {
+		return samples
+	}
+	samples = append(samples, sample{at: now, value: value})
+
+	cutoff := now.Add(-CounterHistory())
+	i := 0
+	for i+1 < len(samples) && !samples[i+1].at.After(cutoff) {
+		i++
+	}
+
+	return samples[i:]
+}
+
+// Rate - прирост счетчика за окно и средняя скорость в секунду
+type Rate struct {
+	Increase int64
+	PerSec   float64
+}
+
+// rateOver считает прирост от начала окна до текущего значения cur.
+// Началом служит последняя точка не позже now-window, а если счетчик моложе окна -
+// самая ранняя точка. ok=false, если точек нет.
+func rateOver(samples []sample, cur int64, now time.Time, window time.Duration) (Rate, bool) {
+	if len(samples) == 0 {
+		return Rate{}, false
+	}
+
+	base := samples[0]
+	cutoff := now.Add(-window)
+	for _, s := range samples[1:] {
+		if s.at.After(cutoff) {
+			break
+		}
+		base = s
+	}
+
+	r := Rate{Increase: cur - base.value}
+	if elapsed := now.Sub(base.at).Seconds(); elapsed > 0 {
+		r.PerSec = float64(r.Increase) / elapsed
+	}
+
+	return r, true
+}
@@ -0,0 +1,24 @@
+package repository
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Через сколько без обновлений метрика считается устаревшей, 0 - метрики не устаревают.
+// Общий для обоих хранилищ и меняется на лету при перечитывании конфигурации.
+var metricTTL atomic.Int64
+
+func SetTTL(d time.Duration) {
+	metricTTL.Store(int64(d))
+}
+
+func TTL() time.Duration {
+	return time.Duration(metricTTL.Load())
+}
+
+// expired проверяет, устарела ли метрика, обновленная в updated
+func expired(updated time.Time, now time.Time) bool {
+	ttl := TTL()
+	return ttl > 0 && now.Sub(updated) > ttl
+}
@@ -0,0 +1,239 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"metricapp/internal/logger"
+	models "metricapp/internal/model"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// WriteBehind копит обновления gauge и счетчиков в памяти и пишет их в базу одной транзакцией:
+// для gauge остается последнее значение, приращения счетчика складываются.
+// Гистограммы, summary и множества в буфер не попадают и пишутся сразу.
+type WriteBehind struct {
+	mu       sync.Mutex
+	gauges   map[string]float64
+	counters map[string]int64
+	maxSize  int
+	full     chan struct{}
+	// Метрики, которые база отвергла при сбросе. Ошибка возвращается следующему обновлению метрики,
+	// чтобы подтвержденные данные не пропадали молча.
+	rejected map[models.MetricRef]error
+
+	// Сбросы не должны идти параллельно, иначе старое значение gauge может перезаписать новое
+	flushMu sync.Mutex
+}
+
+// NewWriteBehind создает буфер, который просит сброса, когда в нем набирается maxSize метрик
+func NewWriteBehind(maxSize int) *WriteBehind {
+	return &WriteBehind{
+		gauges:   make(map[string]float64),
+		counters: make(map[string]int64),
+		maxSize:  maxSize,
+		full:     make(chan struct{}, 1),
+		rejected: make(map[models.MetricRef]error),
+	}
+}
+
+// Buffered - попадают ли метрики типа mType в буфер
+func (wb *WriteBehind) Buffered(mType string) bool {
+	return mType == models.Gauge || mType == models.Counter
+}
+
+// Full сигналит, что буфер набрал maxSize метрик и его пора сбросить
+func (wb *WriteBehind) Full() <-chan struct{} {
+	return wb.full
+}
+
+// Len - сколько метрик ждет записи
+func (wb *WriteBehind) Len() int {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	return len(wb.gauges) + len(wb.counters)
+}
+
+// Add добавляет одну провалидированную метрику
+func (wb *WriteBehind) Add(m models.Metrics) error {
+	var batchErr models.BatchError
+	if err := wb.AddBatch([]models.Metrics{m}, nil); errors.As(err, &batchErr) {
+		return batchErr[0].Err
+	}
+
+	return nil
+}
+
+// AddBatch добавляет в буфер gauge и счетчики из провалидированного пакета, остальное пропускает.
+// Пакет не добавляется целиком, если приращение переполняет накопленное в буфере значение
+// или если прошлое обновление метрики база отвергла при сбросе. Переполнение вместе с сохраненным
+// в базе значением проверяет сама база при сбросе: чтение счетчика на каждое обновление
+// добавило бы по запросу в базу на запись, которую буфер должен экономить.
+//
+// write, если задан, пишет остальную часть пакета. Он вызывается под замком буфера после проверок
+// и до изменения буфера, так что пакет либо принимается целиком, либо не применяется вовсе:
+// ни проверка, ни параллельное обновление не могут отвергнуть буферную часть после записи в базу.
+func (wb *WriteBehind) AddBatch(metrics []models.Metrics, write func() error) error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	// Отказ сообщается один раз, повтор того же обновления уже принимается
+	if i, err := wb.rejectedIn(metrics); err != nil {
+		delete(wb.rejected, models.MetricRef{ID: metrics[i].ID, MType: metrics[i].MType})
+		return models.BatchError{{Index: i, ID: metrics[i].ID, Err: err}}
+	}
+
+	sums, err := wb.sum(metrics)
+	if err != nil {
+		return err
+	}
+	if write != nil {
+		if err := write(); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range metrics {
+		if m.MType == models.Gauge {
+			wb.gauges[m.ID] = *m.Value
+		}
+	}
+	for id, sum := range sums {
+		wb.counters[id] = sum
+	}
+
+	if len(wb.gauges)+len(wb.counters) >= wb.maxSize {
+		select {
+		case wb.full <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// rejectedIn ищет в пакете метрику, прошлое обновление которой база отвергла. Вызывается под mu.
+func (wb *WriteBehind) rejectedIn(metrics []models.Metrics) (int, error) {
+	for i, m := range metrics {
+		if err, ok := wb.rejected[models.MetricRef{ID: m.ID, MType: m.MType}]; ok {
+			return i, fmt.Errorf("previous update was rejected on flush: %w", err)
+		}
+	}
+
+	return 0, nil
+}
+
+// sum считает новые накопленные приращения счетчиков пакета. Вызывается под mu.
+func (wb *WriteBehind) sum(metrics []models.Metrics) (map[string]int64, error) {
+	sums := make(map[string]int64)
+	for i, m := range metrics {
+		if m.MType != models.Counter {
+			continue
+		}
+
+		cur, ok := sums[m.ID]
+		if !ok {
+			cur = wb.counters[m.ID]
+		}
+		sum, err := models.AddDelta(cur, *m.Delta)
+		if err != nil {
+			return nil, models.BatchError{{Index: i, ID: m.ID, Err: err}}
+		}
+		sums[m.ID] = sum
+	}
+
+	return sums, nil
+}
+
+// Flush пишет накопленное одной транзакцией и возвращает записанные метрики.
+// Метрику, которую база отвергла (счетчик переполнился из-за записи другой реплики, имя занято
+// метрикой другого типа), выбрасывает с записью в лог, а ошибку отдает ее следующему обновлению.
+// При ошибке соединения накопленное возвращается в буфер до следующего сброса.
+func (wb *WriteBehind) Flush(ctx context.Context) ([]models.MetricRef, error) {
+	wb.flushMu.Lock()
+	defer wb.flushMu.Unlock()
+
+	wb.mu.Lock()
+	gauges, counters := wb.gauges, wb.counters
+	wb.gauges, wb.counters = make(map[string]float64), make(map[string]int64)
+	wb.mu.Unlock()
+
+	metrics := make([]models.Metrics, 0, len(gauges)+len(counters))
+	for id, v := range gauges {
+		metrics = append(metrics, models.ComposeMetrics(id, models.Gauge, v, 0))
+	}
+	for id, d := range counters {
+		metrics = append(metrics, models.ComposeMetrics(id, models.Counter, 0, d))
+	}
+
+	for len(metrics) > 0 {
+		err := InsertBatch(ctx, metrics)
+		if err == nil {
+			break
+		}
+
+		var batchErr models.BatchError
+		if !errors.As(err, &batchErr) {
+			wb.restore(metrics)
+			return nil, err
+		}
+
+		wb.mu.Lock()
+		for _, item := range batchErr {
+			logger.Ctx(ctx).Error("dropped buffered metric rejected by db", zap.String("ID", item.ID), zap.Error(item.Err))
+			m := metrics[item.Index]
+			wb.rejected[models.MetricRef{ID: m.ID, MType: m.MType}] = item.Err
+		}
+		wb.mu.Unlock()
+		metrics = dropIndexes(metrics, batchErr)
+	}
+
+	refs := make([]models.MetricRef, 0, len(metrics))
+	for _, m := range metrics {
+		refs = append(refs, models.MetricRef{ID: m.ID, MType: m.MType})
+	}
+
+	return refs, nil
+}
+
+// restore возвращает несохраненные метрики в буфер. Более свежие значения gauge,
+// пришедшие во время сброса, не перезаписываются.
+func (wb *WriteBehind) restore(metrics []models.Metrics) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	for _, m := range metrics {
+		switch m.MType {
+		case models.Gauge:
+			if _, ok := wb.gauges[m.ID]; !ok {
+				wb.gauges[m.ID] = *m.Value
+			}
+		case models.Counter:
+			sum, err := models.AddDelta(wb.counters[m.ID], *m.Delta)
+			if err != nil {
+				logger.Error("dropped buffered counter on overflow", zap.String("ID", m.ID))
+				continue
+			}
+			wb.counters[m.ID] = sum
+		}
+	}
+}
+
+func dropIndexes(metrics []models.Metrics, batchErr models.BatchError) []models.Metrics {
+	drop := make(map[int]struct{}, len(batchErr))
+	for _, item := range batchErr {
+		drop[item.Index] = struct{}{}
+	}
+
+	kept := metrics[:0]
+	for i, m := range metrics {
+		if _, ok := drop[i]; !ok {
+			kept = append(kept, m)
+		}
+	}
+
+	return kept
+}
@@ -0,0 +1,96 @@
+package repository
+
+import (
+	"errors"
+	"math"
+	models "metricapp/internal/model"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBehind(t *testing.T) {
+	wb := NewWriteBehind(3)
+	assert.True(t, wb.Buffered(models.Counter))
+	assert.False(t, wb.Buffered(models.Set))
+
+	// Gauge перезаписывается, приращения счетчика складываются
+	require.NoError(t, wb.AddBatch([]models.Metrics{
+		models.ComposeMetrics("g", models.Gauge, 1, 0),
+		models.ComposeMetrics("c", models.Counter, 0, 2),
+		models.ComposeMetrics("g", models.Gauge, 5, 0),
+	}, nil))
+	require.NoError(t, wb.Add(models.ComposeMetrics("c", models.Counter, 0, 3)))
+	assert.Equal(t, 2, wb.Len())
+	assert.Equal(t, 5.0, wb.gauges["g"])
+	assert.Equal(t, int64(5), wb.counters["c"])
+
+	// Переполнение отвергает пакет целиком и указывает номер метрики
+	err := wb.AddBatch([]models.Metrics{
+		models.ComposeMetrics("g2", models.Gauge, 1, 0),
+		models.ComposeMetrics("c", models.Counter, 0, math.MaxInt64),
+	}, nil)
+	var batchErr models.BatchError
+	require.ErrorAs(t, err, &batchErr)
+	assert.Equal(t, 1, batchErr[0].Index)
+	assert.Equal(t, 2, wb.Len())
+	assert.ErrorIs(t, wb.Add(models.ComposeMetrics("c", models.Counter, 0, math.MaxInt64)), models.ErrCounterOverflow)
+
+	select {
+	case <-wb.Full():
+		t.Fatal("buffer is not full yet")
+	default:
+	}
+	require.NoError(t, wb.Add(models.ComposeMetrics("g3", models.Gauge, 1, 0)))
+	select {
+	case <-wb.Full():
+	default:
+		t.Fatal("full buffer must ask for flush")
+	}
+
+	// Несохраненное возвращается в буфер, не затирая свежие gauge
+	wb.restore([]models.Metrics{
+		models.ComposeMetrics("g", models.Gauge, 1, 0),
+		models.ComposeMetrics("g4", models.Gauge, 4, 0),
+		models.ComposeMetrics("c", models.Counter, 0, 10),
+	})
+	assert.Equal(t, 5.0, wb.gauges["g"])
+	assert.Equal(t, 4.0, wb.gauges["g4"])
+	assert.Equal(t, int64(15), wb.counters["c"])
+}
+
+func TestWriteBehind_AddBatch(t *testing.T) {
+	wb := NewWriteBehind(100)
+	require.NoError(t, wb.Add(models.ComposeMetrics("big", models.Counter, 0, math.MaxInt64-10)))
+
+	// Отвергнутый буфером пакет не пишет в базу остальную часть
+	batch := []models.Metrics{
+		models.ComposeMetrics("c", models.Counter, 0, 1),
+		models.ComposeMetrics("big", models.Counter, 0, 11),
+	}
+	written := 0
+	write := func() error {
+		written++
+		return nil
+	}
+	var batchErr models.BatchError
+	require.ErrorAs(t, wb.AddBatch(batch, write), &batchErr)
+	assert.Equal(t, 1, batchErr[0].Index)
+	assert.ErrorIs(t, batchErr[0].Err, models.ErrCounterOverflow)
+	assert.Equal(t, 0, written)
+	assert.Equal(t, 1, wb.Len())
+
+	// Ошибка записи в базу оставляет буфер нетронутым
+	errDB := errors.New("insert failed")
+	assert.ErrorIs(t, wb.AddBatch(batch[:1], func() error { return errDB }), errDB)
+	assert.Equal(t, 1, wb.Len())
+
+	// Отказ базы при сбросе получает следующее обновление метрики, и только оно
+	wb.rejected[models.MetricRef{ID: "c", MType: models.Counter}] = ErrTypeConflict
+	assert.ErrorIs(t, wb.AddBatch(batch[:1], write), ErrTypeConflict)
+	assert.Equal(t, 0, written)
+	assert.NoError(t, wb.AddBatch(batch[:1], write))
+	assert.Equal(t, 1, written)
+	assert.Equal(t, int64(1), wb.counters["c"])
+}
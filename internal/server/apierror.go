@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"metricapp/internal/logger"
+	models "metricapp/internal/model"
+	"metricapp/internal/query"
+	"metricapp/internal/repository"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// errBadPayload - тело запроса не удалось прочитать или распарсить
+	errBadPayload = errors.New("failed to parse payload")
+	// errUnauthorized - к служебному эндпоинту обратились без верного токена
+	errUnauthorized = errors.New("admin token is missing or invalid")
+	// errEmptyPrefix - массовое удаление без префикса удалило бы все метрики
+	errEmptyPrefix = errors.New("prefix is required")
+)
+
+// APIError - единый формат ответа с ошибкой для всех эндпоинтов
+type APIError struct {
+	Code      int               `json:"code"`
+	Message   string            `json:"message"`
+	RequestID string            `json:"request_id,omitempty"`
+	Errors    models.BatchError `json:"errors,omitempty"`
+}
+
+// statusFromError - единственное место, где ошибки хранилищ сопоставляются с HTTP-статусами:
+//
+//	404 - метрика не найдена или в пути не указано ее имя
+//	400 - невалидные данные запроса
+//	401 - нет доступа к служебным эндпоинтам
+//	409 - имя метрики занято метрикой другого типа
+//	413 - тело запроса или пакет больше допустимого
+//	429 - клиент превысил лимит запросов
+//	503 - хранилище недоступно
+//	500 - все остальное
+func statusFromError(err error) int {
+	var batchErr models.BatchError
+
+	switch {
+	case errors.Is(err, models.ErrEmptyID),
+		errors.Is(err, repository.ErrUnknownMetric),
+		errors.Is(err, repository.ErrUnknownCounter),
+		errors.Is(err, query.ErrNoMatch):
+		return http.StatusNotFound
+	case errors.As(err, &batchErr),
+		errors.Is(err, errBadPayload),
+		errors.Is(err, errEmptyPrefix),
+		errors.Is(err, errNotWebSocket),
+		errors.Is(err, query.ErrSyntax),
+		errors.Is(err, query.ErrEval),
+		errors.Is(err, repository.ErrWindowTooLong),
+		errors.Is(err, models.ErrIDTooLong),
+		errors.Is(err, models.ErrUnknownType),
+		errors.Is(err, models.ErrMissingValue),
+		errors.Is(err, models.ErrMissingDelta),
+		errors.Is(err, models.ErrInvalidGauge),
+		errors.Is(err, models.ErrCounterOverflow),
+		errors.Is(err, models.ErrReservedID),
+		errors.Is(err, models.ErrInvalidHistogram),
+		errors.Is(err, models.ErrBucketsMismatch),
+		errors.Is(err, models.ErrInvalidSummary),
+		errors.Is(err, models.ErrAlphaMismatch),
+		errors.Is(err, models.ErrInvalidQuantile),
+		errors.Is(err, models.ErrInvalidSet),
+		errors.Is(err, models.ErrPrecisionMismatch),
+		errors.Is(err, repository.ErrInvalidGaugeValue),
+		errors.Is(err, repository.ErrInvalidCounterValue):
+		return http.StatusBadRequest
+	case errors.Is(err, errUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, repository.ErrTypeConflict):
+		return http.StatusConflict
+	case errors.Is(err, errTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, repository.ErrNoConnection):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError отдает ошибку клиенту в формате APIError.
+// Текст внутренних ошибок клиенту не показывается, а пишется в лог.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	resp := APIError{
+		Code:      statusFromError(err),
+		Message:   err.Error(),
+		RequestID: logger.RequestID(r.Context()),
+	}
+
+	var batchErr models.BatchError
+	if errors.As(err, &batchErr) {
+		resp.Message = "invalid metrics in batch"
+		resp.Errors = batchErr
+	}
+
+	if resp.Code >= http.StatusInternalServerError {
+		logger.Ctx(r.Context()).Error(
+			"request failed",
+			zap.String("URI", r.RequestURI),
+			zap.Error(err),
+		)
+		resp.Message = http.StatusText(resp.Code)
+	}
+
+	b, mErr := json.Marshal(resp)
+	if mErr != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(resp.Code)
+	w.Write(b)
+}
+
+// writeDeleted отдает количество удаленных метрик
+func writeDeleted(w http.ResponseWriter, r *http.Request, n int64) {
+	b, err := json.Marshal(struct {
+		Deleted int64 `json:"deleted"`
+	}{n})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// writeValue отдает значение метрики в текстовом виде.
+// Для гистограмм и summary параметр ?quantile= возвращает оценку квантиля вместо числа наблюдений.
+func writeValue(w http.ResponseWriter, r *http.Request, m models.Metrics) {
+	q := r.URL.Query().Get("quantile")
+	if q == "" {
+		w.Write([]byte(models.FormatValue(m)))
+		return
+	}
+
+	qv, err := strconv.ParseFloat(q, 64)
+	if err != nil {
+		writeError(w, r, models.ErrInvalidQuantile)
+		return
+	}
+
+	v, err := m.Quantile(qv)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Write([]byte(strconv.FormatFloat(v, 'f', -1, 64)))
+}
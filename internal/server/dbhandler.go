@@ -1,27 +1,35 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
+	"math"
 	"metricapp/internal/logger"
 	models "metricapp/internal/model"
 	"metricapp/internal/repository"
-	"metricapp/internal/server/cfg"
 	"net/http"
+	"slices"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"go.uber.org/zap"
 )
 
 // Имело бы смысл засунуть psqlHandler в dbHandler, но пока оставлю пустым
-type DBHandler struct{}
+type DBHandler struct {
+	// Нужны для проверки готовности
+	migrationPath     string
+	maxReplicationLag time.Duration
+	// Буфер отложенной записи gauge и счетчиков, nil - запись сразу
+	wb *repository.WriteBehind
+}
 
 func NewDBHandler(dsn string, mPath string) *DBHandler {
-	repository.NewPsqlHandler(cfg.Cfg.DSN, cfg.Cfg.MigrationPath)
+	repository.NewPsqlHandler(dsn, mPath)
 
-	return &DBHandler{}
+	return &DBHandler{migrationPath: mPath}
 }
 
 func (h *DBHandler) UpdateMetrics(w http.ResponseWriter, r *http.Request) {
@@ -29,46 +37,128 @@ func (h *DBHandler) UpdateMetrics(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "mName")
 	value := chi.URLParam(r, "mValue")
 
+	if name == "" {
+		writeError(w, r, models.ErrEmptyID)
+		return
+	}
+
+	metric := models.Metrics{ID: name, MType: mType}
 	switch mType {
 	case models.Gauge:
 		v, err := strconv.ParseFloat(value, 64)
 		if err != nil {
-			http.Error(w, "failed to parse mValue", errBadReq)
+			writeError(w, r, repository.ErrInvalidGaugeValue)
 			return
 		}
+		metric.Value = &v
 
-		err = repository.UpdateGauge(name, v)
+	case models.Counter:
+		v, err := strconv.ParseInt(value, 10, 64)
 		if err != nil {
-			http.Error(w, "failed to update gauge", errInternal)
+			writeError(w, r, repository.ErrInvalidCounterValue)
 			return
 		}
+		metric.Delta = &v
 
-	case models.Counter:
-		v, err := strconv.ParseInt(value, 10, 64)
+	case models.Histogram, models.Summary:
+		v, err := strconv.ParseFloat(value, 64)
 		if err != nil {
-			http.Error(w, "failed to parse mValue", errBadReq)
+			writeError(w, r, repository.ErrInvalidGaugeValue)
+			return
+		}
+		if err := models.CheckReserved(metric.ID); err != nil {
+			writeError(w, r, err)
 			return
 		}
 
-		err = repository.IncrementCounter(name, v)
-		if err != nil {
-			http.Error(w, "failed to update counter", errInternal)
+		if err := repository.ObserveDistribution(r.Context(), mType, name, v); err != nil {
+			writeError(w, r, err)
 			return
 		}
+		selfStats.observeIngest(1)
+		h.publish(r.Context(), models.MetricRef{ID: name, MType: mType})
+		return
+
+	case models.Set:
+		// Одиночное обновление добавляет в множество один элемент
+		metric.Set = &models.SetData{Elements: []string{value}}
+	}
+
+	if err := models.CheckReserved(metric.ID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := metric.Validate(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := h.update(r.Context(), metric); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	selfStats.observeIngest(1)
+	h.publish(r.Context(), models.MetricRef{ID: metric.ID, MType: metric.MType})
+}
+
+// update записывает провалидированную метрику в базу
+func (h *DBHandler) update(ctx context.Context, metric models.Metrics) error {
+	if h.wb != nil && h.wb.Buffered(metric.MType) {
+		return h.wb.Add(metric)
+	}
+
+	switch metric.MType {
+	case models.Gauge:
+		return repository.UpdateGauge(ctx, metric.ID, *metric.Value)
+	case models.Counter:
+		return repository.IncrementCounter(ctx, metric.ID, *metric.Delta)
+	case models.Histogram, models.Summary:
+		return repository.MergeDistribution(ctx, metric)
+	case models.Set:
+		return repository.MergeSet(ctx, metric)
+	}
+
+	return fmt.Errorf("%w: %s", models.ErrUnknownType, metric.MType)
+}
+
+// publish отдает подписчикам /stream и /ws свежие значения обновленных метрик.
+// Метрики из буфера отложенной записи уйдут подписчикам после его сброса.
+func (h *DBHandler) publish(ctx context.Context, refs ...models.MetricRef) {
+	if h.wb != nil {
+		refs = slices.DeleteFunc(refs, func(ref models.MetricRef) bool {
+			return h.wb.Buffered(ref.MType)
+		})
 	}
+	h.broadcast(ctx, refs)
+}
 
+// broadcast читает метрики refs из базы и рассылает подписчикам.
+// Лишний запрос в базу делается, только если на метрики кто-то подписан.
+func (h *DBHandler) broadcast(ctx context.Context, refs []models.MetricRef) {
+	if len(refs) == 0 {
+		return
+	}
+
+	updates.publish(refs, func(refs []models.MetricRef) []models.Metrics {
+		metrics, err := repository.GetMany(ctx, refs, 0)
+		if err != nil {
+			logger.Ctx(ctx).Warn("failed to read metrics for subscribers", zap.Error(err))
+		}
+		return metrics
+	})
 }
 
 func (h *DBHandler) UpdateMultyMetrics(w http.ResponseWriter, r *http.Request) {
-	b, err := io.ReadAll(r.Body)
+	b, err := readBody(r)
 	if err != nil {
-		http.Error(w, http.StatusText(errInternal), errInternal)
+		writeError(w, r, err)
 		return
 	}
 	defer func() {
 		err := r.Body.Close()
 		if err != nil {
-			logger.Error(
+			logger.Ctx(r.Context()).Error(
 				"failed to close request body",
 				zap.Error(err),
 			)
@@ -78,20 +168,27 @@ func (h *DBHandler) UpdateMultyMetrics(w http.ResponseWriter, r *http.Request) {
 	var metrics []models.Metrics
 	err = json.Unmarshal(b, &metrics)
 	if err != nil {
-		http.Error(w, "failed to parse data", errBadReq)
+		writeError(w, r, fmt.Errorf("%w: %v", errBadPayload, err))
 		return
 	}
 
-	if cfg.Cfg.DSN == "" {
-		http.Error(w, "db is not initialized", errInternal)
+	if err := limits.checkBatch(len(metrics)); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	err = repository.InsertBatch(r.Context(), metrics)
+	if err := models.CheckReservedBatch(metrics); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	err = h.insertBatch(r.Context(), metrics)
 	if err != nil {
-		http.Error(w, "failed to make transaction", errInternal)
+		writeError(w, r, err)
 		return
 	}
+	selfStats.observeBatch(len(metrics))
+	h.publish(r.Context(), refsOf(metrics)...)
 }
 
 func (h *DBHandler) GetMetric(w http.ResponseWriter, r *http.Request) {
@@ -100,65 +197,71 @@ func (h *DBHandler) GetMetric(w http.ResponseWriter, r *http.Request) {
 
 	metric, err := repository.QueryRow(r.Context(), mType, mName)
 	if err != nil {
-		http.Error(w, "failed to get metric", errBadReq)
-		return
-	}
-
-	b, err := json.Marshal(metric)
-	if err != nil {
-		http.Error(w, "failed to marshal data", errInternal)
+		writeError(w, r, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(b)
+	writeValue(w, r, *metric)
 }
 
 func (h *DBHandler) UpdateMetricsWJSON(w http.ResponseWriter, r *http.Request) {
-	b, err := io.ReadAll(r.Body)
+	b, err := readBody(r)
 	if err != nil {
-		http.Error(w, http.StatusText(errInternal), errInternal)
+		writeError(w, r, err)
 		return
 	}
 	defer r.Body.Close()
 
-	var metric struct {
-		ID    string `json:"id"`
-		Type  string `json:"type"`
-		Value any    `json:"value"`
+	var payload struct {
+		ID    string   `json:"id"`
+		Type  string   `json:"type"`
+		Value *float64 `json:"value"`
 	}
-	err = json.Unmarshal(b, &metric)
+	err = json.Unmarshal(b, &payload)
 	if err != nil {
-		http.Error(w, http.StatusText(errBadReq), errBadReq)
+		writeError(w, r, fmt.Errorf("%w: %v", errBadPayload, err))
 		return
 	}
 
-	switch metric.Type {
+	metric := models.Metrics{ID: payload.ID, MType: payload.Type}
+	switch payload.Type {
 	case models.Gauge:
-		v := metric.Value.(float64)
-		err := repository.UpdateGauge(metric.ID, v)
-		if err != nil {
-			http.Error(w, "filed to update GAUGE", errInternal)
-			return
-		}
-
+		metric.Value = payload.Value
 	case models.Counter:
-		v := metric.Value.(int64)
-		err := repository.IncrementCounter(metric.ID, v)
-		if err != nil {
-			http.Error(w, "filed to update COUNTER", errInternal)
-			return
+		if payload.Value != nil {
+			v := *payload.Value
+			// Как и в памяти: дробные и не влезающие в int64 значения отвергаются, а не обрезаются
+			if v != math.Trunc(v) || v >= math.MaxInt64 || v < math.MinInt64 {
+				writeError(w, r, repository.ErrInvalidCounterValue)
+				return
+			}
+			d := int64(v)
+			metric.Delta = &d
 		}
+	}
+
+	if err := models.CheckReserved(metric.ID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := metric.Validate(); err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-	default:
-		http.Error(w, fmt.Sprintf("unknown metric type: %s", metric.Type), errBadReq)
+	if err := h.update(r.Context(), metric); err != nil {
+		writeError(w, r, err)
+		return
 	}
+	selfStats.observeIngest(1)
+	h.publish(r.Context(), models.MetricRef{ID: metric.ID, MType: metric.MType})
 }
 
 func (h *DBHandler) UpdateMetricWJSONv2(w http.ResponseWriter, r *http.Request) {
-	b, err := io.ReadAll(r.Body)
+	b, err := readBody(r)
 	if err != nil {
-		http.Error(w, http.StatusText(errInternal), errInternal)
+		writeError(w, r, err)
 		return
 	}
 	defer r.Body.Close()
@@ -166,58 +269,78 @@ func (h *DBHandler) UpdateMetricWJSONv2(w http.ResponseWriter, r *http.Request)
 	var metric models.Metrics
 	err = json.Unmarshal(b, &metric)
 	if err != nil {
-		http.Error(w, http.StatusText(errBadReq), errBadReq)
+		writeError(w, r, fmt.Errorf("%w: %v", errBadPayload, err))
 		return
 	}
 
-	switch metric.MType {
-	case models.Gauge:
-		v := metric.Value
-		err := repository.UpdateGauge(metric.ID, *v)
-		if err != nil {
-			http.Error(w, "filed to update GAUGE", errInternal)
-			return
-		}
+	if err := models.CheckReserved(metric.ID); err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-	case models.Counter:
-		v := metric.Delta
-		err := repository.IncrementCounter(metric.ID, *v)
-		if err != nil {
-			http.Error(w, "filed to update COUNTER", errInternal)
-			return
-		}
+	if err := metric.Validate(); err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-	default:
-		http.Error(w, fmt.Sprintf("unknown metric type: %s", metric.MType), errBadReq)
+	if err := h.update(r.Context(), metric); err != nil {
+		writeError(w, r, err)
+		return
 	}
+	selfStats.observeIngest(1)
+	h.publish(r.Context(), models.MetricRef{ID: metric.ID, MType: metric.MType})
 }
 
 func (h *DBHandler) GetMetricWJSON(w http.ResponseWriter, r *http.Request) {
-	b, err := io.ReadAll(r.Body)
+	h.GetMetricWJSONv2(w, r)
+}
+
+func (h *DBHandler) GetMetricWJSONv2(w http.ResponseWriter, r *http.Request) {
+	b, err := readBody(r)
 	if err != nil {
-		http.Error(w, "error to read request body", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
 	var payload struct {
 		ID   string `json:"id"`
 		Type string `json:"type"`
+		// Окно для rate и increase счетчика
+		Window string `json:"window"`
 	}
 	err = json.Unmarshal(b, &payload)
 	if err != nil {
-		http.Error(w, "failed to parse payload", errBadReq)
+		writeError(w, r, fmt.Errorf("%w: %v", errBadPayload, err))
 		return
 	}
 
+	var window time.Duration
+	if payload.Type == models.Counter {
+		if window, err = parseWindow(payload.Window); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
 	metric, err := repository.QueryRow(r.Context(), payload.Type, payload.ID)
 	if err != nil {
-		http.Error(w, "failed get metric", errInternal)
+		writeError(w, r, err)
 		return
 	}
+	if window > 0 {
+		rate, ok, err := repository.CounterRate(r.Context(), payload.ID, window)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if ok {
+			setRate(metric, rate)
+		}
+	}
 
-	b, err = json.Marshal(metric)
+	b, err = json.Marshal(models.ForResponse(*metric))
 	if err != nil {
-		http.Error(w, "failed to marshal metric", errInternal)
+		writeError(w, r, fmt.Errorf("failed to marshal metric: %w", err))
 		return
 	}
 
@@ -225,52 +348,83 @@ func (h *DBHandler) GetMetricWJSON(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
-func (h *DBHandler) GetMetricWJSONv2(w http.ResponseWriter, r *http.Request) {
-	b, err := io.ReadAll(r.Body)
+func (h *DBHandler) PingDB(w http.ResponseWriter, r *http.Request) {
+	err := repository.Ping(r.Context())
 	if err != nil {
-		http.Error(w, "error to read request body", http.StatusInternalServerError)
+		writeError(w, r, fmt.Errorf("%w: %v", repository.ErrNoConnection, err))
 		return
 	}
+}
 
-	var payload struct {
-		ID   string `json:"id"`
-		Type string `json:"type"`
+func (h *DBHandler) GetStorage() *repository.MemStorage {
+	return nil
+}
+
+func (h *DBHandler) storeSelfMetrics(ctx context.Context, metrics []models.Metrics) error {
+	hits, misses := repository.CacheStats()
+	metrics = append(metrics,
+		models.ComposeMetrics(selfName("cache_hits"), models.Counter, 0, hits),
+		models.ComposeMetrics(selfName("cache_misses"), models.Counter, 0, misses),
+	)
+
+	return repository.InsertBatch(ctx, metrics)
+}
+
+func (h *DBHandler) expire(ctx context.Context) (int64, error) {
+	return repository.Expire(ctx)
+}
+
+func (h *DBHandler) storageSize(ctx context.Context) (int, error) {
+	return repository.Count(ctx)
+}
+
+// DeleteMetric - DELETE /value/{mType}/{mName}
+func (h *DBHandler) DeleteMetric(w http.ResponseWriter, r *http.Request) {
+	if err := h.flushPending(r.Context()); err != nil {
+		writeError(w, r, err)
+		return
 	}
-	err = json.Unmarshal(b, &payload)
+
+	err := repository.DeleteMetric(r.Context(), chi.URLParam(r, "mType"), chi.URLParam(r, "mName"))
 	if err != nil {
-		http.Error(w, "failed to parse payload", errBadReq)
+		writeError(w, r, err)
+	}
+}
+
+// ResetCounter - POST /reset/{mName}
+func (h *DBHandler) ResetCounter(w http.ResponseWriter, r *http.Request) {
+	// Отложенные приращения должны лечь до сброса, а не после
+	if err := h.flushPending(r.Context()); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	metric, err := repository.QueryRow(r.Context(), payload.Type, payload.ID)
-	if err != nil {
-		http.Error(w, "failed get metric", http.StatusNotFound)
-		logger.Error("failed to get metric", zap.Error(err))
+	name := chi.URLParam(r, "mName")
+	if err := repository.ResetCounter(r.Context(), name); err != nil {
+		writeError(w, r, err)
 		return
 	}
+	h.broadcast(r.Context(), []models.MetricRef{{ID: name, MType: models.Counter}})
+}
 
-	b, err = json.Marshal(metric)
-	if err != nil {
-		http.Error(w, "failed to marshal metric", errInternal)
+// DeleteByPrefix - DELETE /value/?prefix=
+func (h *DBHandler) DeleteByPrefix(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		writeError(w, r, errEmptyPrefix)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(b)
-}
+	if err := h.flushPending(r.Context()); err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-func (h *DBHandler) PingDB(w http.ResponseWriter, r *http.Request) {
-	err := repository.Ping()
+	n, err := repository.DeletePrefix(r.Context(), prefix)
 	if err != nil {
-		http.Error(w, "Error: database is not responding", errInternal)
+		writeError(w, r, err)
 		return
 	}
-}
 
-func (h *DBHandler) getStoreInterval() int {
-	return 1_000
-}
-
-func (h *DBHandler) GetStorage() *repository.MemStorage {
-	return nil
+	writeDeleted(w, r, n)
 }
@@ -1,13 +1,15 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
-	"io"
+	"fmt"
 	"metricapp/internal/filemanager"
 	"metricapp/internal/logger"
 	models "metricapp/internal/model"
 	"metricapp/internal/repository"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"go.uber.org/zap"
@@ -18,11 +20,6 @@ type MetricHandler struct {
 	fm      *filemanager.FManager
 }
 
-const (
-	errInternal = http.StatusInternalServerError
-	errBadReq   = http.StatusBadRequest
-)
-
 func NewMetricHandlerWfm(fm *filemanager.FManager, restore bool) *MetricHandler {
 	handler := &MetricHandler{
 		storage: repository.NewMemStorage(),
@@ -33,6 +30,11 @@ func NewMetricHandlerWfm(fm *filemanager.FManager, restore bool) *MetricHandler
 		metrics, err := fm.Read()
 		if err == nil {
 			for _, m := range metrics {
+				if err := m.Validate(); err != nil {
+					logger.Warn("skip invalid metric from file", zap.String("ID", m.ID), zap.Error(err))
+					continue
+				}
+
 				switch m.MType {
 				case models.Gauge:
 					handler.storage.SetField(m.ID, *m.Value)
@@ -44,6 +46,8 @@ func NewMetricHandlerWfm(fm *filemanager.FManager, restore bool) *MetricHandler
 						Name:  m.ID,
 						Delta: *m.Delta,
 					})
+				case models.Histogram, models.Summary, models.Set:
+					handler.storage.ProcessMultyMetrics([]models.Metrics{m})
 				}
 			}
 		}
@@ -56,6 +60,38 @@ func (h *MetricHandler) GetStorage() *repository.MemStorage {
 	return &h.storage
 }
 
+func (h *MetricHandler) storeSelfMetrics(_ context.Context, metrics []models.Metrics) error {
+	return h.storage.ProcessMultyMetrics(metrics)
+}
+
+// expire удаляет устаревшие метрики и сразу сбрасывает хранилище в файл
+func (h *MetricHandler) expire(_ context.Context) (int64, error) {
+	n := h.storage.Expire(time.Now())
+	if n > 0 {
+		if err := h.write(); err != nil {
+			return int64(n), err
+		}
+	}
+
+	return int64(n), nil
+}
+
+// flushPending нечего делать: в памяти все пишется сразу, файл сбрасывает цикл сервера
+func (h *MetricHandler) flushPending(_ context.Context) error {
+	return nil
+}
+
+func (h *MetricHandler) storageSize(_ context.Context) (int, error) {
+	return len(h.storage.GetAllMetrics()), nil
+}
+
+// publish отдает подписчикам /stream и /ws свежие значения обновленных метрик
+func (h *MetricHandler) publish(refs ...models.MetricRef) {
+	updates.publish(refs, func(refs []models.MetricRef) []models.Metrics {
+		return h.storage.GetMany(refs, 0, time.Now())
+	})
+}
+
 func NewMetricHandler() *MetricHandler {
 	return &MetricHandler{
 		storage: repository.NewMemStorage(),
@@ -76,23 +112,28 @@ func (h *MetricHandler) UpdateMetrics(w http.ResponseWriter, r *http.Request) {
 		Type:  mType,
 		Value: value,
 	}
+	if err := models.CheckReserved(metrics.ID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
 	if err := h.storage.ProcessMetric(metrics); err != nil {
-		switch err {
-		case repository.ErrMetricIsRequired:
-			http.Error(w, err.Error(), http.StatusNotFound)
-		default:
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		}
+		writeError(w, r, err)
+		return
 	}
+	selfStats.observeIngest(1)
+	h.publish(models.MetricRef{ID: metrics.ID, MType: metrics.Type})
 
-	if h.getStoreInterval() == 0 {
-		h.write(h.storage.GetAllMetrics())
+	if h.syncWrite() {
+		h.write()
 	}
 }
 
-func (h *MetricHandler) write(metrics []models.Metrics) error {
+// write сбрасывает хранилище в файл. Срез снимается под замком файла,
+// чтобы параллельные записи не вернули в файл устаревшее состояние.
+func (h *MetricHandler) write() error {
 	if h.fm != nil {
-		return h.fm.Write(metrics)
+		return h.fm.Save(h.storage.GetAllMetrics)
 	}
 
 	return nil
@@ -106,37 +147,34 @@ func (h *MetricHandler) read() ([]models.Metrics, error) {
 	return nil, nil
 }
 
-func (h *MetricHandler) getStoreInterval() int {
-	if h.fm == nil {
-		return 1_000
-	}
-
-	return h.fm.Storeinterval
+// syncWrite - при нулевом STORE_INTERVAL метрики пишутся в файл сразу после обновления
+func (h *MetricHandler) syncWrite() bool {
+	return h.fm != nil && h.fm.StoreInterval() == 0
 }
 
 func (h *MetricHandler) GetMetric(w http.ResponseWriter, r *http.Request) {
 	mType := chi.URLParam(r, "mType")
 	mName := chi.URLParam(r, "mName")
 
-	b, _, err := h.storage.ProcessGetField(mName, mType)
+	m, err := h.storage.Get(mType, mName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, r, err)
 		return
 	}
 
-	w.Write(b)
+	writeValue(w, r, m)
 }
 
 func (h *MetricHandler) UpdateMetricsWJSON(w http.ResponseWriter, r *http.Request) {
-	b, err := io.ReadAll(r.Body)
+	b, err := readBody(r)
 	if err != nil {
-		http.Error(w, http.StatusText(errInternal), errInternal)
+		writeError(w, r, err)
 		return
 	}
 	defer func() {
 		err := r.Body.Close()
 		if err != nil {
-			logger.Error(
+			logger.Ctx(r.Context()).Error(
 				"failed to close request body",
 				zap.Error(err),
 			)
@@ -150,25 +188,41 @@ func (h *MetricHandler) UpdateMetricsWJSON(w http.ResponseWriter, r *http.Reques
 	}
 	err = json.Unmarshal(b, &metrics)
 	if err != nil {
-		http.Error(w, http.StatusText(errBadReq), errBadReq)
+		writeError(w, r, fmt.Errorf("%w: %v", errBadPayload, err))
 		return
 	}
 
-	if err := h.storage.ProcessMetric(metrics); err != nil {
-		switch err {
-		case repository.ErrMetricIsRequired:
-			http.Error(w, err.Error(), http.StatusNotFound)
-		default:
-			http.Error(w, err.Error(), http.StatusBadRequest)
+	// Счетчик может прийти как в поле value, так и в поле delta
+	if metrics.Type == models.Counter && metrics.Value == nil {
+		var delta struct {
+			Delta any `json:"delta"`
+		}
+		if err := json.Unmarshal(b, &delta); err == nil {
+			metrics.Value = delta.Delta
 		}
 	}
 
+	if err := models.CheckReserved(metrics.ID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := h.storage.ProcessMetric(metrics); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	selfStats.observeIngest(1)
+	h.publish(models.MetricRef{ID: metrics.ID, MType: metrics.Type})
+
 	var v any
 	switch metrics.Type {
 	case models.Gauge:
 		v, _ = h.storage.GetField(metrics.ID)
 	case models.Counter:
 		v, _ = h.storage.GetCounter(metrics.ID)
+	case models.Histogram, models.Summary, models.Set:
+		m, _ := h.storage.Get(metrics.Type, metrics.ID)
+		v = models.FormatValue(m)
 	}
 
 	resp := make(map[string]any)
@@ -177,28 +231,29 @@ func (h *MetricHandler) UpdateMetricsWJSON(w http.ResponseWriter, r *http.Reques
 	resp["value"] = v
 
 	b, _ = json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
 	w.Write(b)
 
-	logger.Info(
+	logger.Ctx(r.Context()).Info(
 		"UPDATE",
 		zap.Any("metric", metrics),
 	)
 
-	if h.getStoreInterval() == 0 {
-		h.fm.Write(h.storage.GetAllMetrics())
+	if h.syncWrite() {
+		h.write()
 	}
 }
 
 func (h *MetricHandler) UpdateMetricWJSONv2(w http.ResponseWriter, r *http.Request) {
-	b, err := io.ReadAll(r.Body)
+	b, err := readBody(r)
 	if err != nil {
-		http.Error(w, http.StatusText(errInternal), errInternal)
+		writeError(w, r, err)
 		return
 	}
 	defer func() {
 		err := r.Body.Close()
 		if err != nil {
-			logger.Error(
+			logger.Ctx(r.Context()).Error(
 				"failed to close request body",
 				zap.Error(err),
 			)
@@ -212,7 +267,12 @@ func (h *MetricHandler) UpdateMetricWJSONv2(w http.ResponseWriter, r *http.Reque
 	}
 	err = json.Unmarshal(b, &metrics)
 	if err != nil {
-		http.Error(w, http.StatusText(errBadReq), errBadReq)
+		writeError(w, r, fmt.Errorf("%w: %v", errBadPayload, err))
+		return
+	}
+
+	if err := models.CheckReserved(metrics.ID); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
@@ -226,7 +286,13 @@ func (h *MetricHandler) UpdateMetricWJSONv2(w http.ResponseWriter, r *http.Reque
 
 		err := json.Unmarshal(b, &gMetrics)
 		if err != nil {
-			http.Error(w, http.StatusText(errBadReq), errBadReq)
+			writeError(w, r, fmt.Errorf("%w: %v", errBadPayload, err))
+			return
+		}
+
+		m := models.Metrics{ID: gMetrics.ID, MType: models.Gauge, Value: &gMetrics.Value}
+		if err := m.Validate(); err != nil {
+			writeError(w, r, err)
 			return
 		}
 
@@ -241,27 +307,60 @@ func (h *MetricHandler) UpdateMetricWJSONv2(w http.ResponseWriter, r *http.Reque
 
 		err := json.Unmarshal(b, &cMetrics)
 		if err != nil {
-			http.Error(w, http.StatusText(errBadReq), errBadReq)
+			writeError(w, r, fmt.Errorf("%w: %v", errBadPayload, err))
+			return
+		}
+
+		m := models.Metrics{ID: cMetrics.ID, MType: models.Counter, Delta: &cMetrics.Value}
+		if err := m.Validate(); err != nil {
+			writeError(w, r, err)
 			return
 		}
 
-		h.storage.IncrementCounter(struct {
+		err = h.storage.IncrementCounter(struct {
 			Name  string
 			Delta int64
 		}{Name: cMetrics.ID, Delta: cMetrics.Value})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+	case models.Histogram, models.Summary, models.Set:
+		var m models.Metrics
+		if err := json.Unmarshal(b, &m); err != nil {
+			writeError(w, r, fmt.Errorf("%w: %v", errBadPayload, err))
+			return
+		}
+
+		// ProcessMultyMetrics проверяет метрику и складывает ее с сохраненной
+		if err := h.storage.ProcessMultyMetrics([]models.Metrics{m}); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+	default:
+		writeError(w, r, fmt.Errorf("%w: %s", models.ErrUnknownType, metrics.Type))
+		return
+	}
+	selfStats.observeIngest(1)
+	h.publish(models.MetricRef{ID: metrics.ID, MType: metrics.Type})
+
+	if h.syncWrite() {
+		h.write()
 	}
 }
 
 func (h *MetricHandler) UpdateMultyMetrics(w http.ResponseWriter, r *http.Request) {
-	b, err := io.ReadAll(r.Body)
+	b, err := readBody(r)
 	if err != nil {
-		http.Error(w, http.StatusText(errInternal), errInternal)
+		writeError(w, r, err)
 		return
 	}
 	defer func() {
 		err := r.Body.Close()
 		if err != nil {
-			logger.Error(
+			logger.Ctx(r.Context()).Error(
 				"failed to close request body",
 				zap.Error(err),
 			)
@@ -271,17 +370,36 @@ func (h *MetricHandler) UpdateMultyMetrics(w http.ResponseWriter, r *http.Reques
 	var metrics []models.Metrics
 	err = json.Unmarshal(b, &metrics)
 	if err != nil {
-		http.Error(w, "failed to parse data", errBadReq)
+		writeError(w, r, fmt.Errorf("%w: %v", errBadPayload, err))
+		return
+	}
+
+	if err := limits.checkBatch(len(metrics)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := models.CheckReservedBatch(metrics); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	h.storage.ProcessMultyMetrics(metrics)
+	if err := h.storage.ProcessMultyMetrics(metrics); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	selfStats.observeBatch(len(metrics))
+	h.publish(refsOf(metrics)...)
+
+	if h.syncWrite() {
+		h.write()
+	}
 }
 
 func (h *MetricHandler) GetMetricWJSON(w http.ResponseWriter, r *http.Request) {
-	b, err := io.ReadAll(r.Body)
+	b, err := readBody(r)
 	if err != nil {
-		http.Error(w, "error to read request body", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
@@ -291,7 +409,7 @@ func (h *MetricHandler) GetMetricWJSON(w http.ResponseWriter, r *http.Request) {
 	}
 	err = json.Unmarshal(b, &payload)
 	if err != nil {
-		http.Error(w, http.StatusText(errBadReq), errBadReq)
+		writeError(w, r, fmt.Errorf("%w: %v", errBadPayload, err))
 		return
 	}
 
@@ -304,14 +422,14 @@ func (h *MetricHandler) GetMetricWJSON(w http.ResponseWriter, r *http.Request) {
 		Type: payload.Type,
 	}
 
-	logger.Info(
+	logger.Ctx(r.Context()).Info(
 		"READ",
 		zap.Any("payload", payload),
 	)
 
 	_, v, err := h.storage.ProcessGetField(payload.ID, payload.Type)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, r, err)
 		return
 	}
 
@@ -323,20 +441,22 @@ func (h *MetricHandler) GetMetricWJSON(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *MetricHandler) GetMetricWJSONv2(w http.ResponseWriter, r *http.Request) {
-	b, err := io.ReadAll(r.Body)
+	b, err := readBody(r)
 	if err != nil {
-		http.Error(w, "error to read request body", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
 	var payload struct {
 		ID   string `json:"id"`
 		Type string `json:"type"`
+		// Окно для rate и increase счетчика
+		Window string `json:"window"`
 	}
 
 	err = json.Unmarshal(b, &payload)
 	if err != nil {
-		http.Error(w, http.StatusText(errBadReq), errBadReq)
+		writeError(w, r, fmt.Errorf("%w: %v", errBadPayload, err))
 		return
 	}
 
@@ -344,7 +464,7 @@ func (h *MetricHandler) GetMetricWJSONv2(w http.ResponseWriter, r *http.Request)
 	case models.Gauge:
 		v, ok := h.storage.GetField(payload.ID)
 		if !ok {
-			http.Error(w, "unknown metric", http.StatusNotFound)
+			writeError(w, r, repository.ErrUnknownMetric)
 			return
 		}
 
@@ -359,9 +479,15 @@ func (h *MetricHandler) GetMetricWJSONv2(w http.ResponseWriter, r *http.Request)
 		w.Write(b)
 
 	case models.Counter:
+		window, err := parseWindow(payload.Window)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
 		v, ok := h.storage.GetCounter(payload.ID)
 		if !ok {
-			http.Error(w, "unknown metric", http.StatusNotFound)
+			writeError(w, r, repository.ErrUnknownCounter)
 			return
 		}
 
@@ -370,13 +496,75 @@ func (h *MetricHandler) GetMetricWJSONv2(w http.ResponseWriter, r *http.Request)
 			MType: payload.Type,
 			Delta: &v,
 		}
+		if window > 0 {
+			if rate, ok := h.storage.CounterRate(payload.ID, window, time.Now()); ok {
+				setRate(&resp, rate)
+			}
+		}
 
 		b, _ := json.Marshal(resp)
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(b)
+
+	case models.Histogram, models.Summary, models.Set:
+		m, err := h.storage.Get(payload.Type, payload.ID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		b, _ := json.Marshal(models.ForResponse(m))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+
+	default:
+		writeError(w, r, repository.ErrUnknownMetric)
 	}
 }
 
 func (h *MetricHandler) PingDB(w http.ResponseWriter, r *http.Request) {
-	http.Error(w, "Error: database is not responding", errInternal)
+	writeError(w, r, repository.ErrNoConnection)
+}
+
+// DeleteMetric - DELETE /value/{mType}/{mName}
+func (h *MetricHandler) DeleteMetric(w http.ResponseWriter, r *http.Request) {
+	if err := h.storage.Delete(chi.URLParam(r, "mType"), chi.URLParam(r, "mName")); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	h.persist(r)
+}
+
+// ResetCounter - POST /reset/{mName}
+func (h *MetricHandler) ResetCounter(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "mName")
+	if err := h.storage.ResetCounter(name); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	h.publish(models.MetricRef{ID: name, MType: models.Counter})
+
+	h.persist(r)
+}
+
+// DeleteByPrefix - DELETE /value/?prefix=
+func (h *MetricHandler) DeleteByPrefix(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		writeError(w, r, errEmptyPrefix)
+		return
+	}
+
+	n := h.storage.DeletePrefix(prefix)
+	h.persist(r)
+	writeDeleted(w, r, int64(n))
+}
+
+// persist сразу сбрасывает хранилище в файл независимо от интервала записи,
+// иначе удаленные метрики вернутся после перезапуска
+func (h *MetricHandler) persist(r *http.Request) {
+	if err := h.write(); err != nil {
+		logger.Ctx(r.Context()).Error("failed to write metrics to file", zap.Error(err))
+	}
 }
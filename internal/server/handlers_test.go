@@ -1,19 +1,33 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"metricapp/internal/config"
+	"metricapp/internal/filemanager"
 	"metricapp/internal/logger"
 	models "metricapp/internal/model"
+	"metricapp/internal/repository"
+	"metricapp/internal/utils"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/coder/websocket"
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 )
 
@@ -153,3 +167,554 @@ var cases = []testcase{
 		mValue:       "500",
 	},
 }
+
+func TestMetricHandler_ErrorResponse(t *testing.T) {
+	logger.InitLogger()
+	handler := NewMetricHandler()
+
+	body := bytes.NewReader([]byte(`{"id":"unknown","type":"gauge"}`))
+	request := httptest.NewRequest(http.MethodPost, "/value/", body)
+	w := httptest.NewRecorder()
+	handler.GetMetricWJSONv2(w, request)
+
+	res := w.Result()
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+
+	var apiErr APIError
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&apiErr))
+	assert.Equal(t, http.StatusNotFound, apiErr.Code)
+	assert.NotEmpty(t, apiErr.Message)
+}
+
+func TestDBHandler_UpdateMetricsWJSONCounter(t *testing.T) {
+	logger.InitLogger()
+	handler := &DBHandler{}
+
+	// Значение отвергается до обращения к базе, поэтому соединение не нужно
+	for _, value := range []string{"1.5", "1e300", "-1e300"} {
+		body := strings.NewReader(`{"id":"c","type":"counter","value":` + value + `}`)
+		request := httptest.NewRequest(http.MethodPost, "/update/", body)
+		w := httptest.NewRecorder()
+		handler.UpdateMetricsWJSON(w, request)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, value)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	logger.InitLogger()
+
+	var got string
+	handler := requestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = logger.RequestID(r.Context())
+	}))
+
+	request := httptest.NewRequest(http.MethodGet, "/ping", nil)
+	request.Header.Set(requestIDHeader, "agent-batch-1")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, request)
+	assert.Equal(t, "agent-batch-1", got)
+	assert.Equal(t, "agent-batch-1", w.Header().Get(requestIDHeader))
+
+	// Невалидный идентификатор заменяется сгенерированным
+	request = httptest.NewRequest(http.MethodGet, "/ping", nil)
+	request.Header.Set(requestIDHeader, "bad id\n")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, request)
+	assert.NotEqual(t, "bad id\n", got)
+	assert.NotEmpty(t, got)
+	assert.Equal(t, got, w.Header().Get(requestIDHeader))
+}
+
+func TestAdminOnly(t *testing.T) {
+	handler := adminOnly("secret")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		header       string
+		expectedCode int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+		if tt.header != "" {
+			request.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request)
+		assert.Equal(t, tt.expectedCode, w.Code, tt.header)
+	}
+}
+
+func TestStartAdmin(t *testing.T) {
+	logger.InitLogger()
+	ms := &MetricServer{}
+
+	// Занятый порт - ошибка запуска, а не молча не поднятый pprof
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer busy.Close()
+	_, err = ms.startAdmin(&config.Server{AdminToken: "secret", AdminAddress: busy.Addr().String()}, chi.NewRouter())
+	assert.Error(t, err)
+
+	srv, err := ms.startAdmin(&config.Server{AdminToken: "secret"}, chi.NewRouter())
+	require.NoError(t, err)
+	assert.Nil(t, srv, "without address pprof lives on the main router")
+
+	srv, err = ms.startAdmin(&config.Server{AdminToken: "secret", AdminAddress: "127.0.0.1:0"}, chi.NewRouter())
+	require.NoError(t, err)
+	require.NotNil(t, srv)
+	require.NoError(t, srv.Shutdown(context.Background()))
+	assert.ErrorIs(t, srv.Serve(busy), http.ErrServerClosed)
+}
+
+func TestSelfMetrics(t *testing.T) {
+	logger.InitLogger()
+	handler := NewMetricHandler()
+
+	// Клиент не может писать в зарезервированные метрики
+	body := bytes.NewReader([]byte(`{"id":"_server.batches","type":"counter","delta":1}`))
+	request := httptest.NewRequest(http.MethodPost, "/update/", body)
+	w := httptest.NewRecorder()
+	handler.UpdateMetricWJSONv2(w, request)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	stats := newServerStats()
+	stats.observeBatch(3)
+	stats.observeBatch(5)
+	stats.observeRequest(2 * time.Millisecond)
+	stats.observeRequest(2 * time.Second)
+
+	assert.NoError(t, handler.storeSelfMetrics(context.Background(), stats.snapshot(time.Now(), 0)))
+
+	s := handler.GetStorage()
+	ingested, _ := s.GetCounter("_server.ingested_metrics")
+	assert.Equal(t, int64(8), ingested)
+	batchMax, _ := s.GetField("_server.batch_size_max")
+	assert.Equal(t, float64(5), batchMax)
+	le, _ := s.GetCounter("_server.http_request_duration_le_0.005")
+	assert.Equal(t, int64(1), le)
+	inf, _ := s.GetCounter("_server.http_request_duration_le_+Inf")
+	assert.Equal(t, int64(2), inf)
+
+	// После снимка счетчики начинаются заново
+	next := stats.snapshot(time.Now(), 0)
+	assert.Equal(t, int64(0), *next[0].Delta)
+}
+
+func TestReadyz(t *testing.T) {
+	logger.InitLogger()
+
+	fm, err := filemanager.Open(filepath.Join(t.TempDir(), "metrics.json"), time.Minute)
+	assert.NoError(t, err)
+	defer fm.Close()
+
+	tests := []struct {
+		name         string
+		handler      IHandler
+		expectedCode int
+		checks       []string
+	}{
+		{"memory only", NewMetricHandler(), http.StatusOK, []string{"storage"}},
+		{"file", NewMetricHandlerWfm(fm, false), http.StatusOK, []string{"storage", "file", "snapshot"}},
+		{"db without connection", &DBHandler{}, http.StatusServiceUnavailable, []string{"postgres"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			readyz(tt.handler)(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			assert.Equal(t, tt.expectedCode, w.Code)
+
+			var resp readyResponse
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			for _, c := range tt.checks {
+				assert.Contains(t, resp.Checks, c)
+			}
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(1, 2)
+	now := time.Now()
+
+	ok, _ := rl.allow("ip:a", now)
+	assert.True(t, ok)
+	ok, _ = rl.allow("ip:a", now)
+	assert.True(t, ok)
+	ok, wait := rl.allow("ip:a", now)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+
+	// У другого клиента своя корзина
+	ok, _ = rl.allow("ip:b", now)
+	assert.True(t, ok)
+
+	// Токены восстанавливаются со временем
+	ok, _ = rl.allow("ip:a", now.Add(time.Second))
+	assert.True(t, ok)
+
+	// Клиент определяется по IP, смена X-Agent-ID не дает новой корзины
+	handler := rl.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	var w *httptest.ResponseRecorder
+	for i := range 3 {
+		request := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+		request.Header.Set("X-Agent-ID", strconv.Itoa(i))
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, request)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	// Клиенты сверх maxBuckets делят общую корзину
+	rl = newRateLimiter(1, 1)
+	for i := range maxBuckets {
+		rl.buckets[strconv.Itoa(i)] = &bucket{tokens: 1, last: now}
+	}
+	ok, _ = rl.allow("ip:new1", now)
+	assert.True(t, ok)
+	ok, _ = rl.allow("ip:new2", now)
+	assert.False(t, ok)
+	assert.Len(t, rl.buckets, maxBuckets+1)
+}
+
+func TestIngestLimits(t *testing.T) {
+	logger.InitLogger()
+	def := config.DefaultServer()
+	defer limits.set(&def)
+
+	cfg := config.DefaultServer()
+	cfg.MaxBodySize = 1024
+	cfg.MaxDecompressedSize = 4096
+	cfg.MaxBatchSize = 2
+	limits.set(&cfg)
+
+	handler := limitBody(gzipHandler(http.HandlerFunc(NewMetricHandler().UpdateMultyMetrics)))
+
+	// Тело больше лимита
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(make([]byte, 2048))))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// gzip-бомба: сжатое тело маленькое, распакованное - больше лимита
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(bytes.Repeat([]byte(" "), 1<<20))
+	gz.Close()
+	request := httptest.NewRequest(http.MethodPost, "/updates/", &buf)
+	request.Header.Set("Content-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// Пакет больше лимита
+	body := `[{"id":"a","type":"gauge","value":1},{"id":"b","type":"gauge","value":1},{"id":"c","type":"gauge","value":1}]`
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader([]byte(body))))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
+
+func TestMetricHandler_Delete(t *testing.T) {
+	logger.InitLogger()
+
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	fm, err := filemanager.Open(path, time.Hour)
+	assert.NoError(t, err)
+	defer fm.Close()
+
+	handler := NewMetricHandlerWfm(fm, false)
+	handler.storage.SetField("stale.typo", 1)
+	handler.storage.SetField("stale.other", 2)
+	handler.storage.SetField("alive", 3)
+
+	router := chi.NewRouter()
+	router.Use(adminOnly("secret"))
+	router.Delete("/value/{mType}/{mName}", handler.DeleteMetric)
+	router.Delete("/value/", handler.DeleteByPrefix)
+
+	request := httptest.NewRequest(http.MethodDelete, "/value/?prefix=stale.", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	request.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"deleted":2}`, w.Body.String())
+
+	request = httptest.NewRequest(http.MethodDelete, "/value/gauge/stale.typo", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Удаление сразу попадает в файл, несмотря на интервал записи в час
+	restored, err := filemanager.Open(path, 0)
+	assert.NoError(t, err)
+	defer restored.Close()
+	metrics, err := restored.Read()
+	assert.NoError(t, err)
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, "alive", metrics[0].ID)
+}
+
+func TestMetricHandler_ConcurrentPersist(t *testing.T) {
+	logger.InitLogger()
+
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	fm, err := filemanager.Open(path, time.Hour)
+	require.NoError(t, err)
+	defer fm.Close()
+
+	handler := NewMetricHandlerWfm(fm, false)
+	handler.storage.SetField("alive", 1)
+	for i := range 50 {
+		handler.storage.SetField("stale."+strconv.Itoa(i), 1)
+	}
+
+	router := chi.NewRouter()
+	router.Delete("/value/{mType}/{mName}", handler.DeleteMetric)
+
+	// Удаления из обработчиков идут вперемешку с записью по таймеру
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/value/gauge/stale."+strconv.Itoa(i), nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+		}()
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, fm.Save(handler.storage.GetAllMetrics))
+		}()
+	}
+	wg.Wait()
+
+	// Последним в файле оказывается срез после всех удалений
+	restored, err := filemanager.Open(path, 0)
+	require.NoError(t, err)
+	defer restored.Close()
+	metrics, err := restored.Read()
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "alive", metrics[0].ID)
+}
+
+func TestMetricHandler_ListMetrics(t *testing.T) {
+	logger.InitLogger()
+
+	handler := NewMetricHandler()
+	for _, id := range []string{"app.c", "app.a", "other", "app.b"} {
+		handler.storage.SetField(id, 1)
+	}
+	assert.NoError(t, handler.storage.IncrementCounter(struct {
+		Name  string
+		Delta int64
+	}{Name: "app.a", Delta: 1}))
+
+	// Обходим все метрики app. страницами по две
+	var got []string
+	cursor := ""
+	for range 5 {
+		w := httptest.NewRecorder()
+		handler.ListMetrics(w, httptest.NewRequest(http.MethodGet,
+			"/api/metrics?prefix=app.&limit=2&cursor="+cursor, nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var page listPage
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+		assert.LessOrEqual(t, len(page.Metrics), 2)
+		for _, m := range page.Metrics {
+			got = append(got, m.MType+"/"+m.ID)
+		}
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+	assert.Equal(t, []string{"counter/app.a", "gauge/app.a", "gauge/app.b", "gauge/app.c"}, got)
+
+	for _, q := range []string{"limit=0", "limit=x", "type=bogus", "cursor=!!"} {
+		w := httptest.NewRecorder()
+		handler.ListMetrics(w, httptest.NewRequest(http.MethodGet, "/api/metrics?"+q, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, q)
+	}
+}
+
+func TestHub(t *testing.T) {
+	logger.InitLogger()
+
+	handler := NewMetricHandler()
+	handler.storage.SetField("app.heap", 1)
+
+	h := newHub()
+	load := func(refs []models.MetricRef) []models.Metrics {
+		return handler.storage.GetMany(refs, 0, time.Now())
+	}
+	byID := h.subscribe([]string{"app.heap"}, nil)
+	byPrefix := h.subscribe(nil, []string{"other."})
+
+	h.publish([]models.MetricRef{{ID: "app.heap", MType: models.Gauge}}, load)
+	m := <-byID.ch
+	assert.Equal(t, "app.heap", m.ID)
+	assert.Equal(t, 1.0, *m.Value)
+	assert.Empty(t, byPrefix.ch)
+
+	// Без подписчиков хранилище не читается
+	h.unsubscribe(byID)
+	h.publish([]models.MetricRef{{ID: "app.heap", MType: models.Gauge}}, func([]models.MetricRef) []models.Metrics {
+		t.Fatal("load called without subscribers")
+		return nil
+	})
+
+	// Медленный подписчик отключается с закрытием канала
+	slow := h.subscribe(nil, nil)
+	for range subscriberBuffer + 1 {
+		h.publish([]models.MetricRef{{ID: "app.heap", MType: models.Gauge}}, load)
+	}
+	n := 0
+	for range slow.ch {
+		n++
+	}
+	assert.Equal(t, subscriberBuffer, n)
+}
+
+func TestStream(t *testing.T) {
+	logger.InitLogger()
+
+	handler := NewMetricHandler()
+	router := chi.NewRouter()
+	router.Use(gzipHandler)
+	router.Use(requestLogger)
+	router.Post("/update/{mType}/{mName}/{mValue}", handler.UpdateMetrics)
+	router.Get("/stream", serveStream)
+	router.Get("/ws", serveWebSocket)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	waitSubscribers := func(n int) {
+		assert.Eventually(t, func() bool {
+			updates.mu.RLock()
+			defer updates.mu.RUnlock()
+			return len(updates.subs) == n
+		}, time.Second, time.Millisecond)
+	}
+	update := func(path string) {
+		resp, err := http.Post(srv.URL+path, "text/plain", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// SSE
+	resp, err := http.Get(srv.URL + "/stream?prefix=app.")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, eventStreamType, resp.Header.Get("Content-Type"))
+	waitSubscribers(1)
+
+	update("/update/gauge/other/1")
+	update("/update/counter/app.polls/5")
+	br := bufio.NewReader(resp.Body)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "event: metric\n", line)
+	line, err = br.ReadString('\n')
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id":"app.polls","type":"counter","delta":5}`, strings.TrimPrefix(strings.TrimSpace(line), "data: "))
+
+	// WebSocket
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?id=app.polls", nil)
+	require.NoError(t, err)
+	defer conn.CloseNow()
+	waitSubscribers(2)
+
+	update("/update/counter/app.polls/2")
+	typ, payload, err := conn.Read(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, websocket.MessageText, typ)
+	assert.JSONEq(t, `{"id":"app.polls","type":"counter","delta":7}`, string(payload))
+
+	// Сообщения клиента игнорируются, соединение остается открытым
+	require.NoError(t, conn.Write(ctx, websocket.MessageText, []byte("hello")))
+	update("/update/counter/app.polls/1")
+	_, payload, err = conn.Read(ctx)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id":"app.polls","type":"counter","delta":8}`, string(payload))
+
+	require.NoError(t, conn.Close(websocket.StatusNormalClosure, ""))
+
+	resp.Body.Close()
+	waitSubscribers(0)
+
+	// Без заголовков рукопожатия - 400
+	wsBad, err := http.Get(srv.URL + "/ws")
+	require.NoError(t, err)
+	wsBad.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, wsBad.StatusCode)
+}
+
+// flushRecorder - обработчик с отложенной записью, который запоминает, завершились ли запросы к моменту сброса
+type flushRecorder struct {
+	*MetricHandler
+	served  atomic.Bool
+	flushed atomic.Bool
+	err     error
+}
+
+func (h *flushRecorder) GetStorage() *repository.MemStorage {
+	return nil
+}
+
+func (h *flushRecorder) flushPending(_ context.Context) error {
+	h.flushed.Store(h.served.Load())
+	return h.err
+}
+
+func TestShutdown(t *testing.T) {
+	logger.InitLogger()
+	policy := flushRetryPolicy
+	defer func() { flushRetryPolicy = policy }()
+	flushRetryPolicy = utils.Policy{Initial: time.Millisecond, Max: time.Millisecond, Retries: 2}
+
+	handler := &flushRecorder{MetricHandler: NewMetricHandler()}
+	started := make(chan struct{})
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		handler.served.Store(true)
+	}))
+	srv.Start()
+	defer srv.Close()
+
+	done := make(chan struct{})
+	go func() {
+		resp, err := http.Post(srv.URL, "text/plain", nil)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+		close(done)
+	}()
+
+	// Буфер сбрасывается только после того, как начатый запрос получил ответ
+	<-started
+	assert.Equal(t, 0, shutdown(handler, nil, srv.Config, nil))
+	assert.True(t, handler.flushed.Load())
+	<-done
+
+	// Если сбросить так и не удалось, код выхода ненулевой
+	handler.err = repository.ErrNoConnection
+	assert.Equal(t, 1, shutdown(handler, nil, &http.Server{}))
+}
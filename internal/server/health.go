@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"metricapp/internal/repository"
+	"net/http"
+	"time"
+)
+
+const (
+	statusOK   = "ok"
+	statusFail = "fail"
+
+	// Сколько ждем ответа от хранилища при проверке готовности
+	readyTimeout = 3 * time.Second
+)
+
+var (
+	errSnapshotLag      = errors.New("metrics snapshot is overdue")
+	errMigrationsBehind = errors.New("database schema is behind migrations")
+	errReplicationLag   = errors.New("replication lag exceeds limit")
+)
+
+// checkResult - результат одной проверки готовности
+type checkResult struct {
+	Status  string         `json:"status"`
+	Error   string         `json:"error,omitempty"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// readyResponse - ответ /readyz: общий статус и разбивка по проверкам
+type readyResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+func okCheck(details map[string]any) checkResult {
+	return checkResult{Status: statusOK, Details: details}
+}
+
+func failCheck(err error, details map[string]any) checkResult {
+	return checkResult{Status: statusFail, Error: err.Error(), Details: details}
+}
+
+// healthz отвечает 200, пока процесс жив и обрабатывает запросы
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// readyz проверяет активное хранилище и отвечает 503, если хоть одна проверка не прошла
+func readyz(handler IHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+
+		resp := readyResponse{Status: statusOK, Checks: handler.readiness(ctx)}
+		code := http.StatusOK
+		for _, c := range resp.Checks {
+			if c.Status != statusOK {
+				resp.Status = statusFail
+				code = http.StatusServiceUnavailable
+				break
+			}
+		}
+
+		b, err := json.Marshal(resp)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		w.Write(b)
+	}
+}
+
+// readiness для файлового режима: каталог файла доступен на запись,
+// а последний снимок не отстает больше чем на два интервала записи
+func (h *MetricHandler) readiness(_ context.Context) map[string]checkResult {
+	checks := map[string]checkResult{
+		"storage": okCheck(map[string]any{"backend": "memory"}),
+	}
+	if h.fm == nil {
+		return checks
+	}
+
+	if err := h.fm.CheckWritable(); err != nil {
+		checks["file"] = failCheck(err, nil)
+	} else {
+		checks["file"] = okCheck(nil)
+	}
+
+	interval := h.fm.StoreInterval()
+	lag := time.Since(h.fm.LastWrite())
+	details := map[string]any{
+		"lag_seconds":            lag.Seconds(),
+		"store_interval_seconds": interval.Seconds(),
+	}
+	if interval > 0 && lag > 2*interval {
+		checks["snapshot"] = failCheck(errSnapshotLag, details)
+	} else {
+		checks["snapshot"] = okCheck(details)
+	}
+
+	return checks
+}
+
+// readiness для режима БД: Postgres доступен, схема мигрирована до последней версии,
+// реплика не отстает больше допустимого
+func (h *DBHandler) readiness(ctx context.Context) map[string]checkResult {
+	checks := map[string]checkResult{}
+
+	if err := repository.Ping(ctx); err != nil {
+		checks["postgres"] = failCheck(err, nil)
+		return checks
+	}
+	checks["postgres"] = okCheck(nil)
+
+	current, err := repository.MigrationVersion(ctx)
+	if err != nil {
+		checks["migrations"] = failCheck(err, nil)
+	} else {
+		details := map[string]any{"current": current}
+		expected, err := repository.LatestMigration(h.migrationPath)
+		switch {
+		case err != nil:
+			checks["migrations"] = failCheck(err, details)
+		case current < expected:
+			details["expected"] = expected
+			checks["migrations"] = failCheck(errMigrationsBehind, details)
+		default:
+			details["expected"] = expected
+			checks["migrations"] = okCheck(details)
+		}
+	}
+
+	lag, err := repository.ReplicationLag(ctx)
+	if err != nil {
+		checks["replication"] = failCheck(err, nil)
+	} else {
+		details := map[string]any{"lag_seconds": lag.Seconds()}
+		if h.maxReplicationLag > 0 && lag > h.maxReplicationLag {
+			checks["replication"] = failCheck(errReplicationLag, details)
+		} else {
+			checks["replication"] = okCheck(details)
+		}
+	}
+
+	return checks
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	models "metricapp/internal/model"
+	"strings"
+	"sync"
+)
+
+// Сколько обновлений может скопиться у подписчика. Кто не успевает их разбирать, отключается.
+const subscriberBuffer = 256
+
+// subscription - подписка /stream или /ws на метрики с заданными именами или префиксами.
+// Без имен и префиксов подписка получает все метрики.
+type subscription struct {
+	ids      map[string]struct{}
+	prefixes []string
+	// Закрывается, когда подписчика отключили как медленного
+	ch chan models.Metrics
+}
+
+func (s *subscription) matches(id string) bool {
+	if len(s.ids) == 0 && len(s.prefixes) == 0 {
+		return true
+	}
+	if _, ok := s.ids[id]; ok {
+		return true
+	}
+	for _, p := range s.prefixes {
+		if strings.HasPrefix(id, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deliver кладет подходящие метрики в буфер подписчика, не блокируясь.
+// false - буфер переполнен.
+func (s *subscription) deliver(metrics []models.Metrics) bool {
+	for _, m := range metrics {
+		if !s.matches(m.ID) {
+			continue
+		}
+		select {
+		case s.ch <- m:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// hub рассылает подписчикам свежие значения метрик после каждого успешного обновления
+type hub struct {
+	mu   sync.RWMutex
+	subs map[*subscription]struct{}
+	// Закрывается при остановке сервера, чтобы потоки подписчиков завершились
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// updates получает обновления от обоих обработчиков
+var updates = newHub()
+
+func newHub() *hub {
+	return &hub{
+		subs: make(map[*subscription]struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// shutdown завершает потоки всех подписчиков
+func (h *hub) shutdown() {
+	h.doneOnce.Do(func() { close(h.done) })
+}
+
+func (h *hub) subscribe(ids []string, prefixes []string) *subscription {
+	sub := &subscription{
+		ids:      make(map[string]struct{}, len(ids)),
+		prefixes: prefixes,
+		ch:       make(chan models.Metrics, subscriberBuffer),
+	}
+	for _, id := range ids {
+		sub.ids[id] = struct{}{}
+	}
+
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+
+	return sub
+}
+
+func (h *hub) unsubscribe(sub *subscription) {
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.mu.Unlock()
+}
+
+// publish отправляет подписчикам текущие значения метрик refs.
+// load читает их из хранилища и вызывается, только если на refs кто-то подписан.
+func (h *hub) publish(refs []models.MetricRef, load func([]models.MetricRef) []models.Metrics) {
+	h.mu.RLock()
+	wanted := make([]models.MetricRef, 0, len(refs))
+	for _, ref := range refs {
+		for sub := range h.subs {
+			if sub.matches(ref.ID) {
+				wanted = append(wanted, ref)
+				break
+			}
+		}
+	}
+	h.mu.RUnlock()
+	if len(wanted) == 0 {
+		return
+	}
+
+	metrics := load(wanted)
+	for i, m := range metrics {
+		metrics[i] = models.ForResponse(m)
+	}
+
+	var slow []*subscription
+	h.mu.RLock()
+	for sub := range h.subs {
+		if !sub.deliver(metrics) {
+			slow = append(slow, sub)
+		}
+	}
+	h.mu.RUnlock()
+
+	if len(slow) == 0 {
+		return
+	}
+
+	// Канал закрываем под блокировкой на запись: в него никто не пишет
+	h.mu.Lock()
+	for _, sub := range slow {
+		if _, ok := h.subs[sub]; ok {
+			delete(h.subs, sub)
+			close(sub.ch)
+		}
+	}
+	h.mu.Unlock()
+	selfStats.observeDropped(len(slow))
+}
+
+// refsOf - ссылки на метрики пакета для publish, без повторов
+func refsOf(metrics []models.Metrics) []models.MetricRef {
+	seen := make(map[models.MetricRef]struct{}, len(metrics))
+	refs := make([]models.MetricRef, 0, len(metrics))
+	for _, m := range metrics {
+		ref := models.MetricRef{ID: m.ID, MType: m.MType}
+		if _, ok := seen[ref]; !ok {
+			seen[ref] = struct{}{}
+			refs = append(refs, ref)
+		}
+	}
+
+	return refs
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"metricapp/internal/config"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// errTooLarge - тело запроса или пакет превышают лимит
+	errTooLarge = errors.New("request is too large")
+	// errRateLimited - клиент превысил лимит запросов
+	errRateLimited = errors.New("rate limit exceeded")
+)
+
+// ingestLimits - ограничения на прием метрик. Меняются на лету при перечитывании конфигурации.
+type ingestLimits struct {
+	maxBody         atomic.Int64
+	maxDecompressed atomic.Int64
+	maxBatch        atomic.Int64
+}
+
+// limits действуют для всех обработчиков сервера
+var limits = newIngestLimits()
+
+func newIngestLimits() *ingestLimits {
+	def := config.DefaultServer()
+	l := &ingestLimits{}
+	l.set(&def)
+	return l
+}
+
+func (l *ingestLimits) set(cfg *config.Server) {
+	l.maxBody.Store(cfg.MaxBodySize)
+	l.maxDecompressed.Store(cfg.MaxDecompressedSize)
+	l.maxBatch.Store(int64(cfg.MaxBatchSize))
+}
+
+// checkBatch не дает записать пакет больше допустимого
+func (l *ingestLimits) checkBatch(size int) error {
+	if limit := l.maxBatch.Load(); int64(size) > limit {
+		return fmt.Errorf("%w: batch of %d metrics, limit is %d", errTooLarge, size, limit)
+	}
+
+	return nil
+}
+
+// limitBody ограничивает размер тела запроса до распаковки
+func limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limits.maxBody.Load() {
+			writeError(w, r, fmt.Errorf("%w: body exceeds %d bytes", errTooLarge, limits.maxBody.Load()))
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, limits.maxBody.Load())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maxReader читает не больше n байт и возвращает errTooLarge, если данных больше.
+// Защищает от gzip-бомб: маленькое сжатое тело может распаковаться в гигабайты.
+type maxReader struct {
+	r io.Reader
+	n int64
+}
+
+func (m *maxReader) Read(p []byte) (int, error) {
+	if m.n < 0 {
+		return 0, errTooLarge
+	}
+	if int64(len(p)) > m.n+1 {
+		p = p[:m.n+1]
+	}
+
+	n, err := m.r.Read(p)
+	m.n -= int64(n)
+	if m.n < 0 {
+		return n - 1, fmt.Errorf("%w: decompressed body exceeds limit", errTooLarge)
+	}
+
+	return n, err
+}
+
+// readBody читает тело запроса целиком, ошибки лимитов превращает в errTooLarge
+func readBody(r *http.Request) ([]byte, error) {
+	b, err := io.ReadAll(r.Body)
+	if err == nil {
+		return b, nil
+	}
+
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return nil, fmt.Errorf("%w: body exceeds %d bytes", errTooLarge, maxErr.Limit)
+	}
+	if errors.Is(err, errTooLarge) {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("%w: %v", errBadPayload, err)
+}
+
+// rateLimiter - token bucket на каждого клиента
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+const (
+	// Как часто выбрасываются корзины клиентов, которые давно не приходили
+	sweepInterval = time.Minute
+	// Сколько клиентов помнит лимитер. Новые клиенты сверх этого делят одну общую корзину,
+	// иначе поток запросов с разных адресов раздувал бы память до следующей чистки.
+	maxBuckets = 100_000
+	// Ключ общей корзины
+	overflowKey = "overflow"
+)
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	rl := &rateLimiter{buckets: make(map[string]*bucket)}
+	rl.set(rate, burst)
+	return rl
+}
+
+// set меняет лимит на лету. Накопленные токены клиентов сохраняются.
+func (rl *rateLimiter) set(rate float64, burst int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.rate, rl.burst = rate, float64(burst)
+}
+
+// allow списывает токен клиента. Если токенов нет, возвращает, через сколько появится следующий.
+func (rl *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.rate <= 0 {
+		return true, 0
+	}
+	rl.sweep(now)
+
+	b, ok := rl.buckets[key]
+	if !ok && len(rl.buckets) >= maxBuckets {
+		key = overflowKey
+		b, ok = rl.buckets[key]
+	}
+	if !ok {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep удаляет корзины, которые уже успели наполниться: такие клиенты ничем не отличаются от новых
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < sweepInterval {
+		return
+	}
+	rl.lastSweep = now
+
+	full := time.Duration(rl.burst / rl.rate * float64(time.Second))
+	for key, b := range rl.buckets {
+		if now.Sub(b.last) > full {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// middleware отвечает 429 с Retry-After клиентам, превысившим лимит
+func (rl *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := rl.allow(clientKey(r), time.Now())
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, r, errRateLimited)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientKey определяет клиента по IP. X-Agent-ID для этого не годится: клиент может слать
+// новый идентификатор в каждом запросе и каждый раз получать полную корзину.
+func clientKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	models "metricapp/internal/model"
+	"metricapp/internal/repository"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Размер страницы GET /api/metrics по умолчанию. Больше MAX_BATCH_SIZE не отдается.
+const defaultPageSize = 100
+
+// listPage - ответ GET /api/metrics
+type listPage struct {
+	Metrics []models.Metrics `json:"metrics"`
+	// Курсор следующей страницы, пустой на последней
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// encodeCursor упаковывает последнюю отданную метрику в непрозрачный курсор
+func encodeCursor(ref models.MetricRef) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(ref.MType + "/" + ref.ID))
+}
+
+func decodeCursor(s string) (models.MetricRef, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return models.MetricRef{}, fmt.Errorf("%w: invalid cursor", errBadPayload)
+	}
+
+	mType, id, ok := strings.Cut(string(b), "/")
+	if !ok || id == "" {
+		return models.MetricRef{}, fmt.Errorf("%w: invalid cursor", errBadPayload)
+	}
+
+	return models.MetricRef{ID: id, MType: mType}, nil
+}
+
+// parseListOptions разбирает ?type=&prefix=&limit=&cursor=.
+// Запрашивается на одну метрику больше страницы, чтобы понять, есть ли следующая.
+func parseListOptions(r *http.Request) (repository.ListOptions, error) {
+	q := r.URL.Query()
+	opts := repository.ListOptions{
+		Type:   q.Get("type"),
+		Prefix: q.Get("prefix"),
+		Limit:  defaultPageSize,
+	}
+
+	if opts.Type != "" {
+		if err := models.ValidateType(opts.Type); err != nil {
+			return opts, err
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return opts, fmt.Errorf("%w: limit must be a positive integer", errBadPayload)
+		}
+		opts.Limit = n
+	}
+	opts.Limit = min(opts.Limit, int(limits.maxBatch.Load()))
+	if s := q.Get("cursor"); s != "" {
+		after, err := decodeCursor(s)
+		if err != nil {
+			return opts, err
+		}
+		opts.After = after
+	}
+
+	opts.Limit++
+	return opts, nil
+}
+
+// writePage отдает страницу и курсор на следующую, если метрик больше limit
+func writePage(w http.ResponseWriter, r *http.Request, metrics []models.Metrics, limit int) {
+	page := listPage{Metrics: make([]models.Metrics, 0, min(len(metrics), limit))}
+	if len(metrics) > limit {
+		metrics = metrics[:limit]
+		last := metrics[limit-1]
+		page.NextCursor = encodeCursor(models.MetricRef{ID: last.ID, MType: last.MType})
+	}
+	for _, m := range metrics {
+		page.Metrics = append(page.Metrics, models.ForResponse(m))
+	}
+
+	b, err := json.Marshal(page)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to marshal metrics: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// ListMetrics - GET /api/metrics
+func (h *MetricHandler) ListMetrics(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseListOptions(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writePage(w, r, h.storage.List(opts, time.Now()), opts.Limit-1)
+}
+
+// ListMetrics - GET /api/metrics
+func (h *DBHandler) ListMetrics(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseListOptions(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	metrics, err := repository.List(r.Context(), opts)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writePage(w, r, metrics, opts.Limit-1)
+}
@@ -2,6 +2,9 @@ package server
 
 import (
 	"compress/gzip"
+	"crypto/subtle"
+	"fmt"
+	"io"
 	"metricapp/internal/logger"
 	"net/http"
 	"strings"
@@ -16,19 +19,19 @@ func gzipHandler(next http.Handler) http.Handler {
 		if strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
 			gz, err := gzip.NewReader(r.Body)
 			if err != nil {
-				http.Error(w, "invalid gzip body", http.StatusBadRequest)
+				writeError(w, r, fmt.Errorf("%w: invalid gzip body", errBadPayload))
 				return
 			}
 			defer func() {
 				err := gz.Close()
 				if err != nil {
-					logger.Error(
+					logger.Ctx(r.Context()).Error(
 						"failed to close gzip reader",
 						zap.Error(err),
 					)
 				}
 			}()
-			r.Body = gz
+			r.Body = io.NopCloser(&maxReader{r: gz, n: limits.maxDecompressed.Load()})
 		}
 
 		// Обработка gzip-ответа, если клиент поддерживает
@@ -49,15 +52,52 @@ func gzipHandler(next http.Handler) http.Handler {
 	})
 }
 
+const (
+	requestIDHeader = "X-Request-ID"
+	maxRequestIDLen = 128
+)
+
+// requestID берет идентификатор запроса из заголовка X-Request-ID или генерирует новый,
+// кладет его в контекст и возвращает клиенту в том же заголовке
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = logger.NewRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logger.WithRequestID(r.Context(), id)))
+	})
+}
+
+// validRequestID не дает клиенту протащить в логи мусор вместо идентификатора
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
 func requestLogger(next http.Handler) http.Handler {
 	logFn := func(w http.ResponseWriter, r *http.Request) {
 		uri := r.RequestURI
 		method := r.Method
+		log := logger.RequestLog(r.Context())
 
 		start := time.Now()
 		responseData := &responseData{
-			status: 0,
+			status: http.StatusOK,
 			size:   0,
+			// Тело ответа копируем только если оно попадет в лог
+			captureBody: log.Core().Enabled(zap.DebugLevel),
 		}
 		lw := loggingResponseWriter{
 			ResponseWriter: w,
@@ -65,17 +105,37 @@ func requestLogger(next http.Handler) http.Handler {
 		}
 		next.ServeHTTP(&lw, r)
 		duration := time.Since(start)
+		selfStats.observeRequest(duration)
 
-		logger.Info(
-			"Request log",
+		fields := []zap.Field{
 			zap.String("URI", uri),
 			zap.String("Method", method),
 			zap.Duration("Duration", duration),
 			zap.Int("Status", responseData.status),
 			zap.Int("Response size", responseData.size),
-			zap.String("Resp", responseData.msg),
-		)
+		}
+		if responseData.captureBody {
+			log.Debug("Request log", append(fields, zap.String("Resp", responseData.msg))...)
+			return
+		}
+
+		log.Info("Request log", fields...)
 	}
 
 	return http.HandlerFunc(logFn)
 }
+
+// adminOnly пускает к служебным эндпоинтам только с заголовком Authorization: Bearer <token>
+func adminOnly(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				writeError(w, r, errUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
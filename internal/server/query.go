@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	models "metricapp/internal/model"
+	"metricapp/internal/query"
+	"metricapp/internal/repository"
+	"net/http"
+)
+
+// queryRequest - тело POST /query
+type queryRequest struct {
+	Query string `json:"query"`
+}
+
+// serveQuery разбирает запрос и вычисляет его по метрикам из src
+func serveQuery(w http.ResponseWriter, r *http.Request, src query.Source) {
+	b, err := readBody(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var req queryRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		writeError(w, r, fmt.Errorf("%w: %v", errBadPayload, err))
+		return
+	}
+
+	q, err := query.Parse(req.Query)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	res, err := q.Eval(r.Context(), src)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	b, err = json.Marshal(res)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to marshal query result: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// Query - POST /query
+func (h *MetricHandler) Query(w http.ResponseWriter, r *http.Request) {
+	serveQuery(w, r, func(_ context.Context, prefix string) ([]models.Metrics, error) {
+		return h.storage.SelectPrefix(prefix), nil
+	})
+}
+
+// Query - POST /query
+func (h *DBHandler) Query(w http.ResponseWriter, r *http.Request) {
+	serveQuery(w, r, repository.SelectPrefix)
+}
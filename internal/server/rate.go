@@ -0,0 +1,29 @@
+package server
+
+import (
+	"fmt"
+	models "metricapp/internal/model"
+	"metricapp/internal/repository"
+	"time"
+)
+
+// parseWindow разбирает окно rate и increase из запроса /value/ ("30s", "5m").
+// Пустое окно - окно по умолчанию, 0 в ответе - история счетчиков выключена.
+func parseWindow(s string) (time.Duration, error) {
+	var window time.Duration
+	if s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return 0, fmt.Errorf("%w: window must be a positive duration", errBadPayload)
+		}
+		window = d
+	}
+
+	return repository.CounterWindow(window)
+}
+
+// setRate дописывает в ответ прирост и скорость счетчика
+func setRate(m *models.Metrics, r repository.Rate) {
+	m.Increase = &r.Increase
+	m.Rate = &r.PerSec
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	models "metricapp/internal/model"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Границы корзин гистограммы длительности запросов, в секундах
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// selfStats копит собственные показатели сервера между записями в хранилище
+var selfStats = newServerStats()
+
+// serverStats - счетчики сервера за текущий интервал
+type serverStats struct {
+	mu sync.Mutex
+
+	since    time.Time
+	ingested int64
+	batches  int64
+	batchSum int64
+	batchMax int64
+
+	requests   int64
+	latencySum time.Duration
+	// Последний элемент - корзина +Inf
+	latency []int64
+
+	// Подписчики /stream и /ws, отключенные за медленное чтение
+	dropped int64
+}
+
+func newServerStats() *serverStats {
+	return &serverStats{
+		since:   time.Now(),
+		latency: make([]int64, len(latencyBuckets)+1),
+	}
+}
+
+// observeIngest учитывает метрики, записанные по одной
+func (s *serverStats) observeIngest(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ingested += int64(n)
+}
+
+// observeBatch учитывает записанный пакет
+func (s *serverStats) observeBatch(size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ingested += int64(size)
+	s.batches++
+	s.batchSum += int64(size)
+	s.batchMax = max(s.batchMax, int64(size))
+}
+
+// observeRequest учитывает длительность обработанного запроса
+func (s *serverStats) observeRequest(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	s.latencySum += d
+	for i, b := range latencyBuckets {
+		if d.Seconds() <= b {
+			s.latency[i]++
+		}
+	}
+	s.latency[len(latencyBuckets)]++
+}
+
+// observeDropped учитывает отключенных медленных подписчиков
+func (s *serverStats) observeDropped(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dropped += int64(n)
+}
+
+// snapshot собирает метрики за интервал и обнуляет счетчики.
+// Счетчики отдаются приращениями, gauge - значениями за интервал.
+// Корзины гистограммы кумулятивные: le_0.01 включает все запросы быстрее 10мс.
+func (s *serverStats) snapshot(now time.Time, storageSize int) []models.Metrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elapsed := now.Sub(s.since).Seconds()
+	var rate, batchAvg, latencyAvg float64
+	if elapsed > 0 {
+		rate = float64(s.ingested) / elapsed
+	}
+	if s.batches > 0 {
+		batchAvg = float64(s.batchSum) / float64(s.batches)
+	}
+	if s.requests > 0 {
+		latencyAvg = s.latencySum.Seconds() / float64(s.requests)
+	}
+
+	metrics := []models.Metrics{
+		models.ComposeMetrics(selfName("ingested_metrics"), models.Counter, 0, s.ingested),
+		models.ComposeMetrics(selfName("ingestion_rate"), models.Gauge, rate, 0),
+		models.ComposeMetrics(selfName("batches"), models.Counter, 0, s.batches),
+		models.ComposeMetrics(selfName("batch_size_avg"), models.Gauge, batchAvg, 0),
+		models.ComposeMetrics(selfName("batch_size_max"), models.Gauge, float64(s.batchMax), 0),
+		models.ComposeMetrics(selfName("storage_size"), models.Gauge, float64(storageSize), 0),
+		models.ComposeMetrics(selfName("http_requests"), models.Counter, 0, s.requests),
+		models.ComposeMetrics(selfName("http_request_duration_avg"), models.Gauge, latencyAvg, 0),
+		models.ComposeMetrics(selfName("stream_dropped"), models.Counter, 0, s.dropped),
+	}
+	for i, n := range s.latency {
+		le := "+Inf"
+		if i < len(latencyBuckets) {
+			le = strconv.FormatFloat(latencyBuckets[i], 'f', -1, 64)
+		}
+		metrics = append(metrics, models.ComposeMetrics(
+			selfName("http_request_duration_le_"+le), models.Counter, 0, n,
+		))
+	}
+
+	s.since = now
+	s.ingested, s.batches, s.batchSum, s.batchMax = 0, 0, 0, 0
+	s.requests, s.latencySum = 0, 0
+	s.dropped = 0
+	clear(s.latency)
+
+	return metrics
+}
+
+func selfName(name string) string {
+	return models.ReservedPrefix + name
+}
@@ -2,11 +2,17 @@ package server
 
 import (
 	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"metricapp/internal/config"
 	"metricapp/internal/filemanager"
 	"metricapp/internal/logger"
+	models "metricapp/internal/model"
 	"metricapp/internal/repository"
-	"metricapp/internal/server/cfg"
+	"metricapp/internal/utils"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,10 +20,20 @@ import (
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"go.uber.org/zap"
 )
 
-type MetricServer struct{}
+type MetricServer struct {
+	// Reload заново читает конфигурацию по SIGHUP. Если nil, SIGHUP игнорируется.
+	Reload func() (*config.Server, error)
+}
+
+// Ключи конфигурации, которые применяются без перезапуска
+var liveServerKeys = []string{
+	"store_interval", "log", "metric_ttl", "counter_history", "counter_window", "cache_size", "cache_ttl",
+	"max_body_size", "max_decompressed_size", "max_batch_size", "rate_limit", "rate_burst",
+}
 
 type IHandler interface {
 	UpdateMetrics(http.ResponseWriter, *http.Request)
@@ -27,30 +43,56 @@ type IHandler interface {
 	UpdateMultyMetrics(http.ResponseWriter, *http.Request)
 	GetMetricWJSON(http.ResponseWriter, *http.Request)
 	GetMetricWJSONv2(http.ResponseWriter, *http.Request)
+	GetMetrics(http.ResponseWriter, *http.Request)
+	ListMetrics(http.ResponseWriter, *http.Request)
 	PingDB(http.ResponseWriter, *http.Request)
-	getStoreInterval() int
+	DeleteMetric(http.ResponseWriter, *http.Request)
+	ResetCounter(http.ResponseWriter, *http.Request)
+	DeleteByPrefix(http.ResponseWriter, *http.Request)
+	Query(http.ResponseWriter, *http.Request)
 	GetStorage() *repository.MemStorage
+
+	// Запись собственных метрик сервера в обход проверки зарезервированного префикса
+	storeSelfMetrics(context.Context, []models.Metrics) error
+	storageSize(context.Context) (int, error)
+	// Проверки готовности активного хранилища для /readyz
+	readiness(context.Context) map[string]checkResult
+	// Удаление метрик, устаревших по TTL
+	expire(context.Context) (int64, error)
+	// Запись отложенных обновлений, вызывается при остановке
+	flushPending(context.Context) error
 }
 
-func (ms *MetricServer) Start() {
-	cfg.LoadConfig()
-	logger.InitLogger()
+func (ms *MetricServer) Start(cfg *config.Server) {
+	if err := logger.Init(cfg.Log); err != nil {
+		log.Fatal("failed to init logger: ", err)
+	}
 
-	fm, err := filemanager.Open(cfg.Cfg.FileStoragePath, cfg.Cfg.StoreInterval)
+	fm, err := filemanager.Open(cfg.FileStoragePath, cfg.StoreInterval.Duration)
 	if err != nil {
 		log.Fatal("failed to open log file: ", err)
 	}
 
 	var handler IHandler
-	if cfg.Cfg.DSN == "" {
-		handler = NewMetricHandlerWfm(fm, cfg.Cfg.Restore)
+	if cfg.DSN == "" {
+		handler = NewMetricHandlerWfm(fm, cfg.Restore)
 		logger.Info("file")
 	} else {
-		handler = NewDBHandler(cfg.Cfg.DSN, cfg.Cfg.MigrationPath)
+		dbHandler := NewDBHandler(cfg.DSN, cfg.MigrationPath)
+		dbHandler.maxReplicationLag = cfg.MaxReplicationLag.Duration
+		if cfg.WriteBehindInterval.Duration > 0 {
+			dbHandler.enableWriteBehind(cfg.WriteBehindInterval.Duration, cfg.WriteBehindSize)
+		}
+		handler = dbHandler
 		logger.Info("db")
 	}
 
+	limits.set(cfg)
+	limiter := newRateLimiter(cfg.RateLimit, cfg.RateBurst)
+
 	router := chi.NewRouter()
+	router.Use(requestID)
+	router.Use(limitBody)
 	router.Use(gzipHandler)
 	router.Use(requestLogger)
 
@@ -60,58 +102,338 @@ func (ms *MetricServer) Start() {
 			w.Write([]byte("Some text"))
 		})
 
-		r.Post("/update/{mType}/{mName}/{mValue}", handler.UpdateMetrics)
-		r.Get("/value/{mType}/{mName}", handler.GetMetric)
+		// Лимит запросов действует только на прием метрик
+		r.Group(func(r chi.Router) {
+			r.Use(limiter.middleware)
+			r.Post("/update/{mType}/{mName}/{mValue}", handler.UpdateMetrics)
+			r.Post("/update/", handler.UpdateMetricWJSONv2)
+			r.Post("/updates/", handler.UpdateMultyMetrics)
+		})
 
-		r.Post("/update/", handler.UpdateMetricWJSONv2)
-		r.Post("/updates/", handler.UpdateMultyMetrics)
+		r.Get("/value/{mType}/{mName}", handler.GetMetric)
 		r.Post("/value/", handler.GetMetricWJSONv2)
+		r.Post("/values/", handler.GetMetrics)
+		r.Get("/api/metrics", handler.ListMetrics)
+		r.Post("/query", handler.Query)
+		r.Get("/stream", serveStream)
+		r.Get("/ws", serveWebSocket)
 
 		r.Get("/ping", handler.PingDB)
+		r.Get("/healthz", healthz)
+		r.Get("/readyz", readyz(handler))
+
+		// Удаление и сброс метрик доступны только с токеном администратора
+		if cfg.AdminToken != "" {
+			r.Group(func(r chi.Router) {
+				r.Use(adminOnly(cfg.AdminToken))
+				r.Delete("/value/{mType}/{mName}", handler.DeleteMetric)
+				r.Delete("/value/", handler.DeleteByPrefix)
+				r.Post("/reset/{mName}", handler.ResetCounter)
+			})
+		}
 	})
 
+	adminSrv, err := ms.startAdmin(cfg, router)
+	if err != nil {
+		log.Fatal("failed to start admin server: ", err)
+	}
+
 	logger.Info(
 		"Start listening",
-		zap.String("port", cfg.Cfg.Address),
+		zap.String("port", cfg.Address),
 	)
 
-	go http.ListenAndServe(cfg.Cfg.Address, router)
+	srv := &http.Server{Addr: cfg.Address, Handler: router}
+	// Shutdown не ждет потоки /stream и /ws: они бесконечны, их останавливает хаб
+	srv.RegisterOnShutdown(updates.shutdown)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("server stopped", zap.Error(err))
+		}
+	}()
 	defer fm.Close()
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	var tickerC <-chan time.Time // STORE_INTERVAL = 0 -> tickerC = nil -> не будет тикать
-	if handler.getStoreInterval() != 0 {
-		ticker := time.NewTicker(time.Duration(handler.getStoreInterval()) * time.Second)
-		tickerC = ticker.C
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// STORE_INTERVAL = 0 или хранилище в БД -> tickerC = nil -> не будет тикать
+	var (
+		ticker  *time.Ticker
+		tickerC <-chan time.Time
+	)
+	resetTicker := func(d time.Duration) {
+		if ticker != nil {
+			ticker.Stop()
+			ticker, tickerC = nil, nil
+		}
+		if handler.GetStorage() != nil && d > 0 {
+			ticker = time.NewTicker(d)
+			tickerC = ticker.C
+		}
+	}
+	resetTicker(cfg.StoreInterval.Duration)
+
+	repository.SetTTL(cfg.MetricTTL.Duration)
+	repository.SetCounterHistory(cfg.CounterHistory.Duration, cfg.CounterWindow.Duration)
+	repository.SetCache(cfg.CacheSize, cfg.CacheTTL.Duration)
+	var (
+		janitor  *time.Ticker
+		janitorC <-chan time.Time
+	)
+	resetJanitor := func(ttl time.Duration) {
+		if janitor != nil {
+			janitor.Stop()
+			janitor, janitorC = nil, nil
+		}
+		if ttl > 0 {
+			janitor = time.NewTicker(janitorInterval(ttl))
+			janitorC = janitor.C
+		}
+	}
+	resetJanitor(cfg.MetricTTL.Duration)
+
+	var selfTickerC <-chan time.Time
+	if cfg.SelfMetricsInterval.Duration > 0 {
+		selfTicker := time.NewTicker(cfg.SelfMetricsInterval.Duration)
+		defer selfTicker.Stop()
+		selfTickerC = selfTicker.C
 	}
 
+	exitCode := 0
 outerLoop:
 	for {
 		select {
 		case <-tickerC:
 			s := handler.GetStorage()
 			if s != nil {
-				fm.Write(s.GetAllMetrics())
+				fm.Save(s.GetAllMetrics)
 			}
-		case <-sigs:
-			s := handler.GetStorage()
-			if s != nil {
-				fm.Write(s.GetAllMetrics())
+		case now := <-selfTickerC:
+			flushSelfMetrics(handler, now)
+		case <-janitorC:
+			expireMetrics(handler)
+		case <-hup:
+			newCfg := ms.reload(cfg)
+			if newCfg == nil {
+				continue
+			}
+			if newCfg.StoreInterval != cfg.StoreInterval {
+				fm.SetStoreInterval(newCfg.StoreInterval.Duration)
+				resetTicker(newCfg.StoreInterval.Duration)
 			}
-			logger.Info("exiting gracefully")
+			if newCfg.MetricTTL != cfg.MetricTTL {
+				repository.SetTTL(newCfg.MetricTTL.Duration)
+				resetJanitor(newCfg.MetricTTL.Duration)
+			}
+			repository.SetCounterHistory(newCfg.CounterHistory.Duration, newCfg.CounterWindow.Duration)
+			repository.SetCache(newCfg.CacheSize, newCfg.CacheTTL.Duration)
+			limits.set(newCfg)
+			limiter.set(newCfg.RateLimit, newCfg.RateBurst)
+			cfg = newCfg
+		case <-sigs:
+			exitCode = shutdown(handler, fm, srv, adminSrv)
 			break outerLoop
 		}
 	}
 
-	os.Exit(0)
+	os.Exit(exitCode)
+}
+
+// Сколько ждать завершения начатых запросов при остановке
+const shutdownTimeout = 10 * time.Second
+
+// shutdown перестает принимать запросы, дожидается начатых и только потом сохраняет данные.
+// Иначе обновление, подтвержденное клиенту после сохранения, пропало бы при выходе.
+// Останавливает все servers (nil пропускаются). Возвращает код выхода: 1, если сохранить не удалось.
+func shutdown(handler IHandler, fm *filemanager.FManager, servers ...*http.Server) int {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, srv := range servers {
+		if srv == nil {
+			continue
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Error("failed to finish requests before exit", zap.String("address", srv.Addr), zap.Error(err))
+		}
+	}
+
+	code := 0
+	if s := handler.GetStorage(); s != nil {
+		if err := fm.Save(s.GetAllMetrics); err != nil {
+			logger.Error("failed to save metrics on exit", zap.Error(err))
+			code = 1
+		}
+	}
+	if err := flushPending(handler); err != nil {
+		logger.Error("failed to flush buffered metrics on exit, they are lost", zap.Error(err))
+		code = 1
+	}
+
+	if code == 0 {
+		logger.Info("exiting gracefully")
+	}
+	return code
+}
+
+// startAdmin подключает pprof под /debug/. Без токена служебные эндпоинты не поднимаются,
+// без отдельного адреса они висят на основном роутере. С отдельным адресом возвращает его сервер
+// для остановки; адрес занимается сразу, чтобы занятый порт не остался незамеченным.
+func (ms *MetricServer) startAdmin(cfg *config.Server, router chi.Router) (*http.Server, error) {
+	if cfg.AdminToken == "" {
+		return nil, nil
+	}
+
+	admin := router
+	if cfg.AdminAddress != "" {
+		admin = chi.NewRouter()
+		admin.Use(requestID)
+		admin.Use(requestLogger)
+	}
+	admin.With(adminOnly(cfg.AdminToken)).Mount("/debug", middleware.Profiler())
+
+	if cfg.AdminAddress == "" {
+		return nil, nil
+	}
+
+	ln, err := net.Listen("tcp", cfg.AdminAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen %s: %w", cfg.AdminAddress, err)
+	}
+
+	logger.Info("Start admin listening", zap.String("port", cfg.AdminAddress))
+	srv := &http.Server{Addr: cfg.AdminAddress, Handler: admin}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("admin server stopped", zap.Error(err))
+		}
+	}()
+
+	return srv, nil
+}
+
+// Повторы последнего сброса буфера: база может быть ненадолго недоступна
+var flushRetryPolicy = utils.Policy{
+	Initial: time.Second,
+	Max:     5 * time.Second,
+	Retries: 5,
+}
+
+// flushPending дописывает в базу отложенные обновления перед выходом, повторяя при ошибках.
+// Несохраненное при ошибке остается в буфере, так что повтор пишет все заново.
+func flushPending(handler IHandler) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	p := flushRetryPolicy
+	p.OnRetry = func(attempt int, err error, wait time.Duration) {
+		logger.Warn("failed to flush buffered metrics, retrying",
+			zap.Int("attempt", attempt),
+			zap.Duration("wait", wait),
+			zap.Error(err),
+		)
+	}
+
+	_, err := utils.Retry(ctx, p, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, handler.flushPending(ctx)
+	})
+	return err
+}
+
+// flushSelfMetrics пишет накопленные за интервал показатели сервера в его же хранилище
+func flushSelfMetrics(handler IHandler, now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	size, err := handler.storageSize(ctx)
+	if err != nil {
+		logger.Warn("failed to get storage size", zap.Error(err))
+	}
+
+	if err := handler.storeSelfMetrics(ctx, selfStats.snapshot(now, size)); err != nil {
+		logger.Error("failed to store self metrics", zap.Error(err))
+	}
+}
+
+// janitorInterval - как часто искать устаревшие метрики: в четыре раза чаще TTL,
+// но не чаще раза в секунду и не реже раза в минуту
+func janitorInterval(ttl time.Duration) time.Duration {
+	return min(max(ttl/4, time.Second), time.Minute)
+}
+
+// expireMetrics удаляет метрики, которые не обновлялись дольше TTL
+func expireMetrics(handler IHandler) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	n, err := handler.expire(ctx)
+	if err != nil {
+		logger.Error("failed to expire metrics", zap.Error(err))
+		return
+	}
+	if n > 0 {
+		logger.Info("expired stale metrics", zap.Int64("count", n))
+	}
+}
+
+// reload перечитывает конфигурацию и применяет то, что можно применить на лету.
+// Возвращает конфигурацию, в которой ключи, требующие перезапуска, оставлены прежними,
+// или nil, если применять нечего.
+func (ms *MetricServer) reload(cfg *config.Server) *config.Server {
+	if ms.Reload == nil {
+		logger.Warn("configuration reload is not supported")
+		return nil
+	}
+
+	newCfg, err := ms.Reload()
+	if err != nil {
+		logger.Error("failed to reload configuration", zap.Error(err))
+		return nil
+	}
+
+	apply, restart := config.SplitKeys(config.ChangedKeys(cfg, newCfg), liveServerKeys...)
+	if len(restart) > 0 {
+		logger.Warn("configuration keys require restart", zap.Strings("keys", restart))
+	}
+	if len(apply) == 0 {
+		logger.Info("configuration reloaded, nothing to apply")
+		return nil
+	}
+
+	if newCfg.Log != cfg.Log {
+		if err := logger.Init(newCfg.Log); err != nil {
+			logger.Error("failed to apply logger configuration", zap.Error(err))
+			newCfg.Log = cfg.Log
+		}
+	}
+
+	// Оставляем прежними значения, которые без перезапуска не применятся
+	applied := *cfg
+	applied.StoreInterval = newCfg.StoreInterval
+	applied.Log = newCfg.Log
+	applied.MetricTTL = newCfg.MetricTTL
+	applied.CounterHistory = newCfg.CounterHistory
+	applied.CounterWindow = newCfg.CounterWindow
+	applied.CacheSize = newCfg.CacheSize
+	applied.CacheTTL = newCfg.CacheTTL
+	applied.MaxBodySize = newCfg.MaxBodySize
+	applied.MaxDecompressedSize = newCfg.MaxDecompressedSize
+	applied.MaxBatchSize = newCfg.MaxBatchSize
+	applied.RateLimit = newCfg.RateLimit
+	applied.RateBurst = newCfg.RateBurst
+
+	logger.Info("configuration reloaded", zap.Strings("applied", apply))
+	return &applied
 }
 
 type (
 	responseData struct {
-		status int
-		size   int
-		msg    string
+		status      int
+		size        int
+		msg         string
+		captureBody bool
 	}
 
 	loggingResponseWriter struct {
@@ -123,7 +445,10 @@ type (
 func (r *loggingResponseWriter) Write(b []byte) (int, error) {
 	size, err := r.ResponseWriter.Write(b)
 	r.responseData.size += size
-	r.responseData.msg = string(b)
+	// Поток /stream бесконечен, копить его для лога нельзя
+	if r.responseData.captureBody && r.Header().Get("Content-Type") != eventStreamType {
+		r.responseData.msg += string(b)
+	}
 	return size, err
 }
 
@@ -132,6 +457,11 @@ func (r *loggingResponseWriter) WriteHeader(statusCode int) {
 	r.responseData.status = statusCode
 }
 
+// Unwrap дает http.ResponseController добраться до Flush и Hijack (/stream, /ws)
+func (r *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 type gzipResponseWriter struct {
 	http.ResponseWriter
 	Writer *gzip.Writer
@@ -140,3 +470,16 @@ type gzipResponseWriter struct {
 func (w gzipResponseWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
+
+// FlushError отправляет клиенту все, что накопилось в gzip, для потоковых ответов
+func (w gzipResponseWriter) FlushError() error {
+	if err := w.Writer.Flush(); err != nil {
+		return err
+	}
+
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"metricapp/internal/logger"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Как часто слать в поток keepalive, чтобы прокси не закрывали простаивающее соединение
+const streamKeepAlive = 15 * time.Second
+
+const eventStreamType = "text/event-stream"
+
+// subscribeRequest подписывает на метрики из ?id=&prefix= (оба можно повторять)
+func subscribeRequest(r *http.Request) *subscription {
+	q := r.URL.Query()
+	return updates.subscribe(q["id"], q["prefix"])
+}
+
+// serveStream - GET /stream, обновления метрик в формате Server-Sent Events.
+// Каждое обновление приходит событием metric с метрикой в JSON, как в ответе POST /value/.
+// Медленный подписчик получает событие dropped, после чего поток закрывается.
+func serveStream(w http.ResponseWriter, r *http.Request) {
+	sub := subscribeRequest(r)
+	defer updates.unsubscribe(sub)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", eventStreamType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		logger.Ctx(r.Context()).Error("streaming is not supported", zap.Error(err))
+		return
+	}
+
+	keepalive := time.NewTicker(streamKeepAlive)
+	defer keepalive.Stop()
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-updates.done:
+			return
+		case m, ok := <-sub.ch:
+			if !ok {
+				fmt.Fprint(w, "event: dropped\ndata: slow consumer\n\n")
+				rc.Flush()
+				return
+			}
+
+			b, _ := json.Marshal(m)
+			_, err = fmt.Fprintf(w, "event: metric\ndata: %s\n\n", b)
+		case <-keepalive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		}
+
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	models "metricapp/internal/model"
+	"metricapp/internal/repository"
+	"net/http"
+	"time"
+)
+
+// valuesRequest - тело POST /values/: список метрик или фильтр по типу и префиксу.
+// Список можно прислать и просто массивом [{"id":..,"type":..}].
+type valuesRequest struct {
+	Metrics []models.MetricRef `json:"metrics"`
+	Type    string             `json:"type"`
+	Prefix  string             `json:"prefix"`
+	// Окно для rate и increase счетчиков
+	Window string `json:"window"`
+}
+
+// parseValuesRequest читает и проверяет запрос POST /values/
+func parseValuesRequest(r *http.Request) (valuesRequest, time.Duration, error) {
+	var req valuesRequest
+
+	b, err := readBody(r)
+	if err != nil {
+		return req, 0, err
+	}
+
+	if b = bytes.TrimSpace(b); len(b) > 0 && b[0] == '[' {
+		err = json.Unmarshal(b, &req.Metrics)
+	} else {
+		err = json.Unmarshal(b, &req)
+	}
+	if err != nil {
+		return req, 0, fmt.Errorf("%w: %v", errBadPayload, err)
+	}
+
+	if len(req.Metrics) > 0 && (req.Type != "" || req.Prefix != "") {
+		return req, 0, fmt.Errorf("%w: either metrics or type and prefix filter must be set", errBadPayload)
+	}
+	if err := limits.checkBatch(len(req.Metrics)); err != nil {
+		return req, 0, err
+	}
+	if req.Type != "" {
+		if err := models.ValidateType(req.Type); err != nil {
+			return req, 0, err
+		}
+	}
+
+	window, err := parseWindow(req.Window)
+	if err != nil {
+		return req, 0, err
+	}
+
+	return req, window, nil
+}
+
+// writeMetrics отдает метрики массивом в том же виде, что и POST /value/
+func writeMetrics(w http.ResponseWriter, r *http.Request, metrics []models.Metrics) {
+	resp := make([]models.Metrics, 0, len(metrics))
+	for _, m := range metrics {
+		resp = append(resp, models.ForResponse(m))
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to marshal metrics: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// GetMetrics - POST /values/
+func (h *MetricHandler) GetMetrics(w http.ResponseWriter, r *http.Request) {
+	req, window, err := parseValuesRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	now := time.Now()
+	if len(req.Metrics) > 0 {
+		writeMetrics(w, r, h.storage.GetMany(req.Metrics, window, now))
+		return
+	}
+
+	writeMetrics(w, r, h.storage.Select(req.Type, req.Prefix, window, now))
+}
+
+// GetMetrics - POST /values/
+func (h *DBHandler) GetMetrics(w http.ResponseWriter, r *http.Request) {
+	req, window, err := parseValuesRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var metrics []models.Metrics
+	if len(req.Metrics) > 0 {
+		metrics, err = repository.GetMany(r.Context(), req.Metrics, window)
+	} else {
+		metrics, err = repository.Select(r.Context(), req.Type, req.Prefix, window)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeMetrics(w, r, metrics)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"metricapp/internal/logger"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"go.uber.org/zap"
+)
+
+const (
+	// Больше от клиента ничего осмысленного не ждем
+	wsMaxMessage = 4096
+	wsWriteWait  = 10 * time.Second
+)
+
+var errNotWebSocket = errors.New("not a websocket handshake")
+
+// isUpgrade - запрос просит переключиться на WebSocket. Остальные проверки рукопожатия делает websocket.Accept.
+func isUpgrade(r *http.Request) bool {
+	for _, v := range r.Header.Values("Upgrade") {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), "websocket") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// serveWebSocket - GET /ws, те же обновления и фильтры, что и /stream, по WebSocket.
+// Каждое обновление - текстовое сообщение с метрикой в JSON. Сообщения клиента читаются
+// и выбрасываются, на ping и закрытие отвечает библиотека. Медленный подписчик
+// получает закрытие с кодом 1008.
+func serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !isUpgrade(r) {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, r, errNotWebSocket)
+		return
+	}
+
+	// Подписываемся до рукопожатия, чтобы клиент не пропустил обновлений после него
+	sub := subscribeRequest(r)
+	defer updates.unsubscribe(sub)
+
+	// Ответ 101 не сжимается, даже если gzipHandler успел выставить заголовок
+	w.Header().Del("Content-Encoding")
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		// Ответ клиенту библиотека уже записала
+		logger.Ctx(r.Context()).Debug("websocket handshake failed", zap.Error(err))
+		return
+	}
+	defer conn.CloseNow()
+	conn.SetReadLimit(wsMaxMessage)
+
+	// После перехвата соединения контекст запроса не отменяется, когда клиент уходит:
+	// об этом сообщает читатель, отменяя ctx
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepalive := time.NewTicker(streamKeepAlive)
+	defer keepalive.Stop()
+
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-updates.done:
+			conn.Close(websocket.StatusGoingAway, "server is shutting down")
+			return
+		case m, ok := <-sub.ch:
+			if !ok {
+				conn.Close(websocket.StatusPolicyViolation, "slow consumer")
+				return
+			}
+
+			wctx, wcancel := context.WithTimeout(ctx, wsWriteWait)
+			err = wsjson.Write(wctx, conn, m)
+			wcancel()
+		case <-keepalive.C:
+			wctx, wcancel := context.WithTimeout(ctx, wsWriteWait)
+			err = conn.Ping(wctx)
+			wcancel()
+		}
+
+		if err != nil {
+			logger.Ctx(ctx).Debug("websocket write failed", zap.Error(err))
+			return
+		}
+	}
+}
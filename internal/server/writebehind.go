@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"metricapp/internal/logger"
+	models "metricapp/internal/model"
+	"metricapp/internal/repository"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// enableWriteBehind включает отложенную запись gauge и счетчиков: буфер сбрасывается
+// в базу раз в interval или когда в нем набирается size метрик
+func (h *DBHandler) enableWriteBehind(interval time.Duration, size int) {
+	h.wb = repository.NewWriteBehind(size)
+	go h.runWriteBehind(interval)
+}
+
+func (h *DBHandler) runWriteBehind(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.wb.Full():
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := h.flushPending(ctx); err != nil {
+			logger.Error("failed to flush buffered metrics", zap.Error(err))
+		}
+		cancel()
+	}
+}
+
+// flushPending пишет буфер отложенной записи в базу и рассылает записанное подписчикам
+func (h *DBHandler) flushPending(ctx context.Context) error {
+	if h.wb == nil {
+		return nil
+	}
+
+	refs, err := h.wb.Flush(ctx)
+	if err != nil {
+		return err
+	}
+	h.broadcast(ctx, refs)
+
+	return nil
+}
+
+// insertBatch пишет пакет с учетом отложенной записи: гистограммы, summary и множества
+// сразу уходят в базу, gauge и счетчики попадают в буфер. Запись в базу идет под замком буфера,
+// после проверки буферной части, поэтому пакет применяется целиком или не применяется вовсе.
+// Номера метрик в BatchError соответствуют исходному пакету.
+func (h *DBHandler) insertBatch(ctx context.Context, metrics []models.Metrics) error {
+	if h.wb == nil {
+		return repository.InsertBatch(ctx, metrics)
+	}
+
+	if err := models.ValidateBatch(metrics); err != nil {
+		return err
+	}
+
+	var (
+		direct  []models.Metrics
+		indexes []int
+	)
+	for i, m := range metrics {
+		if !h.wb.Buffered(m.MType) {
+			direct = append(direct, m)
+			indexes = append(indexes, i)
+		}
+	}
+
+	var write func() error
+	if len(direct) > 0 {
+		write = func() error {
+			err := repository.InsertBatch(ctx, direct)
+			var batchErr models.BatchError
+			if errors.As(err, &batchErr) {
+				for i := range batchErr {
+					batchErr[i].Index = indexes[batchErr[i].Index]
+				}
+				return batchErr
+			}
+			return err
+		}
+	}
+
+	return h.wb.AddBatch(metrics, write)
+}
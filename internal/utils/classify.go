@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Коды ошибок Postgres, после которых запрос можно повторить
+var pgRetryableCodes = map[string]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+	"53300": true, // too_many_connections
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+}
+
+// PgRetryable повторяет ошибки соединения с Postgres и временные отказы сервера.
+// Ошибки данных (нарушение ограничений, переполнение и т.п.) не повторяются:
+// тот же запрос упадет так же.
+func PgRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// Класс 08 - connection exception
+		return strings.HasPrefix(pgErr.Code, "08") || pgRetryableCodes[pgErr.Code]
+	}
+
+	var connErr *pgconn.ConnectError
+	if errors.As(err, &connErr) {
+		return true
+	}
+
+	return pgconn.SafeToRetry(err) || pgconn.Timeout(err) || NetRetryable(err)
+}
+
+// NetRetryable повторяет сетевые ошибки: таймауты, отказ в соединении, обрыв соединения
+func NetRetryable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF)
+}
@@ -1,54 +1,106 @@
 package utils
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"net/http"
+	"math/rand/v2"
 	"time"
 )
 
-var Delays = []int{
-	1,
-	3,
-	5,
+// Classifier решает, имеет ли смысл повторять операцию после ошибки
+type Classifier func(error) bool
+
+// Policy - политика повторов: пауза растет вдвое с каждой попыткой от Initial до Max,
+// половина паузы случайна, чтобы клиенты не повторяли запросы одновременно.
+type Policy struct {
+	Initial time.Duration
+	Max     time.Duration
+	// Сколько раз повторить операцию после первой неудачи, 0 - без повторов
+	Retries int
+	// Какие ошибки повторять. nil - повторять любые.
+	Retryable Classifier
+	// WaitHint позволяет ошибке самой задать паузу (например, по Retry-After), 0 - обычная пауза
+	WaitHint func(error) time.Duration
+	// OnRetry вызывается перед каждым повтором, attempt - номер неудачной попытки с единицы
+	OnRetry func(attempt int, err error, wait time.Duration)
 }
 
-func WithRetry(f func() error) error {
-	var err error
+// DefaultPolicy - политика по умолчанию: до трех повторов с паузами около 1, 2 и 4 секунд
+var DefaultPolicy = Policy{
+	Initial: 1 * time.Second,
+	Max:     5 * time.Second,
+	Retries: 3,
+}
 
-	for i := 0; i <= len(Delays); i++ {
-		if err = f(); err == nil {
-			return nil
-		}
+// Delay возвращает паузу перед повтором номер attempt (с нуля)
+func (p Policy) Delay(attempt int) time.Duration {
+	d := p.Initial
+	for i := 0; i < attempt && d < p.Max; i++ {
+		d *= 2
+	}
+	d = min(d, p.Max)
 
-		if i == len(Delays) {
-			break
-		}
-		time.Sleep(time.Duration(Delays[i]) * time.Second)
+	if half := d / 2; half > 0 {
+		return half + rand.N(half+1)
 	}
 
-	return err
+	return d
 }
 
-type HTTPClientWRetry struct {
-	client *http.Client
-}
+// Retry выполняет fn, пока она не вернет nil, неповторяемую ошибку или не кончатся попытки.
+// Отмена ctx прерывает ожидание между попытками сразу, ошибки контекста не повторяются.
+func Retry[T any](ctx context.Context, p Policy, fn func(context.Context) (T, error)) (T, error) {
+	for attempt := 0; ; attempt++ {
+		res, err := fn(ctx)
+		if err == nil {
+			return res, nil
+		}
 
-var DefaultClient = HTTPClientWRetry{
-	client: http.DefaultClient,
-}
+		if !p.retryable(err) {
+			return res, err
+		}
+		if attempt >= p.Retries {
+			return res, fmt.Errorf("failed after %d attempts: %w", attempt+1, err)
+		}
 
-func (c *HTTPClientWRetry) Do(req *http.Request) (*http.Response, error) {
-	for i := 0; i <= len(Delays); i++ {
-		if resp, err := c.client.Do(req); err == nil {
-			return resp, nil
+		wait := p.Delay(attempt)
+		if p.WaitHint != nil {
+			if hint := p.WaitHint(err); hint > 0 {
+				wait = hint
+			}
+		}
+		if p.OnRetry != nil {
+			p.OnRetry(attempt+1, err, wait)
 		}
 
-		if i == len(Delays) {
-			break
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			var zero T
+			return zero, ctx.Err()
+		case <-timer.C:
 		}
+	}
+}
+
+// Do - Retry для операций без результата
+func Do(ctx context.Context, p Policy, fn func(context.Context) error) error {
+	_, err := Retry(ctx, p, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, fn(ctx)
+	})
 
-		time.Sleep(time.Duration(Delays[i]) * time.Second)
+	return err
+}
+
+func (p Policy) retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if p.Retryable == nil {
+		return true
 	}
 
-	return nil, fmt.Errorf("failed to make request after %d attempts", len(Delays))
+	return p.Retryable(err)
 }
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetry(t *testing.T) {
+	p := Policy{Initial: time.Millisecond, Max: time.Millisecond, Retries: 3, Retryable: PgRetryable}
+
+	// Ошибка соединения повторяется, пока не пройдет
+	calls := 0
+	res, err := Retry(context.Background(), p, func(context.Context) (int, error) {
+		calls++
+		if calls < 3 {
+			return 0, &pgconn.PgError{Code: "08006"}
+		}
+		return 42, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 42, res)
+	assert.Equal(t, 3, calls)
+
+	// Нарушение ограничения не повторяется
+	calls = 0
+	err = Do(context.Background(), p, func(context.Context) error {
+		calls++
+		return &pgconn.PgError{Code: "23505"}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+
+	// Попытки заканчиваются
+	calls = 0
+	err = Do(context.Background(), p, func(context.Context) error {
+		calls++
+		return &pgconn.PgError{Code: "40001"}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 4, calls)
+}
+
+func TestRetry_ContextCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	p := Policy{Initial: time.Minute, Max: time.Minute, Retries: 3}
+	start := time.Now()
+	err := Do(ctx, p, func(context.Context) error {
+		return errors.New("temporary")
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE metrics ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+CREATE INDEX metrics_updated_at_idx ON metrics (updated_at);
+
+-- +goose Down
+DROP INDEX metrics_updated_at_idx;
+ALTER TABLE metrics DROP COLUMN updated_at;
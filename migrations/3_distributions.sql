@@ -0,0 +1,18 @@
+-- +goose Up
+ALTER TABLE metrics ADD COLUMN data JSONB;
+ALTER TABLE metrics DROP CONSTRAINT metrics_check;
+ALTER TABLE metrics ADD CONSTRAINT metrics_check CHECK (
+    (mtype = 'counter'   AND delta IS NOT NULL)
+ OR (mtype = 'gauge'     AND value IS NOT NULL)
+ OR (mtype = 'histogram' AND data IS NOT NULL)
+ OR (mtype = 'summary'   AND data IS NOT NULL)
+);
+
+-- +goose Down
+DELETE FROM metrics WHERE mtype IN ('histogram', 'summary');
+ALTER TABLE metrics DROP CONSTRAINT metrics_check;
+ALTER TABLE metrics ADD CONSTRAINT metrics_check CHECK (
+    (mtype = 'counter' AND delta IS NOT NULL)
+ OR (mtype = 'gauge'   AND value IS NOT NULL)
+);
+ALTER TABLE metrics DROP COLUMN data;
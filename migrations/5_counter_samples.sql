@@ -0,0 +1,10 @@
+-- +goose Up
+CREATE TABLE counter_samples (
+    id TEXT NOT NULL REFERENCES metrics (id) ON DELETE CASCADE,
+    ts TIMESTAMPTZ NOT NULL,
+    value BIGINT NOT NULL,
+    PRIMARY KEY (id, ts)
+);
+
+-- +goose Down
+DROP TABLE counter_samples;
@@ -0,0 +1,31 @@
+-- +goose Up
+-- Каждое изменение метрики рассылается в канал metrics_changed с ее id.
+-- Уведомления уходят при коммите транзакции, повторы внутри транзакции Postgres схлопывает.
+-- Пустой payload - сбросить все (TRUNCATE).
+-- +goose StatementBegin
+CREATE FUNCTION notify_metrics_changed() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'TRUNCATE' THEN
+        PERFORM pg_notify('metrics_changed', '');
+    ELSIF TG_OP = 'DELETE' THEN
+        PERFORM pg_notify('metrics_changed', OLD.id);
+    ELSE
+        PERFORM pg_notify('metrics_changed', NEW.id);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER metrics_changed
+    AFTER INSERT OR UPDATE OR DELETE ON metrics
+    FOR EACH ROW EXECUTE FUNCTION notify_metrics_changed();
+
+CREATE TRIGGER metrics_truncated
+    AFTER TRUNCATE ON metrics
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_metrics_changed();
+
+-- +goose Down
+DROP TRIGGER metrics_truncated ON metrics;
+DROP TRIGGER metrics_changed ON metrics;
+DROP FUNCTION notify_metrics_changed();
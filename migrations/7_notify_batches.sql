@@ -0,0 +1,36 @@
+-- +goose Up
+-- Payload уведомления - JSON-массив id измененных метрик, пустой - сбросить все (TRUNCATE).
+-- Пакетная запись выставляет metricapp.batch и сама отправляет одно уведомление на транзакцию,
+-- построчный триггер в ней молчит, иначе пакет из N метрик рассылал бы N уведомлений.
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION notify_metrics_changed() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'TRUNCATE' THEN
+        PERFORM pg_notify('metrics_changed', '');
+    ELSIF current_setting('metricapp.batch', true) = 'on' THEN
+        RETURN NULL;
+    ELSIF TG_OP = 'DELETE' THEN
+        PERFORM pg_notify('metrics_changed', json_build_array(OLD.id)::text);
+    ELSE
+        PERFORM pg_notify('metrics_changed', json_build_array(NEW.id)::text);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION notify_metrics_changed() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'TRUNCATE' THEN
+        PERFORM pg_notify('metrics_changed', '');
+    ELSIF TG_OP = 'DELETE' THEN
+        PERFORM pg_notify('metrics_changed', OLD.id);
+    ELSE
+        PERFORM pg_notify('metrics_changed', NEW.id);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
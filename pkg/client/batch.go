@@ -0,0 +1,71 @@
+package client
+
+import "context"
+
+// Batch накапливает метрики для отправки одним запросом /updates/
+type Batch struct {
+	metrics []Metrics
+}
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+func (b *Batch) Gauge(id string, value float64) *Batch {
+	b.metrics = append(b.metrics, Metrics{ID: id, MType: Gauge, Value: &value})
+	return b
+}
+
+func (b *Batch) Counter(id string, delta int64) *Batch {
+	b.metrics = append(b.metrics, Metrics{ID: id, MType: Counter, Delta: &delta})
+	return b
+}
+
+// Histogram добавляет приращение гистограммы с прошлой отправки
+func (b *Batch) Histogram(id string, h *HistogramData) *Batch {
+	b.metrics = append(b.metrics, Metrics{ID: id, MType: Histogram, Histogram: h})
+	return b
+}
+
+// Summary добавляет приращение summary с прошлой отправки
+func (b *Batch) Summary(id string, s *SummaryData) *Batch {
+	b.metrics = append(b.metrics, Metrics{ID: id, MType: Summary, Summary: s})
+	return b
+}
+
+// Set добавляет элементы множества
+func (b *Batch) Set(id string, elements ...string) *Batch {
+	b.metrics = append(b.metrics, Metrics{ID: id, MType: Set, Set: &SetData{Elements: elements}})
+	return b
+}
+
+// SetSketch добавляет скетч множества, собранный клиентом, см. NewHLL.
+// Сами элементы на сервер не передаются.
+func (b *Batch) SetSketch(id string, h *HLL) *Batch {
+	sketch, _ := h.MarshalBinary()
+	b.metrics = append(b.metrics, Metrics{ID: id, MType: Set, Set: &SetData{Sketch: sketch}})
+	return b
+}
+
+func (b *Batch) Add(metrics ...Metrics) *Batch {
+	b.metrics = append(b.metrics, metrics...)
+	return b
+}
+
+func (b *Batch) Len() int {
+	return len(b.metrics)
+}
+
+func (b *Batch) Metrics() []Metrics {
+	return b.metrics
+}
+
+// Send отправляет накопленные метрики и очищает пакет при успехе
+func (c *Client) Send(ctx context.Context, b *Batch) error {
+	if err := c.UpdateBatch(ctx, b.metrics); err != nil {
+		return err
+	}
+
+	b.metrics = b.metrics[:0]
+	return nil
+}
@@ -0,0 +1,313 @@
+// Package client - HTTP-клиент сервера сбора метрик.
+// Реализует контракт, описанный в api/openapi.yaml.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	models "metricapp/internal/model"
+	"metricapp/internal/utils"
+	"metricapp/internal/zip"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Metrics - метрика в формате API сервера
+type Metrics = models.Metrics
+
+// MetricRef - ссылка на метрику для Values
+type MetricRef = models.MetricRef
+
+// Данные гистограмм, summary и множеств, см. internal/model
+type (
+	HistogramData = models.HistogramData
+	SummaryData   = models.SummaryData
+	SetData       = models.SetData
+	HLL           = models.HLL
+)
+
+// NewHLL создает скетч множества, который можно наполнить на стороне клиента
+// и отправить вместо самих элементов
+func NewHLL() *HLL {
+	return models.NewHLL(models.DefaultPrecision)
+}
+
+const (
+	Gauge     = models.Gauge
+	Counter   = models.Counter
+	Histogram = models.Histogram
+	Summary   = models.Summary
+	Set       = models.Set
+)
+
+// RequestIDHeader - заголовок, по которому сервер связывает запрос со своими логами
+const RequestIDHeader = "X-Request-ID"
+
+// AgentIDHeader - заголовок, по которому сервер отличает агентов друг от друга (например, для лимита запросов)
+const AgentIDHeader = "X-Agent-ID"
+
+type requestIDKey struct{}
+
+// WithRequestID задает идентификатор, который клиент отправит в заголовке X-Request-ID.
+// Если идентификатор не задан, клиент сгенерирует его сам.
+// Повторные попытки одного запроса уходят с одним и тем же идентификатором.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestID(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok && id != "" {
+		return id
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type Client struct {
+	baseURL   string
+	http      *http.Client
+	backoff   Backoff
+	onRetry   func(RetryInfo)
+	gzip      bool
+	batchSize int
+	agentID   string
+}
+
+type Option func(*Client)
+
+// WithHTTPClient подменяет http.Client, через который отправляются запросы
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// WithBackoff задает политику повторов. Backoff{} отключает повторы.
+func WithBackoff(b Backoff) Option {
+	return func(c *Client) {
+		c.backoff = b
+	}
+}
+
+// WithRetryHook задает функцию, которая вызывается перед каждым повтором запроса.
+// Удобно для подсчета повторов и отказов сервера.
+func WithRetryHook(fn func(RetryInfo)) Option {
+	return func(c *Client) {
+		c.onRetry = fn
+	}
+}
+
+// WithoutGzip отключает сжатие тела запроса
+func WithoutGzip() Option {
+	return func(c *Client) {
+		c.gzip = false
+	}
+}
+
+// WithBatchSize ограничивает количество метрик в одном запросе /updates/,
+// больший пакет будет разбит на несколько запросов. 0 - без ограничения.
+func WithBatchSize(n int) Option {
+	return func(c *Client) {
+		c.batchSize = n
+	}
+}
+
+// WithAgentID задает идентификатор агента, который уходит в заголовке X-Agent-ID
+func WithAgentID(id string) Option {
+	return func(c *Client) {
+		c.agentID = id
+	}
+}
+
+// New создает клиента. address может быть как "host:port", так и полным URL.
+func New(address string, opts ...Option) *Client {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+
+	c := &Client{
+		baseURL: strings.TrimRight(address, "/"),
+		http:    http.DefaultClient,
+		backoff: DefaultBackoff,
+		gzip:    true,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// UpdateGauge - POST /update/gauge/{mName}/{mValue}
+func (c *Client) UpdateGauge(ctx context.Context, id string, value float64) error {
+	v := strconv.FormatFloat(value, 'f', -1, 64)
+	return c.do(ctx, http.MethodPost, c.path("update", Gauge, id, v), nil, nil)
+}
+
+// UpdateCounter - POST /update/counter/{mName}/{mValue}
+func (c *Client) UpdateCounter(ctx context.Context, id string, delta int64) error {
+	v := strconv.FormatInt(delta, 10)
+	return c.do(ctx, http.MethodPost, c.path("update", Counter, id, v), nil, nil)
+}
+
+// Update - POST /update/
+func (c *Client) Update(ctx context.Context, metric Metrics) error {
+	return c.do(ctx, http.MethodPost, c.baseURL+"/update/", metric, nil)
+}
+
+// UpdateBatch - POST /updates/
+func (c *Client) UpdateBatch(ctx context.Context, metrics []Metrics) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	size := c.batchSize
+	if size <= 0 {
+		size = len(metrics)
+	}
+
+	for start := 0; start < len(metrics); start += size {
+		end := min(start+size, len(metrics))
+		if err := c.do(ctx, http.MethodPost, c.baseURL+"/updates/", metrics[start:end], nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Value - POST /value/
+func (c *Client) Value(ctx context.Context, mType string, id string) (Metrics, error) {
+	var metric Metrics
+	req := Metrics{ID: id, MType: mType}
+	err := c.do(ctx, http.MethodPost, c.baseURL+"/value/", req, &metric)
+
+	return metric, err
+}
+
+// Values - POST /values/, несколько метрик за один запрос.
+// Отсутствующие метрики в ответ не попадают.
+func (c *Client) Values(ctx context.Context, refs ...MetricRef) ([]Metrics, error) {
+	var metrics []Metrics
+	err := c.do(ctx, http.MethodPost, c.baseURL+"/values/", refs, &metrics)
+
+	return metrics, err
+}
+
+// ValueText - GET /value/{mType}/{mName}, значение в текстовом виде
+func (c *Client) ValueText(ctx context.Context, mType string, id string) (string, error) {
+	var text string
+	err := c.do(ctx, http.MethodGet, c.path("value", mType, id), nil, &text)
+
+	return text, err
+}
+
+// Ping - GET /ping
+func (c *Client) Ping(ctx context.Context) error {
+	return c.do(ctx, http.MethodGet, c.baseURL+"/ping", nil, nil)
+}
+
+func (c *Client) path(parts ...string) string {
+	escaped := make([]string, 0, len(parts))
+	for _, p := range parts {
+		escaped = append(escaped, url.PathEscape(p))
+	}
+
+	return c.baseURL + "/" + strings.Join(escaped, "/")
+}
+
+// do отправляет запрос с повторами. payload сериализуется в JSON,
+// ответ декодируется в out (*string - текст ответа как есть).
+func (c *Client) do(ctx context.Context, method string, u string, payload any, out any) error {
+	var body []byte
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to marshal data: %w", err)
+		}
+
+		if c.gzip {
+			b, err = zip.GzipCompress(b)
+			if err != nil {
+				return fmt.Errorf("failed to compress data: %w", err)
+			}
+		}
+		body = b
+	}
+
+	id := requestID(ctx)
+
+	resp, err := utils.Retry(ctx, c.retryPolicy(), func(ctx context.Context) (*http.Response, error) {
+		return c.send(ctx, method, u, id, body)
+	})
+	if err != nil {
+		return err
+	}
+
+	return decodeResponse(resp, out)
+}
+
+// send выполняет одну попытку. Ответы с кодом 4xx и 5xx возвращаются как *Error.
+func (c *Client) send(ctx context.Context, method string, u string, id string, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set(RequestIDHeader, id)
+	if c.agentID != "" {
+		req.Header.Set(AgentIDHeader, c.agentID)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+		if c.gzip {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, readError(resp)
+	}
+
+	return resp, nil
+}
+
+func decodeResponse(resp *http.Response, out any) error {
+	defer resp.Body.Close()
+
+	switch v := out.(type) {
+	case nil:
+		_, err := io.Copy(io.Discard, resp.Body)
+		return err
+	case *string:
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("failed to read response: %w", err)
+		}
+		*v = string(b)
+		return nil
+	default:
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+		return nil
+	}
+}
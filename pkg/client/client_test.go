@@ -0,0 +1,124 @@
+package client
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_UpdateBatch(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Первая попытка падает, вторая должна пройти
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		assert.Equal(t, "/updates/", r.URL.Path)
+		assert.NotEmpty(t, r.Header.Get(RequestIDHeader))
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+
+		gz, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+
+		var metrics []Metrics
+		require.NoError(t, json.NewDecoder(gz).Decode(&metrics))
+		assert.Len(t, metrics, 2)
+	}))
+	defer server.Close()
+
+	c := New(server.URL, WithBackoff(Backoff{Initial: time.Millisecond, Max: time.Millisecond, Retries: 1}))
+	b := NewBatch().Gauge("Alloc", 1.5).Counter("PollCount", 3)
+	require.NoError(t, c.Send(context.Background(), b))
+	assert.Equal(t, int32(2), calls.Load())
+	assert.Zero(t, b.Len())
+}
+
+func TestClient_Error(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"code":404,"message":"unknown metric name","request_id":"abc"}`))
+	}))
+	defer server.Close()
+
+	c := New(server.URL, WithBackoff(Backoff{}))
+	_, err := c.Value(context.Background(), Gauge, "unknown")
+
+	var apiErr *Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	assert.Equal(t, "unknown metric name", apiErr.Message)
+	assert.Equal(t, "abc", apiErr.RequestID)
+}
+
+func TestClient_Backpressure(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		retryAfter    string
+		expectedCalls int32
+		expectedWait  time.Duration
+	}{
+		{"fail fast on 4xx", http.StatusBadRequest, "", 1, 0},
+		{"retry 500 with backoff", http.StatusInternalServerError, "", 3, 0},
+		{"honor Retry-After", http.StatusTooManyRequests, "1", 3, time.Second},
+		{"give up when asked to wait too long", http.StatusServiceUnavailable, "60", 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			var retries []RetryInfo
+			c := New(server.URL,
+				WithBackoff(Backoff{Initial: time.Millisecond, Max: time.Second, Retries: 2}),
+				WithRetryHook(func(info RetryInfo) { retries = append(retries, info) }),
+			)
+			err := c.Ping(context.Background())
+
+			var apiErr *Error
+			require.ErrorAs(t, err, &apiErr)
+			assert.Equal(t, tt.status, apiErr.StatusCode)
+			assert.Equal(t, tt.expectedCalls, calls.Load())
+			assert.Len(t, retries, int(tt.expectedCalls)-1)
+			if tt.expectedWait > 0 {
+				assert.Equal(t, tt.expectedWait, retries[0].Wait)
+				assert.Equal(t, tt.status, retries[0].StatusCode)
+			}
+		})
+	}
+}
+
+func TestClient_ContextCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	c := New(server.URL, WithBackoff(Backoff{Initial: time.Minute, Max: time.Minute, Retries: 1}))
+	start := time.Now()
+	err := c.Ping(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ItemError - ошибка одной метрики из пакета /updates/
+type ItemError struct {
+	Index int    `json:"index"`
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// Error - ответ сервера с ошибкой (схема APIError в api/openapi.yaml)
+type Error struct {
+	StatusCode int         `json:"-"`
+	Code       int         `json:"code"`
+	Message    string      `json:"message"`
+	RequestID  string      `json:"request_id,omitempty"`
+	Errors     []ItemError `json:"errors,omitempty"`
+	// Сколько сервер просит подождать перед повтором (заголовок Retry-After)
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *Error) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("server responded %d: %s (request id %s)", e.StatusCode, e.Message, e.RequestID)
+	}
+
+	return fmt.Sprintf("server responded %d: %s", e.StatusCode, e.Message)
+}
+
+// readError читает тело ответа с ошибкой и закрывает его, чтобы соединение вернулось в пул
+func readError(resp *http.Response) error {
+	defer resp.Body.Close()
+
+	apiErr := &Error{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil || json.Unmarshal(b, apiErr) != nil || apiErr.Message == "" {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+
+	return apiErr
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"errors"
+	"metricapp/internal/utils"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Backoff - политика повторов: пауза растет вдвое с каждой попыткой от Initial до Max,
+// к ней добавляется случайный разброс, чтобы агенты не били в сервер одновременно.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	// Сколько раз повторить запрос после первой неудачи, 0 - без повторов
+	Retries int
+}
+
+// DefaultBackoff - политика повторов по умолчанию
+var DefaultBackoff = Backoff{
+	Initial: 1 * time.Second,
+	Max:     10 * time.Second,
+	Retries: 3,
+}
+
+// Delay возвращает паузу перед повтором номер attempt (с нуля): половина
+// экспоненциальной паузы фиксирована, вторая половина случайна.
+func (b Backoff) Delay(attempt int) time.Duration {
+	return b.policy().Delay(attempt)
+}
+
+func (b Backoff) policy() utils.Policy {
+	return utils.Policy{Initial: b.Initial, Max: b.Max, Retries: b.Retries}
+}
+
+// RetryInfo - сведения о неудачной попытке, после которой клиент повторит запрос
+type RetryInfo struct {
+	// Номер неудачной попытки, с единицы
+	Attempt int
+	// HTTP-статус ответа, 0 - если ответа не было
+	StatusCode int
+	Err        error
+	Wait       time.Duration
+}
+
+// retryPolicy собирает политику повторов клиента.
+//
+// Ошибки сети и 5xx повторяются с экспоненциальной паузой. На 429 и 503 сервер
+// может попросить подождать заголовком Retry-After - тогда ждем сколько просят,
+// а если просят дольше Backoff.Max, сдаемся сразу. Остальные 4xx не повторяются:
+// тот же запрос получит тот же ответ.
+func (c *Client) retryPolicy() utils.Policy {
+	p := c.backoff.policy()
+	p.Retryable = func(err error) bool {
+		var apiErr *Error
+		if !errors.As(err, &apiErr) {
+			return utils.NetRetryable(err)
+		}
+
+		switch {
+		case apiErr.StatusCode == http.StatusTooManyRequests, apiErr.StatusCode == http.StatusServiceUnavailable:
+			return apiErr.RetryAfter <= c.backoff.Max
+		default:
+			return apiErr.StatusCode >= http.StatusInternalServerError
+		}
+	}
+	p.WaitHint = func(err error) time.Duration {
+		var apiErr *Error
+		if errors.As(err, &apiErr) {
+			return apiErr.RetryAfter
+		}
+		return 0
+	}
+	if c.onRetry != nil {
+		p.OnRetry = func(attempt int, err error, wait time.Duration) {
+			info := RetryInfo{Attempt: attempt, Err: err, Wait: wait}
+			var apiErr *Error
+			if errors.As(err, &apiErr) {
+				info.StatusCode = apiErr.StatusCode
+			}
+			c.onRetry(info)
+		}
+	}
+
+	return p
+}
+
+// parseRetryAfter разбирает Retry-After: число секунд или HTTP-дата
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+
+	if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+
+	return 0
+}